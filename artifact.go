@@ -1,50 +1,147 @@
 package pulse
 
 import (
-	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
+// Progress describes a state of an artifact download. It is reported by
+// ArtifactFetcher every time a chunk of a file is written to disk and once
+// more after the file is downloaded completely.
+type Progress struct {
+	File       string // path of the file being downloaded
+	N          int64  // number of bytes of the File downloaded so far
+	Size       int64  // size of the File or -1 if unknown
+	Total      int64  // number of bytes downloaded so far for all the files
+	TotalSize  int64  // size of all the files or -1 if unknown
+	Files      int    // number of files downloaded completely
+	Failed     int    // number of files, which failed to download
+	TotalFiles int    // number of all the files
+}
+
+// ProgressFunc is a callback used by ArtifactFetcher to report a progress
+// of a download. It must not block.
+type ProgressFunc func(Progress)
+
 // ArtifactFetcher is type for fetching artifacts based on info from BuildArtifact type
 type ArtifactFetcher struct {
-	Client        *http.Client
+	Client *http.Client
+	// Progress, when non-nil, is called to report a progress of a download.
+	// The total size of all the files is obtained with HEAD requests, which
+	// are sent only when Progress is set.
+	Progress ProgressFunc
+	// Cache, when non-nil, is consulted before downloading a file and stores
+	// every file of a known size after it is downloaded.
+	Cache         *ArtifactCache
 	tok, dir, url string
 }
 
-var errEmptyRes = errors.New("fakerpc: empty response")
+// ArtifactHTTPError is returned when Pulse server responds with a non-2xx
+// status code to a request for downloading or uploading an artifact file.
+type ArtifactHTTPError struct {
+	Status int
+	URL    string
+	File   string
+}
+
+func (e *ArtifactHTTPError) Error() string {
+	return fmt.Sprintf("pulse: error fetching artifact: status=%d %s, file=%s, url=%s",
+		e.Status, http.StatusText(e.Status), e.File, e.URL)
+}
+
+// ArtifactErrors is a list of errors for every artifact file, which has failed
+// to download.
+type ArtifactErrors []error
+
+func (e ArtifactErrors) Error() string {
+	s := make([]string, len(e))
+	for i := range e {
+		s[i] = e[i].Error()
+	}
+	return strings.Join(s, "\n")
+}
 
 // NewArtifactFetcher returns new ArtifactFetcher
 func NewArtifactFetcher(url, tok, dir string) *ArtifactFetcher {
 	return &ArtifactFetcher{Client: &http.Client{}, tok: tok, dir: dir, url: url}
 }
 
+// artifactFile is a single file of an artifact.
+type artifactFile struct {
+	path string
+	url  string
+	head *fileHead // nil until a HEAD request is sent for the file
+}
+
+// fileHead describes a file as given by a response to a HEAD request.
+type fileHead struct {
+	size int64  // Content-Length or -1 if unknown
+	key  string // cache key, empty if the content of the file is unknown
+}
+
 // Fetch prepares file paths to save artifact files and calls downloadFile
-func (af *ArtifactFetcher) Fetch(a *BuildArtifact, project string) (err error) {
-	var link string
-	if link, err = url.QueryUnescape(a.Permalink); err != nil {
-		return err
-	}
-	basepath := filepath.Join(af.dir, project, a.Stage, a.Command, a.Name)
-	urls := af.buildURLs(link, a.Files)
-	for i := range a.Files {
-		path := filepath.Join(basepath, filepath.Dir(a.Files[i]))
+func (af *ArtifactFetcher) Fetch(a *BuildArtifact, project string) error {
+	return af.FetchAll([]BuildArtifact{*a}, project)
+}
 
-		if _, err = os.Stat(path); os.IsNotExist(err) {
+// FetchAll behaves like Fetch, but it downloads files of all the given artifacts,
+// reporting a progress for them as a whole. A failure of a single file does not
+// stop the download - all the errors are collected and returned as ArtifactErrors.
+func (af *ArtifactFetcher) FetchAll(a []BuildArtifact, project string) error {
+	var files []artifactFile
+	for i := range a {
+		f, err := af.files(&a[i], project)
+		if err != nil {
+			return err
+		}
+		files = append(files, f...)
+	}
+	var errs ArtifactErrors
+	p := &Progress{TotalFiles: len(files)}
+	if af.Progress != nil {
+		p.TotalSize = af.size(files)
+	}
+	for i := range files {
+		path := filepath.Dir(files[i].path)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
 			if err = os.MkdirAll(path, 0755); err != nil {
 				return err
 			}
 		}
-		if err = af.fetchSingle(filepath.Join(path, filepath.Base(a.Files[i])), urls[i]); err != nil {
-			return err
+		if err := af.fetchSingle(&files[i], p); err != nil {
+			errs = append(errs, err)
+			p.Failed++
+			if af.Progress != nil {
+				af.Progress(*p)
+			}
 		}
 	}
+	if len(errs) != 0 {
+		return errs
+	}
 	return nil
 }
 
+// files gives local paths and URLs for every file of the artifact.
+func (af *ArtifactFetcher) files(a *BuildArtifact, project string) ([]artifactFile, error) {
+	link, err := url.QueryUnescape(a.Permalink)
+	if err != nil {
+		return nil, err
+	}
+	basepath := filepath.Join(af.dir, project, a.Stage, a.Command, a.Name)
+	urls := af.buildURLs(link, a.Files)
+	files := make([]artifactFile, len(a.Files))
+	for i := range a.Files {
+		files[i] = artifactFile{path: filepath.Join(basepath, a.Files[i]), url: urls[i]}
+	}
+	return files, nil
+}
+
 // buildURLs builds URLs to download files within artifact
 func (af *ArtifactFetcher) buildURLs(link string, files []string) []string {
 	links := make([]string, len(files))
@@ -54,8 +151,75 @@ func (af *ArtifactFetcher) buildURLs(link string, files []string) []string {
 	return links
 }
 
-// fetchSingle downloads file from url and saves it as filename
-func (af *ArtifactFetcher) fetchSingle(filename string, url string) error {
+// size sums up Content-Length of every file. It returns -1 if a size of any
+// of the files is unknown. The responses are kept with the files, so they
+// are not requested again when the files are looked up in the cache.
+func (af *ArtifactFetcher) size(files []artifactFile) (n int64) {
+	for i := range files {
+		files[i].head = af.head(files[i].url)
+		if n >= 0 && files[i].head.size >= 0 {
+			n += files[i].head.size
+		} else {
+			n = -1
+		}
+	}
+	return n
+}
+
+// head describes a file with a response to a HEAD request. The size of
+// the file is -1 if the request fails.
+func (af *ArtifactFetcher) head(url string) *fileHead {
+	fh := &fileHead{size: -1}
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return fh
+	}
+	req.Header.Add("PULSE_API_TOKEN", af.tok)
+	resp, err := af.Client.Do(req)
+	if err != nil {
+		return fh
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fh
+	}
+	fh.size, fh.key = resp.ContentLength, cacheKey(url, resp.ContentLength, resp.Header)
+	return fh
+}
+
+// fetchCached places a file from the cache at its path. It returns false
+// if the cache does not have the file, or the file can not be cached.
+func (af *ArtifactFetcher) fetchCached(f *artifactFile, p *Progress) (bool, error) {
+	if f.head == nil {
+		f.head = af.head(f.url)
+	}
+	size := f.head.size
+	if f.head.key == "" {
+		return false, nil
+	}
+	ok, err := af.Cache.Get(f.head.key, f.path)
+	if !ok || err != nil {
+		return false, err
+	}
+	p.File, p.N, p.Size = f.path, size, size
+	p.Total += size
+	p.Files++
+	if af.Progress != nil {
+		af.Progress(*p)
+	}
+	return true, nil
+}
+
+// fetchSingle downloads file from its url and saves it under its path. A response
+// of an unknown length is read until EOF, an empty one creates an empty file.
+// When the download fails, the partially written file is removed.
+func (af *ArtifactFetcher) fetchSingle(f *artifactFile, p *Progress) (err error) {
+	if af.Cache != nil {
+		if ok, err := af.fetchCached(f, p); ok || err != nil {
+			return err
+		}
+	}
+	filename, url := f.path, f.url
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return err
@@ -67,18 +231,165 @@ func (af *ArtifactFetcher) fetchSingle(filename string, url string) error {
 	}
 	defer resp.Body.Close()
 
-	if resp.ContentLength == 0 {
-		return errEmptyRes
+	if resp.StatusCode/100 != 2 {
+		return &ArtifactHTTPError{Status: resp.StatusCode, URL: url, File: filename}
+	}
+	// The file may be a hard link to a cached one, which must not be truncated.
+	if err = os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return err
 	}
 	file, err := os.Create(filename)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	defer func() {
+		if e := file.Close(); e != nil && err == nil {
+			err = e
+		}
+		if err != nil {
+			os.Remove(filename)
+		}
+	}()
 
-	if _, err := io.Copy(file, resp.Body); err != nil {
+	p.File, p.N, p.Size = filename, 0, resp.ContentLength
+	var w io.Writer = file
+	if af.Progress != nil {
+		w = &progressWriter{w: file, p: p, fn: af.Progress}
+	}
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
 		return err
 	}
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		return io.ErrUnexpectedEOF
+	}
+	if af.Cache != nil {
+		// A failure to populate the cache must not fail the download.
+		af.Cache.Put(cacheKey(url, resp.ContentLength, resp.Header), filename)
+	}
+	p.Files++
+	if af.Progress != nil {
+		af.Progress(*p)
+	}
+	return nil
+}
+
+// progressWriter reports every write to the underlying writer.
+type progressWriter struct {
+	w  io.Writer
+	p  *Progress
+	fn ProgressFunc
+}
+
+func (pw *progressWriter) Write(b []byte) (int, error) {
+	n, err := pw.w.Write(b)
+	pw.p.N += int64(n)
+	pw.p.Total += int64(n)
+	pw.fn(*pw.p)
+	return n, err
+}
+
+// ArtifactUploader is type for uploading local files as an artifact of
+// an existing build. The files are sent with HTTP PUT under the artifacts
+// of the build in the Pulse web UI, so they are listed on the build page.
+type ArtifactUploader struct {
+	Client   *http.Client
+	tok, url string
+}
 
+// NewArtifactUploader returns new ArtifactUploader
+func NewArtifactUploader(url, tok string) *ArtifactUploader {
+	return &ArtifactUploader{Client: &http.Client{}, tok: tok, url: url}
+}
+
+// Upload sends every file as a part of an artifact with a given name, which is
+// attached to the build of the project, or to the personal build for
+// the ProjectPersonal. Relative paths of the files are kept within
+// the artifact, other files are put at its top. Files of the same path
+// are refused before anything is sent. A failure of a single file does
+// not stop the upload - all the errors are collected and returned as
+// ArtifactErrors.
+func (au *ArtifactUploader) Upload(project string, id int64, name string, files []string) error {
+	paths := make([]string, len(files))
+	seen := make(map[string]string, len(files))
+	for i, file := range files {
+		paths[i] = artifactPath(file)
+		if f, ok := seen[paths[i]]; ok {
+			return fmt.Errorf("pulse: %s and %s would be uploaded as the same file %s", f, file, paths[i])
+		}
+		seen[paths[i]] = file
+	}
+	var errs ArtifactErrors
+	for i, file := range files {
+		if err := au.uploadSingle(file, au.url+au.path(project, id, name, paths[i])); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+// artifactPath gives a slash-separated path of the file within an artifact,
+// which is the relative path of the file, or its base name if the path is
+// absolute or goes up the current directory.
+func artifactPath(file string) string {
+	file = filepath.Clean(file)
+	if filepath.IsAbs(file) || file == ".." || strings.HasPrefix(file, ".."+string(filepath.Separator)) {
+		return filepath.Base(file)
+	}
+	return filepath.ToSlash(file)
+}
+
+// path gives an escaped URL path of the file among artifacts of the build,
+// which are laid out as artifact/file. Every segment is escaped separately.
+func (au *ArtifactUploader) path(project string, id int64, name, file string) string {
+	var p string
+	if project == ProjectPersonal {
+		p = fmt.Sprintf("/dashboard/my/%d/artifacts/", id)
+	} else {
+		p = fmt.Sprintf("/browse/projects/%s/builds/%d/artifacts/", pathEscape(project), id)
+	}
+	seg := strings.Split(file, "/")
+	for i := range seg {
+		seg[i] = pathEscape(seg[i])
+	}
+	return p + pathEscape(name) + "/" + strings.Join(seg, "/")
+}
+
+// pathEscape escapes the string as a single segment of an URL path, so
+// a space becomes %20 instead of + and a slash does not start a new segment.
+func pathEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// uploadSingle sends the file as a body of a PUT request. The file is streamed,
+// so it is never read into memory as a whole.
+func (au *ArtifactUploader) uploadSingle(filename, url string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", url, file)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = fi.Size()
+	req.Header.Add("PULSE_API_TOKEN", au.tok)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := au.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return &ArtifactHTTPError{Status: resp.StatusCode, URL: url, File: filename}
+	}
 	return nil
 }
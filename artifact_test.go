@@ -1,7 +1,312 @@
 package pulse
 
-import "testing"
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestFetch(t *testing.T) {
 	t.Skip("TODO(ppieprzyk)")
 }
+
+func artifactFixture(t *testing.T, files map[string]string) (*ArtifactFetcher, string, func()) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("PULSE_API_TOKEN") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		s, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, "/plain/") {
+			w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum([]byte(s))))
+		}
+		if strings.HasPrefix(r.URL.Path, "/chunked/") {
+			// Flushing before writing the body makes the response chunked.
+			w.(http.Flusher).Flush()
+		}
+		w.Write([]byte(s))
+	}))
+	dir, err := ioutil.TempDir("", "pulsekit")
+	if err != nil {
+		srv.Close()
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	return NewArtifactFetcher(srv.URL, "token", dir), dir, func() { srv.Close(); os.RemoveAll(dir) }
+}
+
+func TestFetchAllProgress(t *testing.T) {
+	af, dir, teardown := artifactFixture(t, map[string]string{
+		"/art/a/x.txt": "xxx",
+		"/art/b/y.txt": strings.Repeat("y", 1024),
+	})
+	defer teardown()
+	var p []Progress
+	af.Progress = func(pr Progress) { p = append(p, pr) }
+	a := []BuildArtifact{{
+		Stage:     "Stage",
+		Command:   "Command",
+		Name:      "Name",
+		Permalink: "/art",
+		Files:     []string{"a/x.txt", "b/y.txt"},
+	}}
+	if err := af.FetchAll(a, "Project"); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	if len(p) == 0 {
+		t.Fatal("expected len(p) to be non-zero")
+	}
+	last := p[len(p)-1]
+	exp := Progress{
+		File:       filepath.Join(dir, "Project", "Stage", "Command", "Name", "b", "y.txt"),
+		N:          1024,
+		Size:       1024,
+		Total:      1027,
+		TotalSize:  1027,
+		Files:      2,
+		TotalFiles: 2,
+	}
+	if last != exp {
+		t.Errorf("expected last=%+v, was %+v instead", exp, last)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "Project", "Stage", "Command", "Name", "a", "x.txt"))
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	if string(b) != "xxx" {
+		t.Errorf(`expected b to be "xxx", was %q instead`, b)
+	}
+}
+
+func TestFetchAllErrors(t *testing.T) {
+	af, dir, teardown := artifactFixture(t, map[string]string{
+		"/art/empty.txt":       "",
+		"/chunked/art/big.txt": strings.Repeat("z", 64*1024),
+	})
+	defer teardown()
+	a := []BuildArtifact{{
+		Name:      "Name",
+		Permalink: "/art",
+		Files:     []string{"missing.txt", "empty.txt"},
+	}, {
+		Name:      "Chunked",
+		Permalink: "/chunked/art",
+		Files:     []string{"big.txt"},
+	}}
+	err := af.FetchAll(a, "Project")
+	errs, ok := err.(ArtifactErrors)
+	if !ok {
+		t.Fatalf("expected err to be of ArtifactErrors type, was %T instead", err)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("expected len(errs) to be 1, was %d instead", len(errs))
+	}
+	e, ok := errs[0].(*ArtifactHTTPError)
+	if !ok {
+		t.Fatalf("expected errs[0] to be of *ArtifactHTTPError type, was %T instead", errs[0])
+	}
+	missing := filepath.Join(dir, "Project", "Name", "missing.txt")
+	if e.Status != http.StatusNotFound || e.File != missing {
+		t.Errorf("expected status=404, file=%q; was status=%d, file=%q", missing, e.Status, e.File)
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("expected %q to not exist, err=%v", missing, err)
+	}
+	sizes := map[string]int64{
+		filepath.Join(dir, "Project", "Name", "empty.txt"):  0,
+		filepath.Join(dir, "Project", "Chunked", "big.txt"): 64 * 1024,
+	}
+	for path, size := range sizes {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Errorf("expected err to be nil, was %q instead", err)
+			continue
+		}
+		if fi.Size() != size {
+			t.Errorf("expected size of %q to be %d, was %d instead", path, size, fi.Size())
+		}
+	}
+}
+
+func TestUpload(t *testing.T) {
+	up := make(map[string]string)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || r.Header.Get("PULSE_API_TOKEN") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		up[r.RequestURI] = string(b)
+	}))
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "pulsekit")
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "qa 1.log")
+	if err = ioutil.WriteFile(file, []byte("log"), 0644); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	au := NewArtifactUploader(srv.URL, "token")
+	err = au.Upload("Pulse CLI", 12, "qa-logs", []string{file, filepath.Join(dir, "missing.log")})
+	if errs, ok := err.(ArtifactErrors); !ok || len(errs) != 1 {
+		t.Errorf("expected err to be ArtifactErrors with 1 error, was %v instead", err)
+	}
+	if err = au.Upload(ProjectPersonal, 12, "qa-logs", []string{file}); err != nil {
+		t.Errorf("expected err to be nil, was %q instead", err)
+	}
+	expected := map[string]string{
+		"/browse/projects/Pulse%20CLI/builds/12/artifacts/qa-logs/qa%201.log": "log",
+		"/dashboard/my/12/artifacts/qa-logs/qa%201.log":                       "log",
+	}
+	if !reflect.DeepEqual(up, expected) {
+		t.Errorf("expected up to be %v, was %v instead", expected, up)
+	}
+	other := filepath.Join(dir, "other")
+	if err = os.Mkdir(other, 0755); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(other, "qa 1.log"), []byte("log"), 0644); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	up = make(map[string]string)
+	err = au.Upload("Pulse CLI", 12, "qa-logs", []string{file, filepath.Join(other, "qa 1.log")})
+	if err == nil || len(up) != 0 {
+		t.Errorf("expected files of the same name to be refused, was err=%v, up=%v instead", err, up)
+	}
+}
+
+func TestArtifactUploaderPath(t *testing.T) {
+	au := NewArtifactUploader("", "")
+	table := []struct {
+		project, file, path string
+	}{
+		{"Pulse CLI", "a/log.txt", "/browse/projects/Pulse%20CLI/builds/12/artifacts/qa%3Flogs/a/log.txt"},
+		{"LM-X/Tier 1", "b/log.txt", "/browse/projects/LM-X%2FTier%201/builds/12/artifacts/qa%3Flogs/b/log.txt"},
+		{"Pulse?CLI", "../log#1.txt", "/browse/projects/Pulse%3FCLI/builds/12/artifacts/qa%3Flogs/log%231.txt"},
+		{ProjectPersonal, "/tmp/a b/log.txt", "/dashboard/my/12/artifacts/qa%3Flogs/log.txt"},
+	}
+	for i, tt := range table {
+		if p := au.path(tt.project, 12, "qa?logs", artifactPath(filepath.FromSlash(tt.file))); p != tt.path {
+			t.Errorf("expected path to be %q, was %q instead (i=%d)", tt.path, p, i)
+		}
+	}
+}
+
+func TestFetchAllCache(t *testing.T) {
+	n := make(map[string]int)
+	files := map[string]string{
+		"/1/art/lib.so":     "binary",
+		"/2/art/lib.so":     "binary",
+		"/plain/art/lib.so": "binary",
+	}
+	af, dir, teardown := artifactFixture(t, files)
+	defer teardown()
+	af.Client = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		n[req.Method]++
+		return http.DefaultTransport.RoundTrip(req)
+	})}
+	ac, err := NewArtifactCache(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	af.Cache = ac
+	for i := 0; i < 2; i++ {
+		for _, link := range []string{"/1/art", "/2/art"} {
+			a := []BuildArtifact{{Name: link[1:2], Permalink: link, Files: []string{"lib.so"}}}
+			if err := af.FetchAll(a, "Project"); err != nil {
+				t.Fatalf("expected err to be nil, was %q instead (i=%d)", err, i)
+			}
+		}
+	}
+	// The same file fetched from another build's permalink is served from the cache.
+	if n["GET"] != 1 || n["HEAD"] != 4 {
+		t.Errorf("expected 1 download and 4 HEAD requests, was %v instead", n)
+	}
+	for _, name := range []string{"1", "2"} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, "Project", name, "lib.so"))
+		if err != nil || string(b) != "binary" {
+			t.Errorf(`expected file to be "binary", was %q instead (err=%v)`, b, err)
+		}
+	}
+	// A rebuilt file of the same size must not be served from the cache.
+	files["/1/art/lib.so"] = "BINARY"
+	af.Progress = func(Progress) {}
+	a := []BuildArtifact{{Name: "1", Permalink: "/1/art", Files: []string{"lib.so"}}}
+	if err = af.FetchAll(a, "Project"); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "Project", "1", "lib.so")); err != nil || string(b) != "BINARY" {
+		t.Errorf(`expected file to be "BINARY", was %q instead (err=%v)`, b, err)
+	}
+	if n["GET"] != 2 || n["HEAD"] != 5 {
+		t.Errorf("expected 2 downloads and 5 HEAD requests, was %v instead", n)
+	}
+	objs, err := filepath.Glob(filepath.Join(dir, "cache", "objects", "*", "*"))
+	if err != nil || len(objs) != 2 {
+		t.Errorf("expected 2 cached objects, was %v instead (err=%v)", objs, err)
+	}
+	used, err := filepath.Glob(filepath.Join(dir, "cache", "used", "*"))
+	if err != nil || len(used) != 2 {
+		t.Errorf("expected 2 use records, was %v instead (err=%v)", used, err)
+	}
+	old := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+	for _, path := range append(objs, used...) {
+		if err = os.Chtimes(path, old, old); err != nil {
+			t.Fatalf("expected err to be nil, was %q instead", err)
+		}
+	}
+	// Storing a file, which is cached already, records its use.
+	if err = ac.Put("", filepath.Join(dir, "Project", "2", "lib.so")); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	if n, _, err := ac.Prune(time.Hour); err != nil || n != 1 {
+		t.Errorf("expected to prune 1 file, was %d instead (err=%v)", n, err)
+	}
+	// Placing a file from the cache leaves its modification time untouched.
+	a = []BuildArtifact{{Name: "2", Permalink: "/2/art", Files: []string{"lib.so"}}}
+	if err = af.FetchAll(a, "Project"); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	fi, err := os.Stat(filepath.Join(dir, "Project", "2", "lib.so"))
+	if err != nil || !fi.ModTime().Equal(old) {
+		t.Errorf("expected modification time to be %v, was %v instead (err=%v)", old, fi.ModTime(), err)
+	}
+	// A file served without ETag is downloaded, but shares the cached content.
+	a = []BuildArtifact{{Name: "plain", Permalink: "/plain/art", Files: []string{"lib.so"}}}
+	if err = af.FetchAll(a, "Project"); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	if n["GET"] != 3 || n["HEAD"] != 7 {
+		t.Errorf("expected 3 downloads and 7 HEAD requests, was %v instead", n)
+	}
+	plain, err := os.Stat(filepath.Join(dir, "Project", "plain", "lib.so"))
+	if err != nil || !os.SameFile(fi, plain) {
+		t.Errorf("expected file to be linked to the cached one (err=%v)", err)
+	}
+	if n, _, err := ac.Prune(0); err != nil || n != 1 {
+		t.Errorf("expected to prune 1 file, was %d instead (err=%v)", n, err)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (fn roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return fn(req)
+}
@@ -0,0 +1,261 @@
+package pulse
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ArtifactCache is a local storage of artifact files shared across builds
+// and projects. Files are stored once per their content and are looked up
+// by a key, which identifies the content of a file - its size and ETag - so
+// the same file is served from the cache no matter which build's permalink
+// it is fetched from, while a rebuilt file is never served from it. Files
+// served with a Last-Modified header only are looked up by their permalink
+// as well. Files served without any of the headers are downloaded every time,
+// but are still stored by their content, so identical files share the space.
+//
+// Files are placed into an output directory as hard links when possible,
+// falling back to copying otherwise. A hard-linked file must not be modified
+// in place, as it would modify the cached content as well. The last use of
+// a file is recorded separately, so the modification time of the placed
+// files is left untouched.
+type ArtifactCache struct {
+	dir string
+}
+
+// NewArtifactCache returns new ArtifactCache, which stores files in the given
+// directory. The directory is created if it does not exist.
+func NewArtifactCache(dir string) (*ArtifactCache, error) {
+	for _, d := range []string{"index", "objects", "used"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &ArtifactCache{dir: dir}, nil
+}
+
+var errCorrupted = errors.New("pulse: corrupted cache index entry")
+
+// cacheKey gives a cache key for a file served from the given URL with
+// the given size and response headers. It returns an empty string if the
+// headers do not identify the content of the file.
+func cacheKey(url string, size int64, h http.Header) string {
+	if size < 0 {
+		return ""
+	}
+	if v := h.Get("ETag"); v != "" {
+		return "etag\x00" + strconv.FormatInt(size, 10) + "\x00" + v
+	}
+	if v := h.Get("Last-Modified"); v != "" {
+		return url + "\x00" + strconv.FormatInt(size, 10) + "\x00" + v
+	}
+	return ""
+}
+
+func (ac *ArtifactCache) index(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return filepath.Join(ac.dir, "index", hex.EncodeToString(sum[:]))
+}
+
+func (ac *ArtifactCache) object(hash string) string {
+	return filepath.Join(ac.dir, "objects", hash[:2], hash[2:])
+}
+
+func (ac *ArtifactCache) used(hash string) string {
+	return filepath.Join(ac.dir, "used", hash)
+}
+
+// touch records the file with the given hash was used just now.
+func (ac *ArtifactCache) touch(hash string) error {
+	now, path := time.Now(), ac.used(hash)
+	if err := os.Chtimes(path, now, now); !os.IsNotExist(err) {
+		return err
+	}
+	return writeFile(path, nil)
+}
+
+// lastUsed gives the time the file was last used at, which is the time
+// it was stored at if its use was never recorded.
+func (ac *ArtifactCache) lastUsed(hash string, fi os.FileInfo) time.Time {
+	if u, err := os.Stat(ac.used(hash)); err == nil {
+		return u.ModTime()
+	}
+	return fi.ModTime()
+}
+
+// lookup gives a hash of a cached file the index entry points at.
+func (ac *ArtifactCache) lookup(index string) (string, error) {
+	b, err := ioutil.ReadFile(index)
+	if err != nil {
+		return "", err
+	}
+	hash := strings.TrimSpace(string(b))
+	if len(hash) != 2*sha1.Size {
+		return "", errCorrupted
+	}
+	if _, err = os.Stat(ac.object(hash)); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+// Get places a cached file for the given key at the dst path. It returns false
+// if the cache does not have the file.
+func (ac *ArtifactCache) Get(key, dst string) (bool, error) {
+	hash, err := ac.lookup(ac.index(key))
+	if os.IsNotExist(err) || err == errCorrupted {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err = link(ac.object(hash), dst); err != nil {
+		return false, err
+	}
+	return true, ac.touch(hash)
+}
+
+// Put stores a file from the src path under the given key. A file with
+// the same content is stored only once, no matter how many keys it has;
+// if it is stored already, the src file is replaced with the stored one.
+// An empty key stores the file without making it possible to look it up.
+func (ac *ArtifactCache) Put(key, src string) error {
+	hash, err := hashFile(src)
+	if err != nil {
+		return err
+	}
+	obj := ac.object(hash)
+	fi, err := os.Stat(obj)
+	switch {
+	case os.IsNotExist(err):
+		if err = os.MkdirAll(filepath.Dir(obj), 0755); err != nil {
+			return err
+		}
+		if err = link(src, obj); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	default:
+		if si, err := os.Stat(src); err == nil && !os.SameFile(fi, si) {
+			if err = link(obj, src); err != nil {
+				return err
+			}
+		}
+	}
+	if err = ac.touch(hash); err != nil {
+		return err
+	}
+	if key == "" {
+		return nil
+	}
+	return writeFile(ac.index(key), []byte(hash))
+}
+
+// Prune removes files, which were not used for longer than the given duration,
+// and index entries pointing at the removed files. It returns the number
+// and the total size of the removed files.
+func (ac *ArtifactCache) Prune(age time.Duration) (n int, size int64, err error) {
+	dir, t := filepath.Join(ac.dir, "objects"), time.Now().Add(-age)
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		hash := filepath.Base(filepath.Dir(path)) + fi.Name()
+		if !ac.lastUsed(hash, fi).Before(t) {
+			return nil
+		}
+		if err = os.Remove(path); err != nil {
+			return err
+		}
+		if err = os.Remove(ac.used(hash)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		n, size = n+1, size+fi.Size()
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	idx, err := ioutil.ReadDir(filepath.Join(ac.dir, "index"))
+	if err != nil {
+		return
+	}
+	for _, fi := range idx {
+		path := filepath.Join(ac.dir, "index", fi.Name())
+		if _, e := ac.lookup(path); e != nil {
+			if err = os.Remove(path); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha1.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// link hard links src to dst, falling back to copying when linking is not
+// possible (e.g. the paths are on different devices). An existing dst file
+// is replaced.
+func link(src, dst string) error {
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if os.Link(src, dst) == nil {
+		return nil
+	}
+	s, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	d, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(d, s); err != nil {
+		d.Close()
+		os.Remove(dst)
+		return err
+	}
+	return d.Close()
+}
+
+// writeFile writes the file atomically, so concurrent readers never see
+// a partially written one.
+func writeFile(path string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
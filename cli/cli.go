@@ -1,21 +1,38 @@
 package cli
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/smtp"
 	"net/url"
 	"os"
+	"os/signal"
 	"os/user"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/x-formation/pulsekit"
 	"github.com/x-formation/pulsekit/dev"
+	"github.com/x-formation/pulsekit/nagios"
+	"github.com/x-formation/pulsekit/prom"
 	"github.com/x-formation/pulsekit/prtg"
+	"github.com/x-formation/pulsekit/report"
+	"github.com/x-formation/pulsekit/secret"
+	"github.com/x-formation/pulsekit/top"
 	"github.com/x-formation/pulsekit/util"
+	"github.com/x-formation/pulsekit/watch"
 
 	"github.com/codegangsta/cli"
 	"gopkg.in/v1/yaml"
@@ -38,53 +55,207 @@ var defaultOut = func(args ...interface{}) {
 // Creds holds information required to authenticate an user session from
 // the Pulse Remote API endpoint.
 type Creds struct {
-	URL  string
-	User string
-	Pass string
+	URL  string `yaml:"url"`
+	User string `yaml:"user"`
+	Pass string `yaml:"pass,omitempty"`
+	// Store is a name of a secret store the password is kept in, empty if it
+	// is kept in the Pass field.
+	Store string `yaml:"store,omitempty"`
 }
 
-// CredsStore persists the Creds struct.
+// Profile holds Creds of a Pulse server together with default values of
+// global flags, which are used when the flags are not given.
+type Profile struct {
+	Creds   `yaml:",inline"`
+	Timeout string `yaml:"timeout,omitempty"`
+	Project string `yaml:"project,omitempty"`
+	Monitor string `yaml:"monitor,omitempty"`
+}
+
+// DefaultProfile is a name of the profile used when no other was chosen.
+const DefaultProfile = "default"
+
+// Config holds named profiles of Pulse servers.
+type Config struct {
+	// Default is a name of the profile used when --profile is not given.
+	Default  string              `yaml:"default,omitempty"`
+	Profiles map[string]*Profile `yaml:"profiles,omitempty"`
+}
+
+// Lookup gives a profile of the given name, or the default one for an empty
+// name, together with its name. It gives an empty profile if there is none.
+func (c *Config) Lookup(name string) (string, *Profile, bool) {
+	if name == "" {
+		if name = c.Default; name == "" {
+			name = DefaultProfile
+		}
+	}
+	if p, ok := c.Profiles[name]; ok {
+		return name, p, true
+	}
+	return name, &Profile{}, false
+}
+
+// Set adds or replaces the profile of the given name, making it the default
+// one if there is no other.
+func (c *Config) Set(name string, p *Profile) {
+	if c.Profiles == nil {
+		c.Profiles = make(map[string]*Profile)
+	}
+	c.Profiles[name] = p
+	if c.Default == "" {
+		c.Default = name
+	}
+}
+
+// CredsStore persists the Config struct.
 type CredsStore interface {
-	// Load gives Creds loaded from a persisted storage.
-	Load() (*Creds, error)
-	// Save saves given Creds to a persisted storage.
-	Save(*Creds) error
+	// Load gives Config loaded from a persisted storage. Passwords kept in
+	// secret stores are not loaded until the Creds are unlocked.
+	Load() (*Config, error)
+	// Save saves given Config to a persisted storage. Passwords, which are
+	// set, are moved to the secret stores of their Creds.
+	Save(*Config) error
+	// Unlock loads a password of the Creds from its secret store.
+	Unlock(*Creds) error
+	// Forget removes a password and a session token of the Creds.
+	Forget(*Creds) error
+	// Token gives a session token persisted for the Creds, an empty one
+	// if there is none.
+	Token(*Creds) (string, error)
+	// SetToken persists a session token for the Creds, an empty token
+	// removes the persisted one.
+	SetToken(c *Creds, tok string) error
+}
+
+// storePlain is a value of the --store flag, which keeps the password
+// in the ~/.pulsecli file.
+const storePlain = "plain"
+
+func secretStore(c *Creds) bool {
+	return c.Store != "" && c.Store != storePlain
+}
+
+// errNoStore is returned when a password is going to be kept in the ~/.pulsecli
+// file, while it was not requested with --store plain.
+var errNoStore = errors.New("pulsecli: no secret store is available for the password, " +
+	"use --store file to keep it encrypted with a passphrase or --store plain to keep it in ~/.pulsecli")
+
+// fileStore keeps Config in a ~/.pulsecli file, which must be accessible by
+// its owner only. Passwords and session tokens are kept in secret stores, if
+// they were chosen on login, otherwise tokens are kept in a separate file.
+// Empty paths default to ~/.pulsecli, ~/.pulsecli.d/secrets and
+// ~/.pulsecli.d/tokens.
+type fileStore struct {
+	path    string
+	secrets string
+	tokens  string
 }
 
-type fileStore struct{}
+func (fs fileStore) config(mode int) (f *os.File, err error) {
+	path := fs.path
+	if path == "" {
+		u, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(u.HomeDir, ".pulsecli")
+	}
+	if mode&os.O_CREATE == 0 {
+		if err = secret.CheckMode(path); err != nil {
+			return
+		}
+	}
+	if f, err = os.OpenFile(path, mode, 0600); err != nil {
+		return
+	}
+	// OpenFile does not change mode of an already existing file.
+	if mode&os.O_CREATE != 0 {
+		if err = os.Chmod(path, 0600); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return
+}
 
-func config(mode int) (f *os.File, err error) {
+// configDir gives a path of the given directory within ~/.pulsecli.d.
+func configDir(name string) (string, error) {
 	u, err := user.Current()
 	if err != nil {
-		return
+		return "", err
+	}
+	return filepath.Join(u.HomeDir, ".pulsecli.d", name), nil
+}
+
+func (fs fileStore) secret(name string) (secret.Store, error) {
+	path := fs.secrets
+	if path == "" && name == secret.NameFile {
+		var err error
+		if path, err = configDir("secrets"); err != nil {
+			return nil, err
+		}
 	}
-	return os.OpenFile(filepath.Join(u.HomeDir, ".pulsecli"), mode, 0644)
+	return secret.New(name, path, passphrase)
+}
+
+// secretKey gives a key the password of the user is stored under.
+func secretKey(c *Creds) string {
+	return c.User + "@" + c.URL
 }
 
-func (fileStore) Load() (c *Creds, err error) {
-	f, err := config(os.O_RDONLY)
+// Load reads the ~/.pulsecli file. A file written before profiles were
+// introduced is loaded as the default profile.
+func (fs fileStore) Load() (*Config, error) {
+	f, err := fs.config(os.O_RDONLY)
 	if err != nil {
-		return
+		return nil, err
 	}
 	defer f.Close()
-	c = &Creds{}
 	var b bytes.Buffer
 	if _, err = io.Copy(&b, f); err != nil {
-		return
+		return nil, err
 	}
+	c := &Config{}
 	if err = yaml.Unmarshal(b.Bytes(), c); err != nil {
-		return
+		return nil, err
 	}
-	return
+	if len(c.Profiles) == 0 {
+		p := &Profile{}
+		if err = yaml.Unmarshal(b.Bytes(), &p.Creds); err != nil {
+			return nil, err
+		}
+		if p.URL != "" || p.User != "" {
+			c.Set(DefaultProfile, p)
+		}
+	}
+	return c, nil
 }
 
-func (fileStore) Save(c *Creds) error {
-	f, err := config(os.O_TRUNC | os.O_CREATE | os.O_WRONLY)
+func (fs fileStore) Save(c *Config) error {
+	file := Config{Default: c.Default, Profiles: make(map[string]*Profile, len(c.Profiles))}
+	for name, p := range c.Profiles {
+		cp := *p
+		if secretStore(&cp.Creds) {
+			if cp.Pass != "" {
+				s, err := fs.secret(cp.Store)
+				if err != nil {
+					return err
+				}
+				if err = s.Set(secretKey(&cp.Creds), cp.Pass); err != nil {
+					return err
+				}
+			}
+			cp.Pass = ""
+		}
+		file.Profiles[name] = &cp
+	}
+	f, err := fs.config(os.O_TRUNC | os.O_CREATE | os.O_WRONLY)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	b, err := yaml.Marshal(c)
+	b, err := yaml.Marshal(&file)
 	if err != nil {
 		return err
 	}
@@ -92,6 +263,158 @@ func (fileStore) Save(c *Creds) error {
 	return err
 }
 
+func (fs fileStore) Unlock(c *Creds) error {
+	if !secretStore(c) || c.Pass != "" {
+		return nil
+	}
+	s, err := fs.secret(c.Store)
+	if err != nil {
+		return err
+	}
+	c.Pass, err = s.Get(secretKey(c))
+	return err
+}
+
+func (fs fileStore) Forget(c *Creds) error {
+	if err := fs.SetToken(c, ""); err != nil {
+		return err
+	}
+	if !secretStore(c) {
+		return nil
+	}
+	s, err := fs.secret(c.Store)
+	if err != nil {
+		return err
+	}
+	return s.Delete(secretKey(c))
+}
+
+// tokenKey gives a key the session token of the user is stored under.
+func tokenKey(c *Creds) string {
+	return "session:" + secretKey(c)
+}
+
+func (fs fileStore) Token(c *Creds) (string, error) {
+	if secretStore(c) {
+		s, err := fs.secret(c.Store)
+		if err != nil {
+			return "", err
+		}
+		tok, err := s.Get(tokenKey(c))
+		if err == secret.ErrNotFound {
+			return "", nil
+		}
+		return tok, err
+	}
+	_, m, err := fs.readTokens()
+	if err != nil {
+		return "", err
+	}
+	return m[secretKey(c)], nil
+}
+
+func (fs fileStore) SetToken(c *Creds, tok string) error {
+	if secretStore(c) {
+		s, err := fs.secret(c.Store)
+		if err != nil {
+			return err
+		}
+		if tok == "" {
+			return s.Delete(tokenKey(c))
+		}
+		return s.Set(tokenKey(c), tok)
+	}
+	path, m, err := fs.readTokens()
+	if err != nil {
+		return err
+	}
+	if m[secretKey(c)] == tok {
+		return nil
+	}
+	if tok == "" {
+		delete(m, secretKey(c))
+	} else {
+		m[secretKey(c)] = tok
+	}
+	b, err := yaml.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(path, b, 0600); err != nil {
+		return err
+	}
+	// WriteFile does not change mode of an already existing file.
+	return os.Chmod(path, 0600)
+}
+
+// readTokens reads session tokens of profiles, which keep passwords in the
+// ~/.pulsecli file, from a file accessible by its owner only.
+func (fs fileStore) readTokens() (string, map[string]string, error) {
+	path := fs.tokens
+	if path == "" {
+		var err error
+		if path, err = configDir("tokens"); err != nil {
+			return "", nil, err
+		}
+	}
+	m := make(map[string]string)
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return path, m, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if err = secret.CheckMode(path); err != nil {
+		return "", nil, err
+	}
+	if err = yaml.Unmarshal(b, &m); err != nil {
+		return "", nil, err
+	}
+	return path, m, nil
+}
+
+// stdin is shared by every read of a password or a passphrase, so they can
+// be all piped to the standard input.
+var stdin = bufio.NewReader(os.Stdin)
+
+// readLine writes the prompt to os.Stderr and reads a single line from
+// the standard input.
+func readLine(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	s, err := stdin.ReadString('\n')
+	if err != nil && (err != io.EOF || s == "") {
+		return "", err
+	}
+	return strings.TrimRight(s, "\r\n"), nil
+}
+
+// passphrase gives a passphrase of the encrypted secrets file, which is read
+// from the $PULSECLI_PASSPHRASE variable or from the standard input.
+func passphrase() (string, error) {
+	if s := os.Getenv("PULSECLI_PASSPHRASE"); s != "" {
+		return s, nil
+	}
+	return readLine("Passphrase: ")
+}
+
+// password gives the password passed with the --pass flag, read from the
+// standard input for "-" or from the $PULSECLI_PASS variable if the flag
+// is empty.
+func password(ctx *cli.Context) (string, error) {
+	switch pass := ctx.String("pass"); pass {
+	case "-":
+		return readLine("")
+	case "":
+		return os.Getenv("PULSECLI_PASS"), nil
+	default:
+		return pass, nil
+	}
+}
+
 func (cli *CLI) matchProjects(list []string) (mp []string) {
 	for _, p := range list {
 		if cli.p == p {
@@ -116,6 +439,9 @@ func (cli *CLI) matchProjects(list []string) (mp []string) {
 type CLI struct {
 	// Client is used to communicate with a Pulse server.
 	Client func(url, user, pass string) (pulse.Client, error)
+	// Session is used to communicate with a Pulse server within a session
+	// persisted by a previous invocation.
+	Session func(url, tok string) (pulse.Client, error)
 	// Dev TODO(rjeczalik): document
 	Dev func(c pulse.Client, url, user, pass string) (dev.Tool, error)
 	// Out terminates the application, writing to os.Stdout and calling os.Exit(0)
@@ -125,6 +451,9 @@ type CLI struct {
 	// Store is used to persist authorization information.
 	Store CredsStore
 	app   *cli.App
+	cfg   *Config
+	prof  *Profile
+	name  string
 	cred  *Creds
 	c     pulse.Client
 	v     dev.Tool
@@ -137,45 +466,123 @@ type CLI struct {
 	n     int64
 	d     time.Duration
 	prtg  bool
+	adv   prtg.Format
+	mon   string
+	rules *HealthRules
+	// saved is a token of the session persisted for the current profile.
+	saved string
 }
 
 // New gives a new CLI, sets up command line handling and registers subcommands.
 func New() *CLI {
 	cl := &CLI{
-		Client: pulse.NewClient,
-		Dev:    dev.New,
-		Store:  fileStore{},
-		Err:    defaultErr,
-		Out:    defaultOut,
-		app:    cli.NewApp(),
-		cred:   &Creds{},
+		Client:  pulse.NewClient,
+		Session: pulse.NewClientToken,
+		Dev:     dev.New,
+		Store:   fileStore{},
+		Err:     defaultErr,
+		Out:     defaultOut,
+		app:     cli.NewApp(),
+		cred:    &Creds{},
 	}
 	cl.app.Name, cl.app.Version = "pulsecli", "0.1.0"
 	cl.app.Usage = "a command-line client for a Pulse server"
 	cl.app.EnableBashCompletion = true
 	cl.app.Flags = []cli.Flag{
 		cli.StringFlag{Name: "url", Value: "http://pulse", Usage: "Pulse Remote API endpoint"},
+		cli.StringFlag{Name: "profile", Usage: "Profile of the ~/.pulsecli file to use instead of the default one"},
 		cli.StringFlag{Name: "agent, a", Value: ".*", Usage: "Agent name pattern"},
 		cli.StringFlag{Name: "project, p", Value: ".*", Usage: `Project name pattern (or "personal")`},
 		cli.StringFlag{Name: "stage, s", Value: ".*", Usage: "Stage name pattern"},
 		cli.StringFlag{Name: "timeout, t", Value: "15s", Usage: "Maximum wait time"},
 		cli.IntFlag{Name: "build, b", Usage: "Build number"},
-		cli.BoolFlag{Name: "prtg", Usage: "PRTG-friendly output"},
+		cli.GenericFlag{Name: "prtg", Value: new(prtgMode), Usage: `PRTG-friendly output ("advanced" or "json" for an advanced sensor)`},
+		cli.StringFlag{Name: "monitor", Usage: `Monitoring system friendly output ("nagios" or "prtg")`},
+		cli.StringFlag{Name: "thresholds", Usage: `Warning and critical thresholds of Nagios metrics, e.g. "offline=:0,syncing=25:49"`},
+		cli.StringFlag{Name: "prtg-limits", Usage: `Limits of advanced sensor channels, e.g. "offline=:0,syncing=2:4"`},
 	}
 	loginFlags := []cli.Flag{
 		cli.StringFlag{Name: "user", Usage: "Pulse user name"},
-		cli.StringFlag{Name: "pass", Usage: "Pulse user password"},
-	}
+		cli.StringFlag{Name: "pass", Usage: `Pulse user password ("-" to read it from the standard input)`},
+		cli.StringFlag{Name: "store", Usage: `Where to keep the password ("secret-service", "pass", "file" or "plain"), detected if empty`},
+	}
+	profileAddFlags := append([]cli.Flag{
+		cli.StringFlag{Name: "url", Usage: "Pulse Remote API endpoint"},
+		cli.StringFlag{Name: "timeout", Usage: "Default maximum wait time"},
+		cli.StringFlag{Name: "project", Usage: "Default project name pattern"},
+		cli.StringFlag{Name: "monitor", Usage: `Default monitoring system friendly output ("nagios" or "prtg")`},
+	}, loginFlags...)
 	personalFlags := []cli.Flag{
 		cli.StringFlag{Name: "patch", Usage: "Patch file for a personal build"},
 		cli.StringFlag{Name: "revision, r", Value: "HEAD", Usage: "Revision to use for personal build"},
+		cli.StringFlag{Name: "patch-type", Usage: `Type of the patch ("git", "svn", "hg" or "unified"), detected if empty`},
+		cli.BoolFlag{Name: "from-vcs", Usage: "Generate the patch from a working copy in the current directory"},
+		cli.BoolFlag{Name: "from-git", Usage: "Generate the patch from a git repository in the current directory"},
+		cli.BoolFlag{Name: "staged", Usage: "Use only staged changes for --from-git"},
+		cli.BoolFlag{Name: "upstream", Usage: "Use commits not in the upstream branch for --from-git"},
+		cli.BoolFlag{Name: "restore", Usage: "Restore stages left disabled by interrupted personal builds"},
+		cli.StringFlag{Name: "skip-stage", Usage: "Name pattern of stages to skip"},
+		cli.BoolFlag{Name: "disable-stages", Usage: "Disable skipped stages in the project configuration, for servers ignoring stage overrides"},
+		cli.BoolFlag{Name: "wait", Usage: "Wait for the personal build to complete and report its result"},
+		cli.StringFlag{Name: "max-wait", Value: "2h", Usage: "Maximum time to wait for the personal build with --wait"},
+		cli.BoolFlag{Name: "dry-run", Usage: "Print stages to run and agents they run on, without requesting the build"},
+	}
+	artifactsFlags := []cli.Flag{
+		cli.StringFlag{Name: "output, o", Value: ".", Usage: "Output for fetched artifacts"},
+		cli.StringFlag{Name: "cache-dir", Usage: "Local cache for fetched artifacts shared across builds"},
+	}
+	pruneFlags := []cli.Flag{
+		cli.StringFlag{Name: "cache-dir", Usage: "Local cache for fetched artifacts shared across builds"},
+		cli.StringFlag{Name: "max-age", Value: "720h", Usage: "Maximum time a cached file is kept unused"},
+	}
+	uploadFlags := []cli.Flag{cli.StringFlag{Name: "name", Usage: "Name of the uploaded artifact"}}
+	cleanupFlags := []cli.Flag{cli.StringFlag{Name: "name", Usage: "Name of the cleanup rule"}}
+	cleanupAddFlags := []cli.Flag{
+		cli.StringFlag{Name: "name", Usage: "Name of the cleanup rule"},
+		cli.IntFlag{Name: "retain", Value: 10, Usage: "Number of builds or days to retain"},
+		cli.StringFlag{Name: "unit", Value: "builds", Usage: `Unit of the retain value ("builds" or "days")`},
+		cli.StringFlag{Name: "what", Usage: `Comma-separated data to remove ("artifacts", "repository", "snapshot"), all if empty`},
+		cli.StringFlag{Name: "states", Usage: "Comma-separated states of builds to remove, all if empty"},
+	}
+	healthFlags := []cli.Flag{
+		cli.StringFlag{Name: "rules", Usage: "YAML file with health check rules, ~/.pulsecli.d/health.yml if it exists"},
+		cli.BoolFlag{Name: "stuck", Usage: "Detects stuck builds and hung agents"},
+	}
+	exporterFlags := []cli.Flag{
+		cli.StringFlag{Name: "listen", Value: ":9400", Usage: "Address to serve metrics on"},
+		cli.StringFlag{Name: "interval", Value: "30s", Usage: "Time between collections of metrics"},
+	}
+	watchFlags := []cli.Flag{
+		cli.StringFlag{Name: "interval", Value: "1m", Usage: "Time between two polls"},
+		cli.StringFlag{Name: "exec", Usage: "Shell command to run for every event"},
+		cli.StringFlag{Name: "webhook", Usage: "URL to post every event to in the JSON format"},
+		cli.StringFlag{Name: "smtp", Usage: "Address of the SMTP server to send every event with, e.g. smtp.example.com:25"},
+		cli.StringFlag{Name: "smtp-user", Usage: "SMTP user, the password is read from $PULSECLI_SMTP_PASS"},
+		cli.StringFlag{Name: "mail-from", Usage: "Sender of the emails"},
+		cli.StringFlag{Name: "mail-to", Usage: "Comma-separated recipients of the emails"},
+		cli.StringFlag{Name: "log", Usage: `File to append every event to in the JSON format, "-" for stdout`},
+		cli.StringFlag{Name: "state", Usage: "File the last seen state is persisted in, ~/.pulsecli.d/watch/<profile>@<host>.yml by default"},
+	}
+	topFlags := []cli.Flag{
+		cli.StringFlag{Name: "interval", Value: "5s", Usage: "Time between two refreshes"},
+	}
+	reportFlags := []cli.Flag{
+		cli.StringFlag{Name: "since", Value: "7d", Usage: `Period of the report, e.g. "7d", "2w" or "36h"`},
+		cli.StringFlag{Name: "format", Value: "text", Usage: `Format of the report ("text", "csv", "json" or "html")`},
+		cli.StringFlag{Name: "output", Usage: "File to write the report to instead of stdout"},
+	}
+	flakyFlags := []cli.Flag{
+		cli.IntFlag{Name: "last", Value: 50, Usage: "Number of the latest builds of every project to analyse"},
 	}
-	artifactsFlags := []cli.Flag{cli.StringFlag{Name: "output, o", Value: ".", Usage: "Output for fetched artifacts"}}
 	cl.app.Commands = []cli.Command{{
 		Name:   "login",
 		Usage:  "Creates or updates session for current user",
 		Action: cl.Login,
 		Flags:  loginFlags,
+	}, {
+		Name:   "logout",
+		Usage:  "Terminates session of current user",
+		Action: cl.Logout,
 	}, {
 		Name:   "trigger",
 		Usage:  "Triggers a build",
@@ -192,6 +599,7 @@ func New() *CLI {
 		Name:   "health",
 		Usage:  "Performs a health check",
 		Action: cl.Health,
+		Flags:  healthFlags,
 	}, {
 		Name:   "projects",
 		Usage:  "Lists all projct names",
@@ -226,34 +634,314 @@ func New() *CLI {
 		Usage:  "Downloads all the artifact files",
 		Action: cl.Artifact,
 		Flags:  artifactsFlags,
+		Subcommands: []cli.Command{{
+			Name:   "upload",
+			Usage:  "Attaches local files to a build as an artifact",
+			Action: cl.Upload,
+			Flags:  uploadFlags,
+		}, {
+			Name:   "prune",
+			Usage:  "Removes unused files from the local artifact cache",
+			Action: cl.Prune,
+			Flags:  pruneFlags,
+		}},
+	}, {
+		Name:   "exporter",
+		Usage:  "Serves Pulse metrics for Prometheus",
+		Action: cl.Exporter,
+		Flags:  exporterFlags,
+	}, {
+		Name:   "report",
+		Usage:  "Reports build statistics",
+		Action: cl.Report,
+		Flags:  reportFlags,
+	}, {
+		Name:   "flaky",
+		Usage:  "Finds flaky stages and commands",
+		Action: cl.Flaky,
+		Flags:  flakyFlags,
+	}, {
+		Name:   "top",
+		Usage:  "Displays a dashboard of projects and agents",
+		Action: cl.Top,
+		Flags:  topFlags,
+	}, {
+		Name:   "watch",
+		Usage:  "Watches projects and agents and notifies about their state changes",
+		Action: cl.Watch,
+		Flags:  watchFlags,
+	}, {
+		Name:   "cleanup",
+		Usage:  "Lists cleanup rules",
+		Action: cl.CleanupList,
+		Subcommands: []cli.Command{{
+			Name:   "list",
+			Usage:  "Lists cleanup rules",
+			Action: cl.CleanupList,
+		}, {
+			Name:   "add",
+			Usage:  "Adds or updates a cleanup rule",
+			Action: cl.CleanupAdd,
+			Flags:  cleanupAddFlags,
+		}, {
+			Name:   "remove",
+			Usage:  "Removes a cleanup rule",
+			Action: cl.CleanupRemove,
+			Flags:  cleanupFlags,
+		}, {
+			Name:   "apply",
+			Usage:  "Runs cleanup rules now",
+			Action: cl.CleanupApply,
+			Flags:  cleanupFlags,
+		}},
+	}, {
+		Name:   "profile",
+		Usage:  "Lists server profiles",
+		Action: cl.ProfileList,
+		Subcommands: []cli.Command{{
+			Name:   "list",
+			Usage:  "Lists server profiles",
+			Action: cl.ProfileList,
+		}, {
+			Name:   "add",
+			Usage:  "Adds or updates a server profile",
+			Action: cl.ProfileAdd,
+			Flags:  profileAddFlags,
+		}, {
+			Name:   "remove",
+			Usage:  "Removes a server profile",
+			Action: cl.ProfileRemove,
+		}, {
+			Name:   "use",
+			Usage:  "Makes a server profile the default one",
+			Action: cl.ProfileUse,
+		}},
 	}}
 	return cl
 }
 
+// Values of the --monitor flag.
+const (
+	monitorNagios = "nagios"
+	monitorPRTG   = "prtg"
+)
+
+// prtgMode is a value of the --prtg flag, which can be given with no value
+// for the legacy output.
+type prtgMode string
+
+const (
+	prtgLegacy   prtgMode = "true"
+	prtgAdvanced prtgMode = "advanced"
+	prtgJSON     prtgMode = "json"
+)
+
+func (m *prtgMode) Set(s string) error {
+	switch prtgMode(s) {
+	case prtgLegacy, prtgAdvanced, prtgJSON:
+		*m = prtgMode(s)
+	case "false":
+		*m = ""
+	case "xml":
+		*m = prtgAdvanced
+	default:
+		return fmt.Errorf("pulsecli: invalid --prtg value %q", s)
+	}
+	return nil
+}
+
+func (m *prtgMode) String() string { return string(*m) }
+
+// IsBoolFlag makes the flag package accept --prtg with no value.
+func (m *prtgMode) IsBoolFlag() bool { return true }
+
+// global gives a value of the global flag, or the default value of the current
+// profile if the flag, which may be given by any of the names, was not set.
+func (cli *CLI) global(ctx *cli.Context, names ...string) string {
+	for _, name := range names {
+		if ctx.GlobalIsSet(name) {
+			return ctx.GlobalString(names[0])
+		}
+	}
+	var v string
+	switch names[0] {
+	case "timeout":
+		v = cli.prof.Timeout
+	case "project":
+		v = cli.prof.Project
+	case "monitor":
+		v = cli.prof.Monitor
+	}
+	if v == "" {
+		return ctx.GlobalString(names[0])
+	}
+	return v
+}
+
+// load loads the ~/.pulsecli file and looks up the current profile. A missing
+// profile is not an error on login.
+func (cli *CLI) load(ctx *cli.Context) (exists bool, err error) {
+	if cli.cfg, err = cli.Store.Load(); os.IsNotExist(err) && ctx.IsSet("user") {
+		cli.cfg, err = &Config{}, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	profile := ctx.GlobalString("profile")
+	cli.name, cli.prof, exists = cli.cfg.Lookup(profile)
+	if !exists && profile != "" && !ctx.IsSet("user") {
+		return false, fmt.Errorf("pulsecli: profile %q does not exist", profile)
+	}
+	cli.cred = &cli.prof.Creds
+	return exists, nil
+}
+
+// session gives a client of the session persisted for the current profile.
+// If there is none, a new session is created and persisted. A session rejected
+// later on, e.g. because it expired while watching, is replaced by relogin.
+func (cli *CLI) session() (pulse.Client, error) {
+	if tok, err := cli.Store.Token(cli.cred); err == nil && tok != "" {
+		if c, err := cli.Session(cli.cred.URL, tok); err == nil {
+			cli.saved = tok
+			c.SetLogin(cli.relogin)
+			return c, nil
+		}
+	}
+	if err := cli.Store.Unlock(cli.cred); err != nil {
+		return nil, err
+	}
+	c, err := cli.Client(cli.cred.URL, cli.cred.User, cli.cred.Pass)
+	if err != nil {
+		return nil, err
+	}
+	if err = cli.Store.SetToken(cli.cred, c.Token()); err != nil {
+		c.Close()
+		return nil, err
+	}
+	cli.saved = c.Token()
+	c.SetLogin(cli.relogin)
+	return c, nil
+}
+
+// relogin creates a new session for the current credentials, which replaces
+// a rejected one. The new session is persisted if the rejected one was.
+func (cli *CLI) relogin() (string, error) {
+	if err := cli.Store.Unlock(cli.cred); err != nil {
+		return "", err
+	}
+	c, err := cli.Client(cli.cred.URL, cli.cred.User, cli.cred.Pass)
+	if err != nil {
+		return "", err
+	}
+	// Only the token is used, the session lives on in the rejecting client.
+	tok := c.Token()
+	if cli.saved != "" {
+		if err = cli.Store.SetToken(cli.cred, tok); err != nil {
+			return "", err
+		}
+		cli.saved = tok
+	}
+	return tok, nil
+}
+
+// setToken persists a token of the session for the current credentials,
+// closing the session it replaces.
+func (cli *CLI) setToken(tok string) error {
+	if old, err := cli.Store.Token(cli.cred); err == nil && old != "" && old != tok {
+		if c, err := cli.Session(cli.cred.URL, old); err == nil {
+			c.Close()
+		}
+	}
+	if err := cli.Store.SetToken(cli.cred, tok); err != nil {
+		return err
+	}
+	cli.saved = tok
+	return nil
+}
+
+// closeSession closes the session of the current command, unless it is
+// persisted.
+func (cli *CLI) closeSession() {
+	if cli.c != nil && cli.c.Token() != cli.saved {
+		cli.c.Close()
+	}
+}
+
 func (cli *CLI) init(ctx *cli.Context) error {
-	if ctx.GlobalBool("prtg") {
+	exists, err := cli.load(ctx)
+	if err != nil {
+		return err
+	}
+	switch prtgMode(ctx.GlobalString("prtg")) {
+	case prtgLegacy:
 		cli.Err, cli.Out = prtg.Err, prtg.Out
+	case prtgAdvanced:
+		cli.adv = prtg.FormatXML
+		cli.Out, cli.Err = prtg.Advanced(cli.adv)
+	case prtgJSON:
+		cli.adv = prtg.FormatJSON
+		cli.Out, cli.Err = prtg.Advanced(cli.adv)
+	}
+	switch cli.mon = cli.global(ctx, "monitor"); cli.mon {
+	case "":
+	case monitorNagios, "icinga":
+		cli.mon, cli.Out, cli.Err = monitorNagios, nagios.Out, nagios.Err
+	case monitorPRTG:
+		cli.Err, cli.Out = prtg.Err, prtg.Out
+	default:
+		return fmt.Errorf("pulsecli: invalid --monitor value %q", cli.mon)
+	}
+	// Credentials given on the command line override the stored ones, a stored
+	// password is used only for the same user.
+	var cred Creds
+	if ctx.IsSet("user") || ctx.IsSet("pass") || ctx.GlobalIsSet("url") {
+		var pass string
+		if pass, err = password(ctx); err != nil {
+			return err
+		}
+		cred = cli.prof.Creds
+		if pass == "" && (!ctx.IsSet("user") || ctx.String("user") == cred.User) {
+			if err = cli.Store.Unlock(&cred); err != nil {
+				return err
+			}
+			pass = cred.Pass
+		}
+		if ctx.GlobalIsSet("url") || cred.URL == "" {
+			cred.URL = ctx.GlobalString("url")
+		}
+		if ctx.IsSet("user") {
+			cred.User = ctx.String("user")
+		}
+		cred.Pass = pass
 	}
-	var err, err2 error
-
-	if ctx.IsSet("user") && ctx.IsSet("pass") {
-		cli.cred = &Creds{ctx.GlobalString("url"), ctx.String("user"), ctx.String("pass")}
+	if cred.User != "" && cred.Pass != "" {
+		stored := cli.prof.Creds
+		cli.cred = &cred
+		if !exists {
+			cli.cred.Store = secret.Detect()
+		}
 		if cli.c, err = cli.Client(cli.cred.URL, cli.cred.User, cli.cred.Pass); err != nil {
-			if cli.cred, err2 = cli.Store.Load(); err2 == nil {
-				cli.c, err = cli.Client(cli.cred.URL, cli.cred.User, cli.cred.Pass)
-				fmt.Println("WARNING: Authentification failed. Use valid credentials previously stored.")
-			} else {
+			if !exists {
 				return err
 			}
-		}
-	} else {
-		if cli.cred, err = cli.Store.Load(); err == nil {
-			cli.c, err = cli.Client(cli.cred.URL, cli.cred.User, cli.cred.Pass)
+			cli.cred = &stored
+			if cli.c, err = cli.session(); err != nil {
+				return err
+			}
+			fmt.Println("WARNING: Authentification failed. Use valid credentials previously stored.")
 		} else {
-			return err
+			cli.c.SetLogin(cli.relogin)
 		}
+	} else if cli.c, err = cli.session(); err != nil {
+		return err
 	}
-	cli.p = ctx.GlobalString("project")
+	// A session created for credentials given on the command line is not
+	// persisted unless the command does so, e.g. login. Out and Err exit
+	// the process, so a deferred logout would never run.
+	out, e := cli.Out, cli.Err
+	cli.Out = func(a ...interface{}) { cli.closeSession(); out(a...) }
+	cli.Err = func(a ...interface{}) { cli.closeSession(); e(a...) }
+	cli.p = cli.global(ctx, "project", "p")
 	a, s, o := ctx.GlobalString("agent"), ctx.GlobalString("stage"), ctx.GlobalString("output")
 	if cli.a, err = regexp.Compile(a); err != nil {
 		return err
@@ -264,7 +952,7 @@ func (cli *CLI) init(ctx *cli.Context) error {
 	if cli.o, err = regexp.Compile(o); err != nil {
 		return err
 	}
-	if cli.d, err = time.ParseDuration(ctx.GlobalString("timeout")); err != nil {
+	if cli.d, err = time.ParseDuration(cli.global(ctx, "timeout", "t")); err != nil {
 		return err
 	}
 	cli.n, cli.rev = int64(ctx.GlobalInt("build")), ctx.String("revision")
@@ -273,12 +961,63 @@ func (cli *CLI) init(ctx *cli.Context) error {
 }
 
 // Personal TODO(rjeczalik): document
+//
+// The type of the patch is given by the --patch-type flag, or detected from
+// a working copy the current directory belongs to.
+//
+// With the --from-vcs flag the patch is generated from the working copy in
+// the current directory - out of uncommitted changes, or a revision range given
+// as an argument. For git repositories (--from-git) the patch can be made of
+// staged changes only (--staged) or of commits not in the upstream branch
+// (--upstream). The revision the patch applies to is detected unless given
+// explicitly with --revision.
+//
+// The patch is sent as a personal build of every project matching the
+// --project pattern, concurrently. The pattern must be given explicitly.
+// When more than one project matches, the command outputs pairs of a project
+// name and a personal build number, one per line, separated by a tab;
+// otherwise it outputs the build number only.
+//
+// With the --wait flag the command follows the personal builds until they
+// complete, printing changes of their stages. It fails when any of the builds
+// fails, reporting error messages of the failed builds.
+//
+// The personal build runs enabled stages of the project, which match the
+// --stage pattern and do not match the --skip-stage one; the rest of them
+// are disabled by overrides sent with the request, which apply to the personal
+// build only. With the --dry-run flag the command prints the selected stages
+// and agents they run on instead.
+//
+// With the --disable-stages flag the skipped stages are disabled in the shared
+// project configuration for the time of the request instead. They are recorded
+// in a journal within ~/.pulsecli.d/journal until they are restored, and
+// restored also when the command is interrupted. Stages left disabled after
+// a crash or a lost connection are restored with the --restore flag.
 func (cli *CLI) Personal(ctx *cli.Context) {
 	err := cli.init(ctx)
 	if err != nil {
 		cli.Err(err)
 		return
 	}
+	dir, err := configDir("journal")
+	if err != nil {
+		cli.Err(err)
+		return
+	}
+	if ctx.Bool("restore") {
+		cli.restore(dir)
+		return
+	}
+	// Every project would get the patch and a personal build otherwise.
+	if cli.p == "" || cli.p == ".*" {
+		cli.Err("pulsecli: a --project name is missing")
+		return
+	}
+	maxWait, err := time.ParseDuration(ctx.String("max-wait"))
+	if err != nil {
+		cli.Err(err)
+		return
+	}
 	if p := ctx.String("patch"); p != "" {
 		if _, err = os.Stat(p); err != nil {
 			cli.Err(err)
@@ -286,70 +1025,361 @@ func (cli *CLI) Personal(ctx *cli.Context) {
 		}
 		cli.patch = p
 	}
-	url := cli.cred.URL
-	if cli.v, err = cli.Dev(cli.c, url, cli.cred.User, cli.cred.Pass); err != nil {
-		cli.Err(err)
-		return
+	var typ dev.PatchType
+	if s := ctx.String("patch-type"); s != "" {
+		if typ, err = dev.ParsePatchType(s); err != nil {
+			cli.Err(err)
+			return
+		}
+	}
+	if ctx.Bool("from-git") {
+		if typ != "" && typ != dev.PatchGit {
+			cli.Err(fmt.Sprintf("pulsecli: --from-git conflicts with --patch-type=%s", typ))
+			return
+		}
+		typ = dev.PatchGit
 	}
-	p := &dev.Personal{
-		Patch:    cli.patch,
-		Project:  cli.p,
-		Revision: cli.rev,
+	if typ == "" {
+		if typ, err = dev.DetectPatchType("."); err != nil {
+			cli.Err(err)
+			return
+		}
 	}
-	if s := cli.s.String(); s != "" && s != ".*" {
-		s, err := cli.c.Stages(p.Project)
+	if ctx.Bool("from-git") || ctx.Bool("from-vcs") {
+		pt, err := dev.NewPatcher(typ, "", ctx.Args().First())
 		if err != nil {
 			cli.Err(err)
 			return
 		}
-		if len(s) != 0 {
-			p.Stages = make([]string, 0, len(s))
-			for _, s := range s {
-				if cli.s.MatchString(s) {
-					continue
-				}
-				p.Stages = append(p.Stages, s)
-			}
-			if len(p.Stages) == 0 {
-				cli.Err(fmt.Sprintf("pulsecli: no stages found that match %q", cli.s.String()))
-				return
-			}
+		if g, ok := pt.(*dev.Git); ok {
+			g.Staged, g.Upstream = ctx.Bool("staged"), ctx.Bool("upstream")
+		}
+		patch, rev, err := writePatch(pt)
+		if err != nil {
+			cli.Err(err)
+			return
+		}
+		// Out and Err exit the process, so a deferred removal would never run.
+		out, e := cli.Out, cli.Err
+		cli.Out = func(a ...interface{}) { os.Remove(patch); out(a...) }
+		cli.Err = func(a ...interface{}) { os.Remove(patch); e(a...) }
+		if cli.patch = patch; !ctx.IsSet("revision") {
+			cli.rev = rev
 		}
 	}
-	id, err := cli.v.Personal(p)
+	projects, err := cli.c.Projects()
 	if err != nil {
 		cli.Err(err)
 		return
 	}
-	cli.Out(id)
-}
-
-// Wait TODO(rjeczalik): document
-func (cli *CLI) Wait(ctx *cli.Context) {
-	if err := cli.init(ctx); err != nil {
-		cli.Err(err)
+	if projects = cli.matchProjects(projects); len(projects) == 0 {
+		cli.Err(fmt.Sprintf("pulsecli: no projects found that match %q", cli.p))
 		return
 	}
-	p := cli.p
-	if p == "" || p == ".*" {
-		cli.Err("pulsecli: a --project name is missing")
+	var skip *regexp.Regexp
+	if s := ctx.String("skip-stage"); s != "" {
+		if skip, err = regexp.Compile(s); err != nil {
+			cli.Err(err)
+			return
+		}
+	}
+	sel := make([]*dev.Selection, len(projects))
+	for i := range projects {
+		if sel[i], err = cli.selectStages(projects[i], skip); err != nil {
+			cli.Err(err)
+			return
+		}
+	}
+	if ctx.Bool("dry-run") {
+		var msg []interface{}
+		for i := range projects {
+			var prefix string
+			if len(projects) > 1 {
+				prefix = fmt.Sprintf("%q\t", projects[i])
+			}
+			msg = append(msg, dryRun(prefix, sel[i])...)
+		}
+		cli.Out(msg...)
 		return
 	}
-	id, err := util.NormalizeBuildOrRequestID(cli.c, p, cli.n)
-	if err != nil {
+	// The password is not unlocked when a persisted session is reused.
+	if err = cli.Store.Unlock(cli.cred); err != nil {
 		cli.Err(err)
 		return
 	}
-	select {
-	case <-time.After(cli.d):
-		err = pulse.ErrTimeout
-	case err = <-util.Wait(cli.c, time.Second, p, id):
+	url := cli.cred.URL
+	if cli.v, err = cli.Dev(cli.c, url, cli.cred.User, cli.cred.Pass); err != nil {
+		cli.Err(err)
+		return
 	}
+	j, err := dev.NewJournal(dir)
 	if err != nil {
 		cli.Err(err)
 		return
 	}
-}
+	cli.v.SetJournal(j)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer func() {
+		signal.Stop(sig)
+		close(sig)
+	}()
+	go func() {
+		if s, ok := <-sig; ok {
+			// Waits for stages being disabled, so none is left disabled.
+			j.Close()
+			if err := j.Restore(cli.c); err != nil {
+				cli.Err(fmt.Sprintf("pulsecli: %v: restoring disabled stages failed: %v", s, err),
+					restoreHint)
+				return
+			}
+			cli.Err(fmt.Sprintf("pulsecli: %v", s))
+		}
+	}()
+	builds := make([]personalBuild, len(projects))
+	var wg sync.WaitGroup
+	for i := range projects {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p := &dev.Personal{
+				Patch:         cli.patch,
+				Project:       projects[i],
+				Revision:      cli.rev,
+				Stages:        sel[i].Names(),
+				Type:          typ,
+				DisableStages: ctx.Bool("disable-stages"),
+			}
+			builds[i].Project = projects[i]
+			builds[i].Result, builds[i].Err = cli.v.Personal(p)
+		}(i)
+	}
+	wg.Wait()
+	if j.Len() != 0 {
+		var errs []interface{}
+		for _, b := range builds {
+			if b.Err != nil {
+				errs = append(errs, fmt.Sprintf("%q\t%v", b.Project, b.Err))
+			}
+		}
+		cli.Err(append(errs, restoreHint)...)
+		return
+	}
+	if len(builds) == 1 && builds[0].Err != nil {
+		cli.Err(builds[0].Err)
+		return
+	}
+	var accepted []personalBuild
+	var errs []interface{}
+	for _, b := range builds {
+		if b.Err != nil {
+			errs = append(errs, fmt.Sprintf("%q\t%v", b.Project, b.Err))
+			continue
+		}
+		for _, w := range b.Result.Warnings {
+			fmt.Fprintf(os.Stderr, "pulsecli: warning: %s: %s\n", b.Project, w)
+		}
+		accepted = append(accepted, b)
+	}
+	if len(errs) != 0 {
+		cli.Err(append(personalTable(accepted, true), errs...)...)
+		return
+	}
+	if ctx.Bool("wait") {
+		cli.waitPersonal(accepted, maxWait, os.Stdout)
+		return
+	}
+	cli.Out(personalTable(accepted, len(projects) > 1)...)
+}
+
+// restoreHint tells how to restore stages, which failed to restore.
+const restoreHint = "pulsecli: some stages are left disabled, run pulsecli personal --restore to restore them"
+
+// personalBuild is a result of a personal build request for a single project.
+type personalBuild struct {
+	Project string
+	Result  *dev.PersonalResult
+	Err     error
+}
+
+// personalTable gives a number of the personal build, or a table of project
+// names and numbers of their personal builds, one per line, separated by a tab,
+// for a batch of builds requested for more than one project.
+func personalTable(builds []personalBuild, batch bool) []interface{} {
+	if !batch {
+		return []interface{}{builds[0].Result.ID}
+	}
+	msg := make([]interface{}, 0, len(builds))
+	for _, b := range builds {
+		msg = append(msg, fmt.Sprintf("%q\t%d", b.Project, b.Result.ID))
+	}
+	return msg
+}
+
+// waitPersonal follows the personal builds until they complete, printing
+// changes of their stages to w, prefixed with a build number when there is
+// more than one build. When a build fails, its error messages are reported,
+// one per line, as a stage name, a command name and the message separated
+// by a tab.
+func (cli *CLI) waitPersonal(builds []personalBuild, max time.Duration, w io.Writer) {
+	pr, done := &stageProgress{w: w}, make(chan error, len(builds))
+	for _, b := range builds {
+		var prefix string
+		if len(builds) > 1 {
+			fmt.Fprintf(w, "personal build %d for %q\n", b.Result.ID, b.Project)
+			prefix = fmt.Sprintf("%d\t", b.Result.ID)
+		} else {
+			fmt.Fprintf(w, "personal build %d\n", b.Result.ID)
+		}
+		go func(id int64, prefix string) {
+			done <- <-util.Follow(cli.c, time.Second, pulse.ProjectPersonal, id, pr.Report(prefix))
+		}(b.Result.ID, prefix)
+	}
+	timeout := time.After(max)
+	for range builds {
+		select {
+		case <-timeout:
+			cli.Err(pulse.ErrTimeout)
+			return
+		case err := <-done:
+			if err != nil {
+				cli.Err(err)
+				return
+			}
+		}
+	}
+	var msg, failed []interface{}
+	for _, b := range builds {
+		id := b.Result.ID
+		res, err := cli.c.BuildResult(pulse.ProjectPersonal, id)
+		if err != nil {
+			cli.Err(err)
+			return
+		}
+		ok := true
+		for i := range res {
+			ok = ok && res[i].Success
+		}
+		if ok {
+			continue
+		}
+		m, err := cli.c.Messages(pulse.ProjectPersonal, id)
+		if err != nil {
+			cli.Err(err)
+			return
+		}
+		var prefix string
+		if len(builds) > 1 {
+			prefix = fmt.Sprintf("%d\t", id)
+		}
+		for _, m := range m.Filter(pulse.Error) {
+			msg = append(msg, fmt.Sprintf("%s%q\t%q\t%q", prefix, m.StageName, m.CommandName, m.Message))
+		}
+		failed = append(failed, fmt.Sprintf("pulsecli: personal build %d failed", id))
+	}
+	if len(failed) != 0 {
+		cli.Err(append(msg, failed...)...)
+		return
+	}
+	cli.Out(personalTable(builds, len(builds) > 1)...)
+}
+
+// selectStages selects stages of the project to run in the personal build
+// out of its configuration - enabled stages, which match the --stage pattern
+// and do not match the skip one.
+func (cli *CLI) selectStages(project string, skip *regexp.Regexp) (*dev.Selection, error) {
+	stages, err := cli.c.ConfigStages(project)
+	if err != nil {
+		return nil, err
+	}
+	sel := dev.SelectStages(stages, cli.s, skip)
+	if len(sel.Run) == 0 {
+		return nil, fmt.Errorf("pulsecli: no stages of %q found that match %q", project, cli.s.String())
+	}
+	return sel, nil
+}
+
+// dryRun describes the stage selection, one stage per line - stages to run
+// with agents they run on, stages to skip and stages disabled in the project
+// configuration. Every line starts with the given prefix.
+func dryRun(prefix string, sel *dev.Selection) []interface{} {
+	msg := make([]interface{}, 0, len(sel.Run)+len(sel.Skip)+len(sel.Disabled))
+	for _, s := range sel.Run {
+		agent := s.Agent
+		if agent == "" {
+			agent = "any"
+		}
+		msg = append(msg, fmt.Sprintf("%srun\t%q\t%q", prefix, s.Name, agent))
+	}
+	for _, s := range sel.Skip {
+		msg = append(msg, fmt.Sprintf("%sskip\t%q", prefix, s.Name))
+	}
+	for _, s := range sel.Disabled {
+		msg = append(msg, fmt.Sprintf("%sdisabled\t%q", prefix, s.Name))
+	}
+	return msg
+}
+
+// restore restores stages recorded by all the journals within the dir.
+// It outputs pairs of a project name and a stage name, one per line, separated
+// by a tab.
+func (cli *CLI) restore(dir string) {
+	rec, err := dev.RestoreAll(cli.c, dir)
+	msg := make([]interface{}, 0, len(rec))
+	for i := range rec {
+		msg = append(msg, fmt.Sprintf("%q\t%q", rec[i].Project, rec[i].Stage.Name))
+	}
+	if err != nil {
+		cli.Err(append(msg, err)...)
+		return
+	}
+	cli.Out(msg...)
+}
+
+// writePatch writes a patch generated by pt to a temporary file. It returns
+// the file path and a revision the patch applies to.
+func writePatch(pt dev.Patcher) (string, string, error) {
+	f, err := ioutil.TempFile("", "pulsecli")
+	if err != nil {
+		return "", "", err
+	}
+	rev, err := pt.Patch(f)
+	if e := f.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", "", err
+	}
+	return f.Name(), rev, nil
+}
+
+// Wait TODO(rjeczalik): document
+func (cli *CLI) Wait(ctx *cli.Context) {
+	if err := cli.init(ctx); err != nil {
+		cli.Err(err)
+		return
+	}
+	p := cli.p
+	if p == "" || p == ".*" {
+		cli.Err("pulsecli: a --project name is missing")
+		return
+	}
+	id, err := util.NormalizeBuildOrRequestID(cli.c, p, cli.n)
+	if err != nil {
+		cli.Err(err)
+		return
+	}
+	select {
+	case <-time.After(cli.d):
+		err = pulse.ErrTimeout
+	case err = <-util.Wait(cli.c, time.Second, p, id):
+	}
+	if err != nil {
+		cli.Err(err)
+		return
+	}
+}
 
 // Init is a a command line interface to Init method of a pulse.Client.
 // It outputs a pair of boolean and name, one per line for every project requested,
@@ -421,22 +1451,236 @@ func (cli *CLI) Build(ctx *cli.Context) {
 	cli.Out(id)
 }
 
-// Login writes Pulse Remote API authentication information to a ~/.pulsecli file
-// in a YAML format. On consecutive runs it updates every non-empty field that is
-// passed from command line. It fails in doing so, when given credentials are not
-// valid.
+// Login writes Pulse Remote API authentication information to a profile of
+// the ~/.pulsecli file in a YAML format. On consecutive runs it updates every
+// non-empty field that is passed from command line. It fails in doing so, when
+// given credentials are not valid. The password is kept in a secret store given
+// by the --store flag, or in the file itself for "plain". Without the flag
+// a new profile uses the Secret Service or pass, and login fails if none
+// of them is available. A token of the session is persisted as well, so it is
+// reused by consecutive commands.
 func (cli *CLI) Login(ctx *cli.Context) {
-	old := []*string{&cli.cred.URL, &cli.cred.User, &cli.cred.Pass}
-	for i, s := range []string{ctx.GlobalString("url"), ctx.String("user"), ctx.String("pass")} {
+	if err := cli.init(ctx); err != nil {
+		cli.Err(err)
+		return
+	}
+	if s := ctx.String("store"); s != "" && s != cli.cred.Store {
+		// The password and the token are moved to the new store.
+		if err := cli.Store.Unlock(cli.cred); err != nil {
+			cli.Err(err)
+			return
+		}
+		if err := cli.Store.SetToken(cli.cred, ""); err != nil {
+			cli.Err(err)
+			return
+		}
+		cli.cred.Store = s
+	}
+	// A password is never kept in plain text by default, except for profiles
+	// which already kept it so.
+	if cli.cred.Store == "" && cli.cred.Pass != "" && cli.prof.Pass == "" {
+		cli.Err(errNoStore)
+		return
+	}
+	cli.prof.Creds = *cli.cred
+	cli.cfg.Set(cli.name, cli.prof)
+	if err := cli.Store.Save(cli.cfg); err != nil {
+		cli.Err(err)
+		return
+	}
+	// A session replaced by a new login would be left open until it expires.
+	if err := cli.setToken(cli.c.Token()); err != nil {
+		cli.Err(err)
+		return
+	}
+	cli.Out()
+}
+
+// Logout terminates the session persisted for the current profile and removes
+// its token. The password is kept, so the next command starts a new session.
+func (cli *CLI) Logout(ctx *cli.Context) {
+	if _, err := cli.load(ctx); err != nil {
+		cli.Err(err)
+		return
+	}
+	tok, err := cli.Store.Token(cli.cred)
+	if err != nil {
+		cli.Err(err)
+		return
+	}
+	if tok == "" {
+		cli.Out()
+		return
+	}
+	// A rejected session needs no logout.
+	if c, err := cli.Session(cli.cred.URL, tok); err == nil {
+		if err = c.Close(); err != nil {
+			cli.Err(err)
+			return
+		}
+	}
+	if err = cli.Store.SetToken(cli.cred, ""); err != nil {
+		cli.Err(err)
+		return
+	}
+	cli.Out()
+}
+
+// ProfileList lists profiles of the ~/.pulsecli file, marking the default one
+// with an asterisk.
+func (cli *CLI) ProfileList(ctx *cli.Context) {
+	cfg, err := cli.Store.Load()
+	if err != nil {
+		cli.Err(err)
+		return
+	}
+	def, _, _ := cfg.Lookup("")
+	names := make([]string, 0, len(cfg.Profiles))
+	for name := range cfg.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msg := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		mark := " "
+		if name == def {
+			mark = "*"
+		}
+		p := cfg.Profiles[name]
+		msg = append(msg, fmt.Sprintf("%s %s %s %s", mark, name, p.URL, p.User))
+	}
+	cli.Out(msg...)
+}
+
+// profile loads the ~/.pulsecli file and gives a name of the profile given
+// as the first argument.
+func (cli *CLI) profile(ctx *cli.Context) (*Config, string, error) {
+	name := ctx.Args().First()
+	if name == "" {
+		return nil, "", errors.New("pulsecli: profile name is missing")
+	}
+	cfg, err := cli.Store.Load()
+	if os.IsNotExist(err) {
+		cfg, err = &Config{}, nil
+	}
+	return cfg, name, err
+}
+
+// ProfileAdd adds a profile of the given name or updates every non-empty field
+// of an existing one. A new profile requires the --url flag. Given credentials
+// are validated and stored like on login.
+func (cli *CLI) ProfileAdd(ctx *cli.Context) {
+	cfg, name, err := cli.profile(ctx)
+	if err != nil {
+		cli.Err(err)
+		return
+	}
+	p, ok := cfg.Profiles[name]
+	if !ok {
+		p = &Profile{Creds: Creds{Store: secret.Detect()}}
+	}
+	// The password is moved on save, when it is going to be kept in another
+	// store or under another key.
+	if store := ctx.String("store"); ok && (ctx.String("url") != "" || store != "" && store != p.Store) {
+		if err = cli.Store.Unlock(&p.Creds); err != nil {
+			cli.Err(err)
+			return
+		}
+	}
+	if ctx.IsSet("user") {
+		if p.Pass, err = password(ctx); err != nil {
+			cli.Err(err)
+			return
+		}
+	}
+	fields := []*string{&p.URL, &p.User, &p.Store, &p.Timeout, &p.Project, &p.Monitor}
+	for i, s := range []string{ctx.String("url"), ctx.String("user"), ctx.String("store"),
+		ctx.String("timeout"), ctx.String("project"), ctx.String("monitor")} {
 		if s != "" {
-			(*old[i]) = s
+			*fields[i] = s
 		}
 	}
-	if err := cli.init(ctx); err != nil {
+	if p.Timeout != "" {
+		if _, err = time.ParseDuration(p.Timeout); err != nil {
+			cli.Err(err)
+			return
+		}
+	}
+	if !ok && p.URL == "" {
+		cli.Err(fmt.Errorf("pulsecli: profile %q requires --url", name))
+		return
+	}
+	if !ok && p.Store == "" && p.Pass != "" {
+		cli.Err(errNoStore)
+		return
+	}
+	if ctx.IsSet("user") {
+		// The session only validates the credentials.
+		c, err := cli.Client(p.URL, p.User, p.Pass)
+		if err != nil {
+			cli.Err(err)
+			return
+		}
+		c.Close()
+	}
+	cfg.Set(name, p)
+	if err = cli.Store.Save(cfg); err != nil {
+		cli.Err(err)
+		return
+	}
+	cli.Out()
+}
+
+// ProfileRemove removes a profile of the given name together with its password
+// and session token, unless another profile of the same user and server still
+// uses them.
+func (cli *CLI) ProfileRemove(ctx *cli.Context) {
+	cfg, name, err := cli.profile(ctx)
+	if err != nil {
+		cli.Err(err)
+		return
+	}
+	p, ok := cfg.Profiles[name]
+	if !ok {
+		cli.Err(fmt.Errorf("pulsecli: profile %q does not exist", name))
+		return
+	}
+	delete(cfg.Profiles, name)
+	// Secrets are kept under the user and the URL, so they are shared by every
+	// profile of the user on the same server.
+	shared := false
+	for _, q := range cfg.Profiles {
+		shared = shared || (q.Store == p.Store && secretKey(&q.Creds) == secretKey(&p.Creds))
+	}
+	if !shared {
+		if err = cli.Store.Forget(&p.Creds); err != nil {
+			cli.Err(err)
+			return
+		}
+	}
+	if cfg.Default == name {
+		cfg.Default = ""
+	}
+	if err = cli.Store.Save(cfg); err != nil {
+		cli.Err(err)
+		return
+	}
+	cli.Out()
+}
+
+// ProfileUse makes a profile of the given name the default one.
+func (cli *CLI) ProfileUse(ctx *cli.Context) {
+	cfg, name, err := cli.profile(ctx)
+	if err != nil {
 		cli.Err(err)
 		return
 	}
-	if err := cli.Store.Save(cli.cred); err != nil {
+	if _, ok := cfg.Profiles[name]; !ok {
+		cli.Err(fmt.Errorf("pulsecli: profile %q does not exist", name))
+		return
+	}
+	cfg.Default = name
+	if err = cli.Store.Save(cfg); err != nil {
 		cli.Err(err)
 		return
 	}
@@ -502,12 +1746,40 @@ func (cli *CLI) Trigger(ctx *cli.Context) {
 // all Pulse worker threads just stuck).
 // A project health check requests error and warning messages for latest build
 // of a given project, and fails when the list is not empty.
+// The thresholds of the checks are configured with a rules file given by
+// the --rules flag (see HealthRules), which may also ignore agents, tolerate
+// warnings or require a project to have a recent successful build.
+// With --stuck the health check samples the Pulse server a few times instead,
+// and fails when a build runs much longer than its project's builds usually
+// do, a stage waits for an agent for too long or an agent is synchronizing
+// or building without any progress in all the samples.
+// With --monitor nagios the health check reports a status of a Nagios plugin
+// with performance data instead - numbers of offline agents, failed projects
+// and test failures and a percentage of synchronizing agents, with warning
+// and critical thresholds given by the --thresholds flag.
+// With --prtg=advanced (or --prtg=json) the health check reports channels
+// of an advanced PRTG sensor instead - numbers of offline and synchronizing
+// agents, failed projects and test failures, with limits given by
+// the --prtg-limits flag.
+// Warning and critical thresholds of the metrics and channels, which are not
+// given on the command line, are derived from the same rules.
 func (cli *CLI) Health(ctx *cli.Context) {
 	if err := cli.init(ctx); err != nil {
 		cli.Err(err)
 		return
 	}
-	if p := cli.p; p != "" && p != ".*" {
+	rules, err := healthRules(ctx.String("rules"))
+	if err != nil {
+		cli.Err(err)
+		return
+	}
+	if cli.rules = rules; ctx.Bool("stuck") {
+		cli.healthStuck(ctx)
+	} else if cli.mon == monitorNagios {
+		cli.healthNagios(ctx)
+	} else if cli.adv != "" {
+		cli.healthSensor(ctx)
+	} else if p := cli.p; p != "" && p != ".*" {
 		cli.healthProject(ctx)
 	} else {
 		cli.healthPulse(ctx)
@@ -522,6 +1794,10 @@ func (cli *CLI) healthProject(ctx *cli.Context) {
 	}
 	all := make(map[string]pulse.Messages)
 	for _, p := range cli.matchProjects(p) {
+		r := cli.rules.Project(p)
+		if r == nil {
+			continue
+		}
 		id, err := util.NormalizeBuildOrRequestID(cli.c, p, cli.n)
 		if err != nil {
 			if err.(*pulse.InvalidBuildError).Status == pulse.BuildNeverBuilt {
@@ -536,7 +1812,11 @@ func (cli *CLI) healthProject(ctx *cli.Context) {
 			cli.Err(err)
 			return
 		}
-		if m = m.FilterOut(pulse.Info); len(m) > 0 {
+		m = r.Filter(m)
+		if err = r.CheckAge(cli.c, p, id); err != nil {
+			m = append(m, pulse.Message{Severity: pulse.SeverityError, Message: err.Error()})
+		}
+		if len(m) > 0 {
 			all[fmt.Sprintf("%s (build %d)", p, id)] = m
 		}
 	}
@@ -552,49 +1832,256 @@ func (cli *CLI) healthProject(ctx *cli.Context) {
 	}
 }
 
-func (cli *CLI) healthPulse(ctx *cli.Context) {
+// healthStats holds measurements of a health check.
+type healthStats struct {
+	agents  pulse.Agents
+	offline pulse.Agents
+	sync    pulse.Agents
+	failed  []string
+	tests   int
+}
+
+// syncPercent gives a percentage of agents in the synchronizing state.
+func (hs *healthStats) syncPercent() int {
+	if len(hs.agents) == 0 {
+		return 0
+	}
+	return 100 * len(hs.sync) / len(hs.agents)
+}
+
+// text gives a summary of offline agents and failed projects.
+func (hs *healthStats) text() string {
+	var text []string
+	for i := range hs.offline {
+		text = append(text, "offline: "+hs.offline[i].String())
+	}
+	for _, p := range hs.failed {
+		text = append(text, "failed: "+p)
+	}
+	if len(text) == 0 {
+		return "OK"
+	}
+	return strings.Join(text, ", ")
+}
+
+// healthStats measures states of agents and latest builds of projects matching
+// the --project pattern. A project fails when its latest build failed or
+// violates the project rule, the same way the project health check does.
+func (cli *CLI) healthStats() (*healthStats, error) {
 	a, err := cli.c.Agents()
 	if err != nil {
-		cli.Err(err)
-		return
+		return nil, err
 	}
-	if len(a.Filter(pulse.Sync)) >= (len(a)+1)/2 {
-		cli.Err("pulsecli: >=50% of Pulse agents are hanging now!")
-		return
+	p, err := cli.c.Projects()
+	if err != nil {
+		return nil, err
 	}
-	if a = a.Filter(pulse.Offline); len(a) == 0 {
-		cli.Out()
-	} else {
-		msg := make([]interface{}, 0, len(a))
-		for i := range a {
-			msg = append(msg, a[i])
+	a = cli.rules.Agents.Filter(a)
+	hs := &healthStats{agents: a, offline: a.Filter(pulse.Offline), sync: a.Filter(pulse.Sync)}
+	for _, p := range cli.matchProjects(p) {
+		r := cli.rules.Project(p)
+		if r == nil {
+			continue
+		}
+		b, err := cli.c.LatestBuildResult(p)
+		if err != nil {
+			if _, ok := err.(*pulse.InvalidBuildError); ok {
+				continue
+			}
+			return nil, err
+		}
+		if len(b) == 0 {
+			continue
+		}
+		ok := true
+		for i := range b {
+			ok = ok && b[i].Success
+			hs.tests += b[i].Test.Failures + b[i].Test.Errors
+		}
+		m, err := cli.c.Messages(p, b[0].ID)
+		if err != nil {
+			return nil, err
+		}
+		if err = r.CheckAge(cli.c, p, b[0].ID); err != nil {
+			ok = false
+		}
+		if !ok || len(r.Filter(m)) != 0 {
+			hs.failed = append(hs.failed, p)
 		}
-		cli.Err(msg...)
 	}
+	return hs, nil
 }
 
-// Projects is a command line interface to a Projects method of a pulse.Client.
-// It outputs a name for every project, one per line.
-func (cli *CLI) Projects(ctx *cli.Context) {
-	if err := cli.init(ctx); err != nil {
+// healthSensor reports the health stats as channels of an advanced sensor.
+// Limits given by the --prtg-limits flag override the ones derived from
+// the rules, which fail the same way the regular health check does.
+func (cli *CLI) healthSensor(ctx *cli.Context) {
+	l, err := prtg.ParseLimits(ctx.GlobalString("prtg-limits"))
+	if err != nil {
 		cli.Err(err)
 		return
 	}
-	p, err := cli.c.Projects()
+	hs, err := cli.healthStats()
 	if err != nil {
 		cli.Err(err)
 		return
 	}
-	msg := make([]interface{}, 0, len(p))
-	for _, p := range p {
-		msg = append(msg, p)
-	}
-	cli.Out(msg...)
+	zero, r := 0, &cli.rules.Agents
+	offline, sync := prtg.Limit{}, prtg.Limit{}
+	offline.Warning, offline.Error = r.OfflineLimits(len(hs.agents))
+	sync.Warning, sync.Error = r.SyncLimits(len(hs.agents))
+	limits := map[string]prtg.Limit{
+		"offline": offline,
+		"syncing": sync,
+		"failed":  {Error: &zero},
+	}
+	for k, v := range l {
+		limits[k] = v
+	}
+	ch := []struct {
+		key, name string
+		n         int
+	}{
+		{"offline", "Offline agents", len(hs.offline)},
+		{"syncing", "Synchronizing agents", len(hs.sync)},
+		{"failed", "Failed projects", len(hs.failed)},
+		{"tests", "Test failures", hs.tests},
+	}
+	s := &prtg.Sensor{Result: make([]prtg.Channel, len(ch)), Text: hs.text()}
+	for i, ch := range ch {
+		s.Result[i] = prtg.Channel{Name: ch.name, Value: ch.n, Unit: prtg.UnitCount}
+		s.Result[i].Limit(limits[ch.key])
+	}
+	cli.Out(s)
 }
 
-// Agents is a command line interface to a Agents method of a pulse.Client.
-// It prints hostname-agentname pairs one per line for every agent.
-// It tries to extract the hostname from every agent's URL.
+// healthNagios reports the health stats as a result of a Nagios plugin.
+// Thresholds given by the --thresholds flag override the ones derived from
+// the rules, which fail the same way the regular health check does.
+func (cli *CLI) healthNagios(ctx *cli.Context) {
+	t, err := nagios.ParseThresholds(ctx.GlobalString("thresholds"))
+	if err != nil {
+		cli.Err(err)
+		return
+	}
+	hs, err := cli.healthStats()
+	if err != nil {
+		cli.Err(err)
+		return
+	}
+	zero, hundred, agents, rules := 0, 100, len(hs.agents), &cli.rules.Agents
+	offline := nagios.Threshold{}
+	offline.Warning, offline.Critical = rules.OfflineLimits(agents)
+	th := map[string]nagios.Threshold{
+		"offline": offline,
+		"syncing": {Warning: rules.WarnSyncPercent, Critical: rules.MaxSyncPercent},
+		"failed":  {Critical: &zero},
+	}
+	for k, v := range t {
+		th[k] = v
+	}
+	r := &nagios.Result{
+		Text: hs.text(),
+		Metrics: []nagios.Metric{
+			{Label: "offline", Value: len(hs.offline), Min: &zero, Max: &agents},
+			{Label: "syncing", Value: hs.syncPercent(), Unit: "%", Min: &zero, Max: &hundred},
+			{Label: "failed", Value: len(hs.failed), Min: &zero},
+			{Label: "tests", Value: hs.tests, Min: &zero},
+		},
+	}
+	for i := range r.Metrics {
+		r.Metrics[i].Threshold = th[r.Metrics[i].Label]
+	}
+	cli.Out(r)
+}
+
+func (cli *CLI) healthPulse(ctx *cli.Context) {
+	a, err := cli.c.Agents()
+	if err != nil {
+		cli.Err(err)
+		return
+	}
+	if msg := cli.rules.Agents.Check(a); len(msg) != 0 {
+		cli.Err(msg...)
+		return
+	}
+	cli.Out()
+}
+
+func (cli *CLI) healthStuck(ctx *cli.Context) {
+	p, err := cli.c.Projects()
+	if err != nil {
+		cli.Err(err)
+		return
+	}
+	p = cli.matchProjects(p)
+	r := &cli.rules.Stuck
+	d := r.Detector(cli.c)
+	var s *util.Stuck
+	for i := 0; i < r.Samples; i++ {
+		if i != 0 {
+			time.Sleep(r.interval)
+		}
+		if s, err = d.Sample(p); err != nil {
+			cli.Err(err)
+			return
+		}
+	}
+	if msg := cli.stuckMessages(s); len(msg) != 0 {
+		cli.Err(msg...)
+		return
+	}
+	cli.Out()
+}
+
+func (cli *CLI) stuckMessages(s *util.Stuck) (msg []interface{}) {
+	if s == nil {
+		return nil
+	}
+	for _, b := range s.Builds {
+		msg = append(msg, fmt.Sprintf("pulsecli: build %d of %q runs for %v, while its median is %v",
+			b.ID, b.Project, seconds(b.Running), seconds(b.Median)))
+	}
+	for _, st := range s.Stages {
+		msg = append(msg, fmt.Sprintf("pulsecli: stage %q of build %d of %q waits for an agent for %v",
+			st.Stage, st.ID, st.Project, seconds(st.Pending)))
+	}
+	for _, a := range s.Agents {
+		if matchAny(cli.rules.Agents.ignore, a.Agent.Name) {
+			continue
+		}
+		msg = append(msg, fmt.Sprintf("pulsecli: agent %q is %s without progress since %s",
+			a.Agent.Name, strings.ToLower(string(a.Agent.Status)), a.Since.Format(time.RFC3339)))
+	}
+	return msg
+}
+
+func seconds(d time.Duration) time.Duration {
+	return d - d%time.Second
+}
+
+// Projects is a command line interface to a Projects method of a pulse.Client.
+// It outputs a name for every project, one per line.
+func (cli *CLI) Projects(ctx *cli.Context) {
+	if err := cli.init(ctx); err != nil {
+		cli.Err(err)
+		return
+	}
+	p, err := cli.c.Projects()
+	if err != nil {
+		cli.Err(err)
+		return
+	}
+	msg := make([]interface{}, 0, len(p))
+	for _, p := range p {
+		msg = append(msg, p)
+	}
+	cli.Out(msg...)
+}
+
+// Agents is a command line interface to a Agents method of a pulse.Client.
+// It prints hostname-agentname pairs one per line for every agent.
+// It tries to extract the hostname from every agent's URL.
 func (cli *CLI) Agents(ctx *cli.Context) {
 	if err := cli.init(ctx); err != nil {
 		cli.Err(err)
@@ -661,7 +2148,11 @@ func (cli *CLI) Run(args []string) {
 }
 
 // Artifact is a a command line interface to Artifact method of a pulse.Client.
-// It downloads all artifacts captured from given project and build number
+// It downloads all artifacts captured from given project and build number.
+// The download progress is drawn as a progress bar when stdout is a terminal,
+// otherwise a summary is printed every few seconds. Files which failed to
+// download are reported after all the projects are processed. When the
+// --cache-dir flag is set, files are looked up in the local cache first.
 func (cli *CLI) Artifact(ctx *cli.Context) {
 	var projects []string
 	err := cli.init(ctx)
@@ -669,13 +2160,25 @@ func (cli *CLI) Artifact(ctx *cli.Context) {
 		cli.Err(err)
 		return
 	}
+	if dir := ctx.String("cache-dir"); dir != "" {
+		ac, err := pulse.NewArtifactCache(dir)
+		if err != nil {
+			cli.Err(err)
+			return
+		}
+		cli.c.SetCache(ac)
+	}
+	cli.c.SetProgress(newProgress(os.Stdout).Report)
 	if cli.p == pulse.ProjectPersonal {
 		projects = append(projects, pulse.ProjectPersonal)
 	} else if projects, err = cli.c.Projects(); err != nil {
 		cli.Err(err)
 		return
 	}
-	var build int64
+	var (
+		build int64
+		msg   []interface{}
+	)
 	dir, url := cli.o.String(), cli.cred.URL
 	for _, p := range cli.matchProjects(projects) {
 		if build, err = util.NormalizeBuildOrRequestID(cli.c, p, cli.n); err != nil {
@@ -683,8 +2186,478 @@ func (cli *CLI) Artifact(ctx *cli.Context) {
 			return
 		}
 		if err = cli.c.Artifact(build, p, dir, url); err != nil {
+			errs, ok := err.(pulse.ArtifactErrors)
+			if !ok {
+				cli.Err(err)
+				return
+			}
+			for _, err := range errs {
+				msg = append(msg, err)
+			}
+		}
+	}
+	if len(msg) != 0 {
+		cli.Err(msg...)
+	}
+}
+
+// Upload is a command line interface to Upload method of a pulse.Client.
+// It attaches files given as arguments to a build of an exactly one project
+// as an artifact with a name given by the --name flag.
+func (cli *CLI) Upload(ctx *cli.Context) {
+	if err := cli.init(ctx); err != nil {
+		cli.Err(err)
+		return
+	}
+	p, name, files := cli.p, ctx.String("name"), []string(ctx.Args())
+	if p == "" || p == ".*" {
+		cli.Err("pulsecli: a --project name is missing")
+		return
+	}
+	if name == "" {
+		cli.Err("pulsecli: an artifact --name is missing")
+		return
+	}
+	if len(files) == 0 {
+		cli.Err("pulsecli: no files to upload")
+		return
+	}
+	for _, file := range files {
+		if _, err := os.Stat(file); err != nil {
+			cli.Err(err)
+			return
+		}
+	}
+	id, err := util.NormalizeBuildOrRequestID(cli.c, p, cli.n)
+	if err != nil {
+		cli.Err(err)
+		return
+	}
+	if err = cli.c.Upload(id, p, name, cli.cred.URL, files); err != nil {
+		if errs, ok := err.(pulse.ArtifactErrors); ok {
+			msg := make([]interface{}, 0, len(errs))
+			for _, err := range errs {
+				msg = append(msg, err)
+			}
+			cli.Err(msg...)
+			return
+		}
+		cli.Err(err)
+		return
+	}
+	msg := make([]interface{}, 0, len(files))
+	for _, file := range files {
+		msg = append(msg, file)
+	}
+	cli.Out(msg...)
+}
+
+var cleanupWhat = map[string]pulse.CleanupWhat{
+	"artifacts":  pulse.CleanupArtifacts,
+	"repository": pulse.CleanupRepository,
+	"snapshot":   pulse.CleanupSnapshot,
+}
+
+var cleanupUnit = map[string]pulse.CleanupUnit{
+	"builds": pulse.CleanupBuilds,
+	"days":   pulse.CleanupDays,
+}
+
+// split splits comma-separated list, trimming spaces and skipping empty items.
+func split(s string) (l []string) {
+	for _, s := range strings.Split(s, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			l = append(l, s)
+		}
+	}
+	return
+}
+
+// CleanupList is a command line interface to a ConfigCleanup method of
+// a pulse.Client. It outputs cleanup rules for every requested project
+// in an YAML format.
+func (cli *CLI) CleanupList(ctx *cli.Context) {
+	if err := cli.init(ctx); err != nil {
+		cli.Err(err)
+		return
+	}
+	p, err := cli.c.Projects()
+	if err != nil {
+		cli.Err(err)
+		return
+	}
+	m := make(map[string][]pulse.ProjectCleanup)
+	for _, p := range cli.matchProjects(p) {
+		cl, err := cli.c.ConfigCleanup(p)
+		if err != nil {
+			cli.Err(err)
+			return
+		}
+		m[p] = cl
+	}
+	y, err := yaml.Marshal(m)
+	if err != nil {
+		cli.Err(err)
+		return
+	}
+	cli.Out(string(y))
+}
+
+// CleanupAdd is a command line interface to a SetConfigCleanup method of
+// a pulse.Client. It adds a cleanup rule to every project requested, or
+// updates the rule if the project already has one with the same name.
+// It outputs pairs of a rule name and a project name, one per line, separated
+// by a tab.
+func (cli *CLI) CleanupAdd(ctx *cli.Context) {
+	if err := cli.init(ctx); err != nil {
+		cli.Err(err)
+		return
+	}
+	cl := pulse.ProjectCleanup{
+		Name:   ctx.String("name"),
+		Retain: ctx.Int("retain"),
+		States: split(ctx.String("states")),
+	}
+	if cl.Name == "" {
+		cli.Err("pulsecli: a cleanup rule --name is missing")
+		return
+	}
+	var ok bool
+	if cl.Unit, ok = cleanupUnit[ctx.String("unit")]; !ok {
+		cli.Err(fmt.Sprintf("pulsecli: invalid --unit value: %q", ctx.String("unit")))
+		return
+	}
+	for _, w := range split(ctx.String("what")) {
+		what, ok := cleanupWhat[w]
+		if !ok {
+			cli.Err(fmt.Sprintf("pulsecli: invalid --what value: %q", w))
+			return
+		}
+		cl.What = append(cl.What, what)
+	}
+	cl.All = len(cl.What) == 0
+	p, err := cli.c.Projects()
+	if err != nil {
+		cli.Err(err)
+		return
+	}
+	msg := make([]interface{}, 0, len(p))
+	for _, p := range cli.matchProjects(p) {
+		if err = cli.c.SetConfigCleanup(p, cl); err != nil {
 			cli.Err(err)
 			return
 		}
+		msg = append(msg, fmt.Sprintf("%s\t%q", cl.Name, p))
+	}
+	cli.Out(msg...)
+}
+
+// CleanupRemove is a command line interface to a DeleteConfigCleanup method
+// of a pulse.Client. It removes a cleanup rule from every project requested,
+// which has the rule configured. It outputs pairs of a rule name and a project
+// name, one per line, separated by a tab.
+func (cli *CLI) CleanupRemove(ctx *cli.Context) {
+	if err := cli.init(ctx); err != nil {
+		cli.Err(err)
+		return
+	}
+	name := ctx.String("name")
+	if name == "" {
+		cli.Err("pulsecli: a cleanup rule --name is missing")
+		return
+	}
+	cli.cleanup(name, cli.c.DeleteConfigCleanup)
+}
+
+// CleanupApply is a command line interface to a Cleanup method of a pulse.Client.
+// It runs cleanup rules for every project requested - either all of them, or
+// only the one with a name given by the --name flag. It outputs pairs of
+// a rule name and a project name, one per line, separated by a tab.
+func (cli *CLI) CleanupApply(ctx *cli.Context) {
+	if err := cli.init(ctx); err != nil {
+		cli.Err(err)
+		return
+	}
+	cli.cleanup(ctx.String("name"), cli.c.Cleanup)
+}
+
+// cleanup calls fn for every cleanup rule of every project requested, which
+// has the given name. Empty name matches every rule.
+func (cli *CLI) cleanup(name string, fn func(project, name string) error) {
+	p, err := cli.c.Projects()
+	if err != nil {
+		cli.Err(err)
+		return
+	}
+	var msg []interface{}
+	for _, p := range cli.matchProjects(p) {
+		cl, err := cli.c.ConfigCleanup(p)
+		if err != nil {
+			cli.Err(err)
+			return
+		}
+		for i := range cl {
+			if name != "" && cl[i].Name != name {
+				continue
+			}
+			if err = fn(p, cl[i].Name); err != nil {
+				cli.Err(err)
+				return
+			}
+			msg = append(msg, fmt.Sprintf("%s\t%q", cl[i].Name, p))
+		}
+	}
+	cli.Out(msg...)
+}
+
+// Prune removes files from the local artifact cache, which were not used for
+// longer than the --max-age duration. It outputs a number and a total size
+// of the removed files.
+func (cli *CLI) Prune(ctx *cli.Context) {
+	dir := ctx.String("cache-dir")
+	if dir == "" {
+		cli.Err("pulsecli: a --cache-dir is missing")
+		return
+	}
+	age, err := time.ParseDuration(ctx.String("max-age"))
+	if err != nil {
+		cli.Err(err)
+		return
+	}
+	ac, err := pulse.NewArtifactCache(dir)
+	if err != nil {
+		cli.Err(err)
+		return
+	}
+	n, size, err := ac.Prune(age)
+	if err != nil {
+		cli.Err(err)
+		return
+	}
+	cli.Out(fmt.Sprintf("removed %d files (%s)", n, bytesize(size)))
+}
+
+// Exporter serves metrics of the Pulse server in the Prometheus text format
+// at the /metrics endpoint of the --listen address. The metrics are collected
+// every --interval for projects matching the --project pattern. It returns
+// only when serving fails.
+func (cli *CLI) Exporter(ctx *cli.Context) {
+	if err := cli.init(ctx); err != nil {
+		cli.Err(err)
+		return
+	}
+	d, err := time.ParseDuration(ctx.String("interval"))
+	if err != nil {
+		cli.Err(err)
+		return
+	}
+	c := prom.NewCollector(cli.c)
+	c.Projects, c.Interval = cli.matchProjects, d
+	go c.Run(nil)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", c)
+	cli.Err(http.ListenAndServe(ctx.String("listen"), mux))
+}
+
+// Watch polls projects matching the --project pattern and agents every
+// --interval, and notifies about builds which broke or got fixed and agents
+// which went offline or back online. The notifications are dispatched to every
+// sink given with the --exec, --webhook, --smtp and --log flags, events are
+// written to stdout if none is given. The last seen state is persisted for
+// every profile and Pulse server, so the transitions which happened during
+// a restart are not missed. It returns only when the watcher could not be
+// set up.
+func (cli *CLI) Watch(ctx *cli.Context) {
+	if err := cli.init(ctx); err != nil {
+		cli.Err(err)
+		return
+	}
+	w, err := cli.watcher(ctx)
+	if err != nil {
+		cli.Err(err)
+		return
+	}
+	w.Error = func(err error) { fmt.Fprintln(os.Stderr, err) }
+	w.Run(nil)
+}
+
+// watchState gives the default path of the watch state file, which is kept
+// separately for every profile and Pulse server.
+func (cli *CLI) watchState() (string, error) {
+	name := cli.name
+	if u, err := url.Parse(cli.cred.URL); err == nil && u.Host != "" {
+		name += "@" + u.Host
+	}
+	return configDir(filepath.Join("watch", url.QueryEscape(name)+".yml"))
+}
+
+func (cli *CLI) watcher(ctx *cli.Context) (*watch.Watcher, error) {
+	d, err := time.ParseDuration(ctx.String("interval"))
+	if err != nil {
+		return nil, err
+	}
+	path := ctx.String("state")
+	if path == "" {
+		if path, err = cli.watchState(); err != nil {
+			return nil, err
+		}
+	}
+	w, err := watch.New(cli.c, path)
+	if err != nil {
+		return nil, err
+	}
+	w.Projects, w.Interval = cli.matchProjects, d
+	if cmd := ctx.String("exec"); cmd != "" {
+		w.Sinks = append(w.Sinks, watch.Command{Cmd: cmd})
+	}
+	if u := ctx.String("webhook"); u != "" {
+		if _, err = url.Parse(u); err != nil {
+			return nil, err
+		}
+		w.Sinks = append(w.Sinks, watch.Webhook{URL: u, Client: &http.Client{Timeout: 15 * time.Second}})
+	}
+	if addr := ctx.String("smtp"); addr != "" {
+		m := watch.Mail{Addr: addr, From: ctx.String("mail-from")}
+		for _, to := range strings.Split(ctx.String("mail-to"), ",") {
+			if to = strings.TrimSpace(to); to != "" {
+				m.To = append(m.To, to)
+			}
+		}
+		if m.From == "" || len(m.To) == 0 {
+			return nil, errors.New("pulsecli: both --mail-from and --mail-to are required for --smtp")
+		}
+		if u := ctx.String("smtp-user"); u != "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			m.Auth = smtp.PlainAuth("", u, os.Getenv("PULSECLI_SMTP_PASS"), host)
+		}
+		w.Sinks = append(w.Sinks, m)
+	}
+	switch l := ctx.String("log"); {
+	case l == "-" || (l == "" && len(w.Sinks) == 0):
+		w.Sinks = append(w.Sinks, watch.NewLog(os.Stdout))
+	case l != "":
+		s, err := watch.OpenLog(l)
+		if err != nil {
+			return nil, err
+		}
+		w.Sinks = append(w.Sinks, s)
+	}
+	return w, nil
+}
+
+// Top displays a full-screen dashboard of the latest builds of projects matching
+// the --project pattern and of agents matching the --agent one, refreshed every
+// --interval. The selected project can be triggered, its build in progress
+// cancelled or logs of its latest build opened in a web browser.
+func (cli *CLI) Top(ctx *cli.Context) {
+	if err := cli.init(ctx); err != nil {
+		cli.Err(err)
+		return
+	}
+	d, err := time.ParseDuration(ctx.String("interval"))
+	if err != nil {
+		cli.Err(err)
+		return
+	}
+	t := top.New(cli.c, cli.cred.URL)
+	t.Projects = cli.matchProjects
+	t.Agents = func(a pulse.Agents) pulse.Agents {
+		return a.Filter(func(a *pulse.Agent) bool { return cli.a.MatchString(a.Name) })
+	}
+	if err = top.Run(t, d); err != nil {
+		cli.Err(err)
+		return
+	}
+	cli.Out()
+}
+
+// Report aggregates completed builds of projects matching the --project
+// pattern, which started within the --since period, into a report of success
+// rates and durations of the projects and their stages, the flakiest stages
+// and commands (see Flaky) and utilisation of the agents. The report is written
+// to stdout or to the --output file, as text, CSV, JSON or HTML as given by
+// the --format flag.
+func (cli *CLI) Report(ctx *cli.Context) {
+	if err := cli.init(ctx); err != nil {
+		cli.Err(err)
+		return
+	}
+	d, err := report.ParsePeriod(ctx.String("since"))
+	if err != nil {
+		cli.Err(err)
+		return
+	}
+	f, err := report.ParseFormat(ctx.String("format"))
+	if err != nil {
+		cli.Err(err)
+		return
+	}
+	p, err := cli.c.Projects()
+	if err != nil {
+		cli.Err(err)
+		return
+	}
+	r, err := report.Collect(cli.c, cli.matchProjects(p), d)
+	if err != nil {
+		cli.Err(err)
+		return
+	}
+	var buf bytes.Buffer
+	if err = r.Write(&buf, f); err != nil {
+		cli.Err(err)
+		return
+	}
+	if o := ctx.String("output"); o != "" {
+		if err = ioutil.WriteFile(o, buf.Bytes(), 0644); err != nil {
+			cli.Err(err)
+			return
+		}
+		cli.Out()
+		return
+	}
+	cli.Out(strings.TrimSuffix(buf.String(), "\n"))
+}
+
+// Flaky analyses the --last builds of every project matching the --project
+// pattern and outputs stages and commands, which result changed between
+// consecutive builds of the same revision, in the JSON format. They are ranked
+// from the flakiest one by a ratio of such changes to all the consecutive
+// builds of the same revision.
+func (cli *CLI) Flaky(ctx *cli.Context) {
+	if err := cli.init(ctx); err != nil {
+		cli.Err(err)
+		return
+	}
+	n := ctx.Int("last")
+	if n <= 0 {
+		cli.Err(fmt.Errorf("pulsecli: invalid --last value %d", n))
+		return
+	}
+	p, err := cli.c.Projects()
+	if err != nil {
+		cli.Err(err)
+		return
+	}
+	flaky := []report.Flaky{}
+	for _, p := range cli.matchProjects(p) {
+		b, err := cli.c.BuildHistory(p, n)
+		if err != nil {
+			if _, ok := err.(*pulse.InvalidBuildError); ok {
+				continue
+			}
+			cli.Err(err)
+			return
+		}
+		flaky = append(flaky, report.FindFlaky(p, b)...)
+	}
+	report.SortFlaky(flaky)
+	b, err := json.MarshalIndent(flaky, "", "\t")
+	if err != nil {
+		cli.Err(err)
+		return
 	}
+	cli.Out(string(b))
 }
@@ -1,31 +1,63 @@
 package cli
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/x-formation/pulsekit"
+	"github.com/x-formation/pulsekit/dev"
 	"github.com/x-formation/pulsekit/mock"
+	"github.com/x-formation/pulsekit/nagios"
+	"github.com/x-formation/pulsekit/prtg"
+	"github.com/x-formation/pulsekit/report"
+	"github.com/x-formation/pulsekit/secret"
 
 	"github.com/codegangsta/cli"
 	"gopkg.in/v1/yaml"
 )
 
 type Flags struct {
-	URL      string
-	User     string
-	Pass     string
-	Agent    string
-	Project  string
-	Revision string
-	Timeout  time.Duration
-	Build    int
-	Prtg     bool
+	URL       string
+	User      string
+	Pass      string
+	Store     string
+	Agent     string
+	Project   string
+	Stage     string
+	Revision  string
+	SkipStage string
+	PatchType string
+	Timeout   time.Duration
+	MaxWait   time.Duration
+	Build     int
+	Prtg      bool
+	Limits    string
+	Monitor   string
+	Threshold string
+	Rules     string
+	DryRun    bool
+	Stuck     bool
+	Since     string
+	Format    string
+	Last      int
+	Profile   string
+	// Args are parsed by the local flag set, e.g. subcommand arguments.
+	Args []string
 }
 
 // NewFlags creates default flag set. The values must be the same as the ones
@@ -35,7 +67,12 @@ func newFlags() *Flags {
 		URL:     "http://pulse",
 		Agent:   ".*",
 		Project: ".*",
+		Stage:   ".*",
 		Timeout: 15 * time.Second,
+		MaxWait: 2 * time.Hour,
+		Since:   "7d",
+		Format:  "text",
+		Last:    50,
 	}
 }
 
@@ -49,15 +86,47 @@ type MockCLI struct {
 func (mcli *MockCLI) ctx() *cli.Context {
 	g := flag.NewFlagSet("global pulsecli test", flag.PanicOnError)
 	g.String("url", mcli.f.URL, "")
+	if mcli.f.URL != newFlags().URL {
+		g.Set("url", mcli.f.URL)
+	}
+	g.String("profile", mcli.f.Profile, "")
 	g.String("agent", mcli.f.Agent, "")
 	g.String("project", mcli.f.Project, "")
+	g.String("stage", mcli.f.Stage, "")
 	g.String("timeout", mcli.f.Timeout.String(), "")
 	g.Int("build", mcli.f.Build, "")
 	g.Bool("prtg", mcli.f.Prtg, "")
+	g.String("prtg-limits", mcli.f.Limits, "")
+	g.String("monitor", mcli.f.Monitor, "")
+	g.String("thresholds", mcli.f.Threshold, "")
 
 	l := flag.NewFlagSet("local pulsecli test", flag.PanicOnError)
 	l.String("revision", mcli.f.Revision, "")
+	l.String("user", mcli.f.User, "")
 	l.String("pass", mcli.f.Pass, "")
+	l.String("store", mcli.f.Store, "")
+	if mcli.f.User != "" {
+		l.Set("user", mcli.f.User)
+	}
+	if mcli.f.Pass != "" {
+		l.Set("pass", mcli.f.Pass)
+	}
+	l.String("url", "", "")
+	l.String("timeout", "", "")
+	l.String("project", "", "")
+	l.String("monitor", "", "")
+	l.String("skip-stage", mcli.f.SkipStage, "")
+	l.String("patch-type", mcli.f.PatchType, "")
+	l.Bool("dry-run", mcli.f.DryRun, "")
+	l.String("max-wait", mcli.f.MaxWait.String(), "")
+	l.String("rules", mcli.f.Rules, "")
+	l.Bool("stuck", mcli.f.Stuck, "")
+	l.String("since", mcli.f.Since, "")
+	l.String("format", mcli.f.Format, "")
+	l.String("output", "", "")
+	l.String("name", "", "")
+	l.Int("last", mcli.f.Last, "")
+	l.Parse(mcli.f.Args)
 
 	return cli.NewContext(mcli.cli.app, l, g)
 }
@@ -76,6 +145,13 @@ func (mcli *MockCLI) Login() (out []interface{}, err []interface{}) {
 	return
 }
 
+func (mcli *MockCLI) Logout() (out []interface{}, err []interface{}) {
+	mcli.cli.Out = func(i ...interface{}) { out = i }
+	mcli.cli.Err = func(i ...interface{}) { err = i }
+	mcli.cli.Logout(mcli.ctx())
+	return
+}
+
 func (mcli *MockCLI) Clean() (out []interface{}, err []interface{}) {
 	mcli.cli.Out = func(i ...interface{}) { out = i }
 	mcli.cli.Err = func(i ...interface{}) { err = i }
@@ -104,6 +180,20 @@ func (mcli *MockCLI) Health() (out []interface{}, err []interface{}) {
 	return
 }
 
+func (mcli *MockCLI) Report() (out []interface{}, err []interface{}) {
+	mcli.cli.Out = func(i ...interface{}) { out = i }
+	mcli.cli.Err = func(i ...interface{}) { err = i }
+	mcli.cli.Report(mcli.ctx())
+	return
+}
+
+func (mcli *MockCLI) Flaky() (out []interface{}, err []interface{}) {
+	mcli.cli.Out = func(i ...interface{}) { out = i }
+	mcli.cli.Err = func(i ...interface{}) { err = i }
+	mcli.cli.Flaky(mcli.ctx())
+	return
+}
+
 func (mcli *MockCLI) Personal() (out []interface{}, err []interface{}) {
 	mcli.cli.Out = func(i ...interface{}) { out = i }
 	mcli.cli.Err = func(i ...interface{}) { err = i }
@@ -146,14 +236,105 @@ func (mcli *MockCLI) Build() (out []interface{}, err []interface{}) {
 	return
 }
 
+func (mcli *MockCLI) Upload() (out []interface{}, err []interface{}) {
+	mcli.cli.Out = func(i ...interface{}) { out = i }
+	mcli.cli.Err = func(i ...interface{}) { err = i }
+	mcli.cli.Upload(mcli.ctx())
+	return
+}
+
+func (mcli *MockCLI) CleanupApply() (out []interface{}, err []interface{}) {
+	mcli.cli.Out = func(i ...interface{}) { out = i }
+	mcli.cli.Err = func(i ...interface{}) { err = i }
+	mcli.cli.CleanupApply(mcli.ctx())
+	return
+}
+
+func (mcli *MockCLI) ProfileList() (out []interface{}, err []interface{}) {
+	mcli.cli.Out = func(i ...interface{}) { out = i }
+	mcli.cli.Err = func(i ...interface{}) { err = i }
+	mcli.cli.ProfileList(mcli.ctx())
+	return
+}
+
+func (mcli *MockCLI) ProfileAdd() (out []interface{}, err []interface{}) {
+	mcli.cli.Out = func(i ...interface{}) { out = i }
+	mcli.cli.Err = func(i ...interface{}) { err = i }
+	mcli.cli.ProfileAdd(mcli.ctx())
+	return
+}
+
+func (mcli *MockCLI) ProfileRemove() (out []interface{}, err []interface{}) {
+	mcli.cli.Out = func(i ...interface{}) { out = i }
+	mcli.cli.Err = func(i ...interface{}) { err = i }
+	mcli.cli.ProfileRemove(mcli.ctx())
+	return
+}
+
+func (mcli *MockCLI) ProfileUse() (out []interface{}, err []interface{}) {
+	mcli.cli.Out = func(i ...interface{}) { out = i }
+	mcli.cli.Err = func(i ...interface{}) { err = i }
+	mcli.cli.ProfileUse(mcli.ctx())
+	return
+}
+
+// memStore keeps Config in memory, so tests do not touch ~/.pulsecli.
+type memStore struct {
+	c   Config
+	tok map[string]string
+	// forgot are keys of the forgotten secrets.
+	forgot []string
+}
+
+func (m *memStore) Load() (*Config, error) {
+	c := &Config{Default: m.c.Default}
+	for name, p := range m.c.Profiles {
+		cp := *p
+		c.Set(name, &cp)
+	}
+	return c, nil
+}
+
+func (m *memStore) Save(c *Config) error {
+	m.c = *c
+	return nil
+}
+
+func (m *memStore) Unlock(*Creds) error { return nil }
+
+func (m *memStore) Forget(c *Creds) error {
+	m.forgot = append(m.forgot, secretKey(c))
+	return nil
+}
+
+func (m *memStore) Token(c *Creds) (string, error) {
+	return m.tok[secretKey(c)], nil
+}
+
+func (m *memStore) SetToken(c *Creds, tok string) error {
+	if m.tok == nil {
+		m.tok = make(map[string]string)
+	}
+	if tok == "" {
+		delete(m.tok, secretKey(c))
+	} else {
+		m.tok[secretKey(c)] = tok
+	}
+	return nil
+}
+
 func NewMockCLI(c pulse.Client) *MockCLI {
 	mcli := &MockCLI{
 		cli: New(),
 		f:   newFlags(),
 	}
+	mcli.cli.Store = &memStore{}
 	mcli.cli.Client = func(_, _, _ string) (pulse.Client, error) {
 		return c, nil
 	}
+	mcli.cli.Session = func(_, _ string) (pulse.Client, error) {
+		return c, nil
+	}
 	return mcli
 }
 
@@ -165,13 +346,424 @@ func fixture() (mc *mock.Client, mcli *MockCLI, f *Flags) {
 }
 
 func TestFileStore(t *testing.T) {
-	t.Skip("TODO(rjeczalik)")
+	dir, err := ioutil.TempDir("", "pulsekit")
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("PULSECLI_PASSPHRASE", os.Getenv("PULSECLI_PASSPHRASE"))
+	os.Setenv("PULSECLI_PASSPHRASE", "correct horse")
+	fs := fileStore{filepath.Join(dir, ".pulsecli"), filepath.Join(dir, "secrets"), filepath.Join(dir, "tokens")}
+	// A file created with a permissive mode must be restricted on save.
+	if err = ioutil.WriteFile(fs.path, nil, 0644); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	cases := []struct {
+		store string
+		plain bool
+	}{
+		{storePlain, true},
+		{"", true},
+		{secret.NameFile, false},
+	}
+	for i, cas := range cases {
+		p := &Profile{Creds: Creds{URL: "http://pulse", User: "john", Pass: "s3cr3t", Store: cas.store}, Timeout: "1m"}
+		c := &Config{}
+		c.Set("production", p)
+		if err = fs.Save(c); err != nil {
+			t.Fatalf("expected err to be nil, was %q instead (i=%d)", err, i)
+		}
+		if fi, err := os.Stat(fs.path); err != nil || fi.Mode().Perm() != 0600 {
+			t.Errorf("expected config to be saved with 0600 mode, was fi=%v, err=%v (i=%d)", fi, err, i)
+		}
+		b, err := ioutil.ReadFile(fs.path)
+		if err != nil {
+			t.Fatalf("expected err to be nil, was %q instead (i=%d)", err, i)
+		}
+		if plain := bytes.Contains(b, []byte("s3cr3t")); plain != cas.plain {
+			t.Errorf("expected password in config to be %v, was %v instead (i=%d)", cas.plain, plain, i)
+		}
+		l, err := fs.Load()
+		if err != nil {
+			t.Fatalf("expected err to be nil, was %q instead (i=%d)", err, i)
+		}
+		name, lp, ok := l.Lookup("")
+		if !ok || name != "production" {
+			t.Fatalf("expected production profile to be the default one, was %q instead (i=%d)", name, i)
+		}
+		if err = fs.Unlock(&lp.Creds); err != nil {
+			t.Fatalf("expected err to be nil, was %q instead (i=%d)", err, i)
+		}
+		if !reflect.DeepEqual(lp, p) {
+			t.Errorf("expected profile to be %+v, was %+v instead (i=%d)", p, lp, i)
+		}
+		if err = fs.SetToken(&lp.Creds, "t0k3n"); err != nil {
+			t.Fatalf("expected err to be nil, was %q instead (i=%d)", err, i)
+		}
+		if tok, err := fs.Token(&lp.Creds); err != nil || tok != "t0k3n" {
+			t.Errorf("expected token to be t0k3n, was %q instead (err=%v, i=%d)", tok, err, i)
+		}
+		if err = fs.Forget(&lp.Creds); err != nil {
+			t.Fatalf("expected err to be nil, was %q instead (i=%d)", err, i)
+		}
+		if tok, err := fs.Token(&lp.Creds); err != nil || tok != "" {
+			t.Errorf("expected token to be removed, was %q instead (err=%v, i=%d)", tok, err, i)
+		}
+	}
+	if fi, err := os.Stat(fs.tokens); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("expected tokens to be saved with 0600 mode, was fi=%v, err=%v", fi, err)
+	}
+	// A file written before profiles were introduced holds the default profile.
+	if err = ioutil.WriteFile(fs.path, []byte("url: http://pulse\nuser: john\npass: s3cr3t\n"), 0600); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	c, err := fs.Load()
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	exp := Creds{URL: "http://pulse", User: "john", Pass: "s3cr3t"}
+	if name, p, ok := c.Lookup(""); !ok || name != DefaultProfile || p.Creds != exp {
+		t.Errorf("expected %s profile to be %+v, was %+v instead (ok=%v)", name, exp, p, ok)
+	}
+	if runtime.GOOS == "windows" {
+		return
+	}
+	if err = os.Chmod(fs.path, 0640); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	if _, err = fs.Load(); err == nil {
+		t.Error("expected config accessible by other users to be refused")
+	}
 }
 
 func TestPersonal(t *testing.T) {
 	t.Skip("TODO(rjeczalik)")
 }
 
+func TestPersonalDryRun(t *testing.T) {
+	stages := []pulse.ProjectStage{
+		{Name: "Build - Linux x86", Agent: "agents/Linux x86", Enabled: true},
+		{Name: "Build - Linux x64", Enabled: true},
+		{Name: "Build - Windows x86", Agent: "agents/Windows", Enabled: false},
+		{Name: "Test - Linux x86", Agent: "agents/Linux x86", Enabled: true},
+	}
+	table := []struct {
+		stage, skip string
+		out         []interface{}
+	}{{
+		".*", "",
+		[]interface{}{
+			`run	"Build - Linux x86"	"agents/Linux x86"`,
+			`run	"Build - Linux x64"	"any"`,
+			`run	"Test - Linux x86"	"agents/Linux x86"`,
+			`disabled	"Build - Windows x86"`,
+		},
+	}, {
+		"Linux", "^Test",
+		[]interface{}{
+			`run	"Build - Linux x86"	"agents/Linux x86"`,
+			`run	"Build - Linux x64"	"any"`,
+			`skip	"Test - Linux x86"`,
+			`disabled	"Build - Windows x86"`,
+		},
+	}, {
+		"x64", "",
+		[]interface{}{
+			`run	"Build - Linux x64"	"any"`,
+			`skip	"Build - Linux x86"`,
+			`skip	"Test - Linux x86"`,
+			`disabled	"Build - Windows x86"`,
+		},
+	}}
+	for i, tt := range table {
+		mc, mcli, f := fixture()
+		mc.Err, mc.CS, mc.P = make([]error, 2), stages, []string{"Pulse CLI", "Pulse CLI - Failure"}
+		f.Project, f.Stage, f.SkipStage = "Pulse CLI", tt.stage, tt.skip
+		f.PatchType, f.DryRun = "git", true
+		out, err := mcli.Personal()
+		mc.Check(t)
+		if err != nil && len(err) != 0 {
+			t.Errorf("expected err to be empty, was %v instead (i=%d)", err, i)
+		}
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("expected out to be %v, was %v instead (i=%d)", tt.out, out, i)
+		}
+	}
+}
+
+func TestPersonalDryRunNoStages(t *testing.T) {
+	mc, mcli, f := fixture()
+	mc.Err, mc.P = make([]error, 2), []string{"Pulse CLI"}
+	mc.CS = []pulse.ProjectStage{{Name: "Build - Linux x86", Enabled: true}}
+	f.Project, f.Stage, f.SkipStage = "Pulse CLI", ".*", "Linux"
+	f.PatchType, f.DryRun = "git", true
+	out, err := mcli.Personal()
+	mc.Check(t)
+	if out != nil && len(out) != 0 {
+		t.Errorf("expected out to be empty, was %v instead", out)
+	}
+	if err == nil || len(err) == 0 {
+		t.Error("expected err to be non-empty")
+	}
+}
+
+func TestWaitPersonal(t *testing.T) {
+	stages := []pulse.StageResult{
+		{Name: "Build - Linux x86", Agent: "agents/Linux x86", State: pulse.BuildSuccess, Complete: true},
+		{Name: "Build - Linux x64", Agent: "agents/Linux x64", State: pulse.BuildFailure, Complete: true},
+	}
+	table := []struct {
+		success bool
+		calls   int
+		out     []interface{}
+		err     []interface{}
+	}{{
+		true, 2,
+		[]interface{}{int64(12)},
+		nil,
+	}, {
+		false, 3,
+		nil,
+		[]interface{}{
+			`"Build - Linux x64"	"build"	"Command 'build' failed"`,
+			"pulsecli: personal build 12 failed",
+		},
+	}}
+	for i, tt := range table {
+		mc, mcli, _ := fixture()
+		mc.Err = make([]error, tt.calls)
+		mc.BR = []pulse.BuildResult{{ID: 12, Complete: true, Success: tt.success, Stages: stages}}
+		mc.M = pulse.Messages{
+			{Severity: pulse.SeverityWarning, StageName: "Build - Linux x86", Message: "deprecated"},
+			{Severity: pulse.SeverityError, StageName: "Build - Linux x64", CommandName: "build",
+				Message: "Command 'build' failed"},
+		}
+		var out, err []interface{}
+		mcli.cli.c = mc
+		mcli.cli.Out = func(i ...interface{}) { out = i }
+		mcli.cli.Err = func(i ...interface{}) { err = i }
+		var buf bytes.Buffer
+		b := []personalBuild{{Project: "Pulse CLI", Result: &dev.PersonalResult{ID: 12}}}
+		mcli.cli.waitPersonal(b, time.Minute, &buf)
+		mc.Check(t)
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("expected out to be %v, was %v instead (i=%d)", tt.out, out, i)
+		}
+		if !reflect.DeepEqual(err, tt.err) {
+			t.Errorf("expected err to be %v, was %v instead (i=%d)", tt.err, err, i)
+		}
+		progress := "personal build 12\n" +
+			`"Build - Linux x86"	success	"agents/Linux x86"` + "\n" +
+			`"Build - Linux x64"	failure	"agents/Linux x64"` + "\n"
+		if buf.String() != progress {
+			t.Errorf("expected progress to be %q, was %q instead (i=%d)", progress, buf.String(), i)
+		}
+	}
+}
+
+func TestPersonalErr_MissingProject(t *testing.T) {
+	mc, mcli, f := fixture()
+	f.PatchType = "git"
+	mc.P = []string{"LM-X - Tier 1", "Pulse CLI"}
+	ft := &fakeTool{}
+	mcli.cli.Dev = func(pulse.Client, string, string, string) (dev.Tool, error) {
+		return ft, nil
+	}
+	out, err := mcli.Personal()
+	mc.Check(t)
+	if len(out) != 0 {
+		t.Errorf("expected out to be empty, was %v instead", out)
+	}
+	expected := []interface{}{"pulsecli: a --project name is missing"}
+	if !reflect.DeepEqual(err, expected) {
+		t.Errorf("expected err to be %v, was %v instead", expected, err)
+	}
+	if len(ft.req) != 0 {
+		t.Errorf("expected no personal build requests, was %d instead", len(ft.req))
+	}
+}
+
+type fakeTool struct {
+	mu  sync.Mutex
+	ids map[string]int64
+	req []*dev.Personal
+}
+
+func (ft *fakeTool) Personal(p *dev.Personal) (*dev.PersonalResult, error) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.req = append(ft.req, p)
+	id, ok := ft.ids[p.Project]
+	if !ok {
+		return nil, &dev.ProjectNotFoundError{Project: p.Project}
+	}
+	return &dev.PersonalResult{ID: id}, nil
+}
+
+func (ft *fakeTool) SetTimeout(time.Duration) {}
+func (ft *fakeTool) SetJournal(*dev.Journal)  {}
+
+func TestPersonalBatch(t *testing.T) {
+	table := []struct {
+		ids map[string]int64
+		out []interface{}
+		err []interface{}
+	}{{
+		map[string]int64{"LM-X - Tier 1": 207, "LM-X - Tier 2": 208},
+		[]interface{}{`"LM-X - Tier 1"	207`, `"LM-X - Tier 2"	208`},
+		nil,
+	}, {
+		map[string]int64{"LM-X - Tier 2": 208},
+		nil,
+		[]interface{}{
+			`"LM-X - Tier 2"	208`,
+			`"LM-X - Tier 1"	pulsedev: project not found: "LM-X - Tier 1"`,
+		},
+	}}
+	for i, tt := range table {
+		mc, mcli, f := fixture()
+		mc.Err, mc.P = make([]error, 3), []string{"LM-X - Tier 1", "LM-X - Tier 2", "Pulse CLI"}
+		mc.CS = []pulse.ProjectStage{
+			{Name: "Build - Linux x86", Enabled: true},
+			{Name: "Build - Windows x86", Enabled: true},
+		}
+		f.Project, f.Stage, f.PatchType = "LM-X - Tier", "Linux", "git"
+		ft := &fakeTool{ids: tt.ids}
+		mcli.cli.Dev = func(pulse.Client, string, string, string) (dev.Tool, error) {
+			return ft, nil
+		}
+		out, err := mcli.Personal()
+		mc.Check(t)
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("expected out to be %v, was %v instead (i=%d)", tt.out, out, i)
+		}
+		if !reflect.DeepEqual(err, tt.err) {
+			t.Errorf("expected err to be %v, was %v instead (i=%d)", tt.err, err, i)
+		}
+		if len(ft.req) != 2 {
+			t.Errorf("expected 2 personal build requests, was %d instead (i=%d)", len(ft.req), i)
+		}
+		for _, p := range ft.req {
+			if !reflect.DeepEqual(p.Stages, []string{"Build - Windows x86"}) {
+				t.Errorf("expected only the Windows stage to be skipped, was %v instead (i=%d)",
+					p.Stages, i)
+			}
+		}
+	}
+}
+
+// compileRules gives health rules read from the YAML string.
+func compileRules(t *testing.T, s string) *HealthRules {
+	r := &HealthRules{}
+	if err := yaml.Unmarshal([]byte(s), r); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	if err := r.compile(); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	return r
+}
+
+func TestHealthSensor(t *testing.T) {
+	mc, mcli, f := fixture()
+	mc.Err = make([]error, 6)
+	mc.A = pulse.Agents{
+		{Name: "Linux x86", Status: pulse.AgentOffline, Host: "linux86"},
+		{Name: "Linux x64", Status: pulse.AgentSync, Host: "linux64"},
+		{Name: "Windows", Status: pulse.AgentIdle, Host: "win"},
+	}
+	mc.P = []string{"LM-X - Tier 1", "LM-X - Tier 2"}
+	mc.L = []pulse.BuildResult{{ID: 3, Success: false, Test: pulse.TestSummary{Failures: 2, Errors: 1}}}
+	f.Limits = "failed=0:1,tests=5:10"
+	var out []interface{}
+	mcli.cli.c, mcli.cli.p = mc, ".*"
+	mcli.cli.rules = compileRules(t, "agents:\n  max_offline: 0\n  max_sync_percent: 66\n"+
+		"  warn_sync_percent: 0\nprojects:\n- match: .*\n")
+	mcli.cli.Out = func(i ...interface{}) { out = i }
+	mcli.cli.Err = func(i ...interface{}) { t.Errorf("expected Err to not be called, was called with %v", i) }
+	mcli.cli.healthSensor(mcli.ctx())
+	mc.Check(t)
+	if len(out) != 1 {
+		t.Fatalf("expected out to have 1 element, was %v instead", out)
+	}
+	s, ok := out[0].(*prtg.Sensor)
+	if !ok {
+		t.Fatalf("expected out[0] to be *prtg.Sensor, was %T instead", out[0])
+	}
+	zero, one, two, five, ten := 0, 1, 2, 5, 10
+	exp := []prtg.Channel{
+		{Name: "Offline agents", Value: 1, Unit: prtg.UnitCount, LimitMode: 1, MaxError: &zero},
+		{Name: "Synchronizing agents", Value: 1, Unit: prtg.UnitCount, LimitMode: 1, MaxWarning: &zero, MaxError: &two},
+		{Name: "Failed projects", Value: 2, Unit: prtg.UnitCount, LimitMode: 1, MaxWarning: &zero, MaxError: &one},
+		{Name: "Test failures", Value: 6, Unit: prtg.UnitCount, LimitMode: 1, MaxWarning: &five, MaxError: &ten},
+	}
+	if !reflect.DeepEqual(s.Result, exp) {
+		t.Errorf("expected channels to be %+v, was %+v instead", exp, s.Result)
+	}
+	text := "offline: Linux x86@linux86, failed: LM-X - Tier 1, failed: LM-X - Tier 2"
+	if s.Text != text {
+		t.Errorf("expected text to be %q, was %q instead", text, s.Text)
+	}
+}
+
+func TestHealthNagios(t *testing.T) {
+	mc, mcli, f := fixture()
+	mc.Err = make([]error, 4)
+	mc.A = pulse.Agents{
+		{Name: "Linux x86", Status: pulse.AgentOffline, Host: "linux86"},
+		{Name: "Linux x64", Status: pulse.AgentSync, Host: "linux64"},
+		{Name: "Windows", Status: pulse.AgentIdle, Host: "win"},
+	}
+	mc.P = []string{"LM-X - Tier 1"}
+	mc.L = []pulse.BuildResult{{ID: 7, Success: true}}
+	mc.M = pulse.Messages{{Severity: pulse.SeverityWarning, Message: "deprecated option"}}
+	f.Threshold = "failed=:1,tests=0:"
+	var out []interface{}
+	mcli.cli.c, mcli.cli.p = mc, ".*"
+	mcli.cli.rules = compileRules(t, "agents:\n  max_offline_percent: 50\n  max_sync_percent: 49\n"+
+		"  warn_sync_percent: 25\nprojects:\n- match: .*\n  tolerate: [deprecated]\n")
+	mcli.cli.Out = func(i ...interface{}) { out = i }
+	mcli.cli.Err = func(i ...interface{}) { t.Errorf("expected Err to not be called, was called with %v", i) }
+	mcli.cli.healthNagios(mcli.ctx())
+	mc.Check(t)
+	if len(out) != 1 {
+		t.Fatalf("expected out to have 1 element, was %v instead", out)
+	}
+	r, ok := out[0].(*nagios.Result)
+	if !ok {
+		t.Fatalf("expected out[0] to be *nagios.Result, was %T instead", out[0])
+	}
+	var buf bytes.Buffer
+	r.Write(&buf)
+	exp := "PULSE WARNING - offline: Linux x86@linux86 | offline=1;;1;0;3 syncing=33%;25;49;0;100 failed=0;;1;0 tests=0;0;;0\n"
+	if buf.String() != exp {
+		t.Errorf("expected output to be %q, was %q instead", exp, buf.String())
+	}
+}
+
+func TestPrtgMode(t *testing.T) {
+	table := map[string]prtgMode{
+		"true":     prtgLegacy,
+		"false":    "",
+		"advanced": prtgAdvanced,
+		"xml":      prtgAdvanced,
+		"json":     prtgJSON,
+	}
+	for s, exp := range table {
+		var m prtgMode
+		if err := m.Set(s); err != nil {
+			t.Errorf("expected err to be nil, was %q instead (s=%s)", err, s)
+		}
+		if m != exp {
+			t.Errorf("expected mode to be %q, was %q instead (s=%s)", exp, m, s)
+		}
+	}
+	var m prtgMode
+	if err := m.Set("yaml"); err == nil {
+		t.Error("expected err to be non-nil")
+	}
+}
+
 func TestWait(t *testing.T) {
 	mc, mcli, f := fixture()
 	mc.Err = make([]error, 2)
@@ -374,6 +966,276 @@ func TestLogin(t *testing.T) {
 	}
 }
 
+func TestLoginPassword(t *testing.T) {
+	defer os.Setenv("PULSECLI_PASS", os.Getenv("PULSECLI_PASS"))
+	defer func(r *bufio.Reader) { stdin = r }(stdin)
+	cases := []struct {
+		pass, env, stdin string
+	}{
+		{"s3cr3t", "", ""},
+		{"-", "", "s3cr3t\n"},
+		{"", "s3cr3t", ""},
+	}
+	for i, cas := range cases {
+		mc, mcli, f := fixture()
+		f.User, f.Pass, f.Store = "john", cas.pass, secret.NamePass
+		os.Setenv("PULSECLI_PASS", cas.env)
+		stdin = bufio.NewReader(strings.NewReader(cas.stdin))
+		_, err := mcli.Login()
+		mc.Check(t)
+		if len(err) != 0 {
+			t.Errorf("expected err to be empty, was %v instead (i=%d)", err, i)
+			continue
+		}
+		exp := Creds{URL: "http://pulse", User: "john", Pass: "s3cr3t", Store: secret.NamePass}
+		c := mcli.cli.Store.(*memStore).c
+		if p := c.Profiles[DefaultProfile]; c.Default != DefaultProfile || p == nil || p.Creds != exp {
+			t.Errorf("expected default profile creds to be %+v, was %+v instead (i=%d)", exp, c, i)
+		}
+	}
+}
+
+func TestLoginUpdate(t *testing.T) {
+	mc, mcli, f := fixture()
+	f.User, f.Pass, f.Store = "john", "s3cr3t", storePlain
+	if _, err := mcli.Login(); len(err) != 0 {
+		t.Fatalf("expected err to be empty, was %v instead", err)
+	}
+	var logins []Creds
+	mcli.cli.Client = func(url, user, pass string) (pulse.Client, error) {
+		logins = append(logins, Creds{URL: url, User: user, Pass: pass})
+		return mc, nil
+	}
+	updates := []struct {
+		url, pass string
+		exp       Creds
+	}{
+		{"http://staging", "", Creds{URL: "http://staging", User: "john", Pass: "s3cr3t", Store: storePlain}},
+		{"", "p4ss", Creds{URL: "http://staging", User: "john", Pass: "p4ss", Store: storePlain}},
+	}
+	for i, u := range updates {
+		f.User, f.Pass, f.Store, f.URL = "", u.pass, "", newFlags().URL
+		if u.url != "" {
+			f.URL = u.url
+		}
+		if _, err := mcli.Login(); len(err) != 0 {
+			t.Fatalf("expected err to be empty, was %v instead (i=%d)", err, i)
+		}
+		if p := mcli.cli.Store.(*memStore).c.Profiles[DefaultProfile]; p.Creds != u.exp {
+			t.Errorf("expected creds to be %+v, was %+v instead (i=%d)", u.exp, p.Creds, i)
+		}
+		if exp := (Creds{URL: u.exp.URL, User: u.exp.User, Pass: u.exp.Pass}); len(logins) != i+1 || logins[i] != exp {
+			t.Errorf("expected a login with %+v, was %+v instead (i=%d)", exp, logins, i)
+		}
+	}
+}
+
+func TestLoginNoStore(t *testing.T) {
+	// Neither secret-tool nor pass can be found without a PATH.
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", "")
+	mc, mcli, f := fixture()
+	f.User, f.Pass = "john", "s3cr3t"
+	if _, err := mcli.Login(); len(err) != 1 || err[0] != errNoStore {
+		t.Errorf("expected err to be errNoStore, was %v instead", err)
+	}
+	if p := mcli.cli.Store.(*memStore).c.Profiles; len(p) != 0 {
+		t.Errorf("expected no profile to be saved, was %v instead", p)
+	}
+	_, mcli, f = fixture()
+	f.Args = []string{"--url", "http://pulse", "--user", "john", "--pass", "s3cr3t", "staging"}
+	if _, err := mcli.ProfileAdd(); len(err) != 1 || err[0] != errNoStore {
+		t.Errorf("expected err to be errNoStore, was %v instead", err)
+	}
+	mc.Check(t)
+}
+
+func TestSession(t *testing.T) {
+	mc, mcli, f := fixture()
+	mc.Tok = "t0k3n"
+	f.User, f.Pass, f.Store = "john", "s3cr3t", storePlain
+	if _, err := mcli.Login(); len(err) != 0 {
+		t.Fatalf("expected err to be empty, was %v instead", err)
+	}
+	store, creds := mcli.cli.Store.(*memStore), &Creds{URL: "http://pulse", User: "john"}
+	if tok, _ := store.Token(creds); tok != "t0k3n" {
+		t.Fatalf("expected token to be persisted on login, was %q instead", tok)
+	}
+	var logins, sessions []string
+	rejected := false
+	mcli.cli.Client = func(_, _, pass string) (pulse.Client, error) {
+		logins = append(logins, pass)
+		return mc, nil
+	}
+	mcli.cli.Session = func(_, tok string) (pulse.Client, error) {
+		sessions = append(sessions, tok)
+		if rejected {
+			return nil, errors.New("invalid token")
+		}
+		return mc, nil
+	}
+	f.User, f.Pass = "", ""
+	cases := []struct {
+		rejected bool
+		logins   []string
+		tok      string
+	}{
+		{false, nil, "t0k3n"},
+		{true, []string{"s3cr3t"}, "n3wt0k3n"},
+	}
+	mc.Tok = "n3wt0k3n"
+	for i, cas := range cases {
+		logins, sessions, rejected = nil, nil, cas.rejected
+		if err := mcli.cli.init(mcli.ctx()); err != nil {
+			t.Fatalf("expected err to be nil, was %q instead (i=%d)", err, i)
+		}
+		if !reflect.DeepEqual(sessions, []string{"t0k3n"}) || !reflect.DeepEqual(logins, cas.logins) {
+			t.Errorf("expected logins to be %v, was sessions=%v, logins=%v instead (i=%d)", cas.logins,
+				sessions, logins, i)
+		}
+		if tok, _ := store.Token(creds); tok != cas.tok {
+			t.Errorf("expected token to be %q, was %q instead (i=%d)", cas.tok, tok, i)
+		}
+	}
+	// Logout closes the session, the next one does nothing.
+	logins, sessions, rejected = nil, nil, false
+	mc.Err = []error{nil}
+	for i := 0; i < 2; i++ {
+		if _, err := mcli.Logout(); len(err) != 0 {
+			t.Fatalf("expected err to be empty, was %v instead (i=%d)", err, i)
+		}
+	}
+	mc.Check(t)
+	if !reflect.DeepEqual(sessions, []string{"n3wt0k3n"}) || logins != nil {
+		t.Errorf("expected a single session to be closed, was sessions=%v, logins=%v instead", sessions, logins)
+	}
+	if tok, _ := store.Token(creds); tok != "" {
+		t.Errorf("expected token to be removed, was %q instead", tok)
+	}
+}
+
+func TestSessionRelogin(t *testing.T) {
+	mc, mcli, f := fixture()
+	mc.Tok = "t0k3n"
+	f.User, f.Pass, f.Store = "john", "s3cr3t", storePlain
+	if _, err := mcli.Login(); len(err) != 0 {
+		t.Fatalf("expected err to be empty, was %v instead", err)
+	}
+	var logins []string
+	mcli.cli.Client = func(_, _, pass string) (pulse.Client, error) {
+		logins = append(logins, pass)
+		return &mock.Client{Tok: "n3wt0k3n"}, nil
+	}
+	f.User, f.Pass, mc.LF = "", "", nil
+	if err := mcli.cli.init(mcli.ctx()); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	if mc.LF == nil {
+		t.Fatal("expected a login function to be set")
+	}
+	tok, err := mc.LF()
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	store := mcli.cli.Store.(*memStore)
+	if tok != "n3wt0k3n" || !reflect.DeepEqual(logins, []string{"s3cr3t"}) {
+		t.Errorf("expected a login giving n3wt0k3n, was %q with logins=%v instead", tok, logins)
+	}
+	if tok, _ = store.Token(&Creds{URL: "http://pulse", User: "john"}); tok != "n3wt0k3n" {
+		t.Errorf("expected the new token to be persisted, was %q instead", tok)
+	}
+	mc.Check(t)
+}
+
+func TestSessionClose(t *testing.T) {
+	mc, mcli, f := fixture()
+	mc.Tok, f.User, f.Pass = "t0k3n", "john", "s3cr3t"
+	// A session not persisted by the command is closed after it.
+	mc.Err, mc.P = make([]error, 3), []string{"Go - Master"}
+	if _, err := mcli.Clean(); len(err) != 0 {
+		t.Fatalf("expected err to be empty, was %v instead", err)
+	}
+	mc.Check(t)
+	if tok := mcli.cli.Store.(*memStore).tok; len(tok) != 0 {
+		t.Errorf("expected no token to be persisted, was %v instead", tok)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	mc, mcli, f := fixture()
+	adds := [][]string{
+		{"--url", "http://staging", "--user", "john", "--pass", "s3cr3t", "--store", "plain",
+			"--timeout", "1m", "--project", "^LM-X", "--monitor", "nagios", "staging"},
+		{"--url", "http://pulse", "--user", "jane", "--pass", "p4ss", "--store", "plain", "production"},
+		{"--url", "http://staging", "--user", "john", "--pass", "s3cr3t", "--store", "plain", "staging-john"},
+	}
+	// Sessions validating the credentials are closed.
+	mc.Err = make([]error, len(adds))
+	for i, args := range adds {
+		f.Args = args
+		if _, err := mcli.ProfileAdd(); len(err) != 0 {
+			t.Fatalf("expected err to be empty, was %v instead (i=%d)", err, i)
+		}
+	}
+	f.Args = []string{"--user", "john", "--pass", "s3cr3t", "--store", "plain", "testing"}
+	if _, err := mcli.ProfileAdd(); len(err) != 1 {
+		t.Errorf("expected err for a new profile without --url, was %v instead", err)
+	}
+	store := mcli.cli.Store.(*memStore)
+	if store.c.Default != "staging" {
+		t.Errorf("expected first profile to be the default one, was %q instead", store.c.Default)
+	}
+	f.Args = []string{"production"}
+	if _, err := mcli.ProfileUse(); len(err) != 0 {
+		t.Fatalf("expected err to be empty, was %v instead", err)
+	}
+	f.Args = nil
+	out, err := mcli.ProfileList()
+	if len(err) != 0 {
+		t.Fatalf("expected err to be empty, was %v instead", err)
+	}
+	exp := []interface{}{"* production http://pulse jane", "  staging http://staging john",
+		"  staging-john http://staging john"}
+	if !reflect.DeepEqual(out, exp) {
+		t.Errorf("expected out to be %v, was %v instead", exp, out)
+	}
+	f.Profile = "staging"
+	if err := mcli.cli.init(mcli.ctx()); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	if cli := mcli.cli; cli.cred.URL != "http://staging" || cli.p != "^LM-X" || cli.d != time.Minute ||
+		cli.mon != monitorNagios {
+		t.Errorf("expected staging profile defaults to be used, was url=%s, project=%s, timeout=%v, monitor=%s",
+			cli.cred.URL, cli.p, cli.d, cli.mon)
+	}
+	f.Profile = "testing"
+	if err := mcli.cli.init(mcli.ctx()); err == nil {
+		t.Error("expected err to not be nil for a missing profile")
+	}
+	f.Args = []string{"production"}
+	if _, err := mcli.ProfileRemove(); len(err) != 0 {
+		t.Fatalf("expected err to be empty, was %v instead", err)
+	}
+	if _, ok := store.c.Profiles["production"]; ok || store.c.Default != "" {
+		t.Errorf("expected production profile to be removed, was %+v instead", store.c)
+	}
+	// Secrets of staging are shared with staging-john, so they are kept.
+	f.Args = []string{"staging"}
+	if _, err := mcli.ProfileRemove(); len(err) != 0 {
+		t.Fatalf("expected err to be empty, was %v instead", err)
+	}
+	if exp := []string{"jane@http://pulse"}; !reflect.DeepEqual(store.forgot, exp) {
+		t.Errorf("expected forgotten secrets to be %v, was %v instead", exp, store.forgot)
+	}
+	f.Args = []string{"production"}
+	for _, cmd := range []func() ([]interface{}, []interface{}){mcli.ProfileRemove, mcli.ProfileUse} {
+		if _, err := cmd(); len(err) == 0 {
+			t.Error("expected err to not be empty for a missing profile")
+		}
+	}
+	mc.Check(t)
+}
+
 func TestClean(t *testing.T) {
 	mc, mcli, f := fixture()
 	f.Project = "^Go.*"
@@ -551,6 +1413,353 @@ func TestHealthPulseErr_Offline(t *testing.T) {
 	}
 }
 
+const healthRulesYAML = `agents:
+  ignore: ["^Windows"]
+  max_offline: 1
+projects:
+- match: "Tier 1$"
+  max_age: 24h
+  tolerate: ["^deprecated"]
+stuck:
+  samples: 2
+  interval: 1ms
+`
+
+func writeHealthRules(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "pulsekit")
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	path := filepath.Join(dir, "health.yml")
+	if err = ioutil.WriteFile(path, []byte(healthRulesYAML), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestHealthRules(t *testing.T) {
+	path, done := writeHealthRules(t)
+	defer done()
+	r, err := ReadHealthRules(path)
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	agents := []pulse.Agents{{
+		{Name: "Linux", Status: pulse.AgentOffline},
+		{Name: "Windows XP", Status: pulse.AgentOffline},
+		{Name: "Windows 7", Status: pulse.AgentOffline},
+	}, {
+		{Name: "Linux", Status: pulse.AgentOffline},
+		{Name: "Linux x64", Status: pulse.AgentOffline},
+		{Name: "Windows 7", Status: pulse.AgentIdle},
+	}}
+	checks := []int{0, 2}
+	for i, a := range agents {
+		if n := len(r.Agents.Check(a)); n != checks[i] {
+			t.Errorf("expected len(msg) to be %d, was %d instead (i=%d)", checks[i], n, i)
+		}
+	}
+	if p := r.Project("LM-X - Tier 2"); p != nil {
+		t.Errorf("expected p to be nil, was %+v instead", p)
+	}
+	p := r.Project("LM-X - Tier 1")
+	if p == nil {
+		t.Fatal("expected p to be non-nil")
+	}
+	m := p.Filter(pulse.Messages{
+		{Severity: pulse.SeverityWarning, Message: "deprecated option"},
+		{Severity: pulse.SeverityWarning, Message: "test failed"},
+		{Severity: pulse.SeverityError, Message: "deprecated build"},
+		{Severity: pulse.SeverityInfo, Message: "info"},
+	})
+	if len(m) != 2 || m[0].Message != "test failed" || m[1].Message != "deprecated build" {
+		t.Errorf("expected tolerated messages to be filtered out, was %v instead", m)
+	}
+}
+
+func TestHealthRulesErr(t *testing.T) {
+	for i, s := range []string{
+		"projects:\n- match: \"(\"\n",
+		"projects:\n- max_age: 2 days\n",
+		"agents:\n  ignore: [\"[\"]\n",
+		"stuck:\n  interval: soon\n",
+		"stuck:\n  samples: -1\n",
+	} {
+		r := &HealthRules{}
+		if err := yaml.Unmarshal([]byte(s), r); err != nil {
+			t.Errorf("expected err to be nil, was %q instead (i=%d)", err, i)
+			continue
+		}
+		if err := r.compile(); err == nil {
+			t.Errorf("expected err to be non-nil (i=%d)", i)
+		}
+	}
+}
+
+func TestCheckAge(t *testing.T) {
+	now := time.Now()
+	r := compileRules(t, "projects:\n- match: .*\n  max_age: 1h\n").Project("Pulse CLI")
+	table := []struct {
+		h  []pulse.BuildResult
+		ok bool
+	}{{
+		[]pulse.BuildResult{
+			{ID: 13, Start: now.Add(-time.Minute)},
+			{ID: 12, Complete: true, Success: true, Start: now.Add(-20 * time.Minute), End: now.Add(-10 * time.Minute)},
+		},
+		true,
+	}, {
+		[]pulse.BuildResult{
+			{ID: 13, Start: now.Add(-time.Minute)},
+			{ID: 12, Complete: true, Start: now.Add(-20 * time.Minute), End: now.Add(-10 * time.Minute)},
+			{ID: 11, Complete: true, Success: true, Start: now.Add(-3 * time.Hour), End: now.Add(-2 * time.Hour)},
+		},
+		false,
+	}}
+	for i, tt := range table {
+		mc := mock.NewClient()
+		mc.Err, mc.H = make([]error, 1), tt.h
+		err := r.CheckAge(mc, "Pulse CLI", 13)
+		mc.Check(t)
+		if (err == nil) != tt.ok {
+			t.Errorf("expected ok to be %v, was err=%v instead (i=%d)", tt.ok, err, i)
+		}
+	}
+}
+
+func TestHealthProjectRules(t *testing.T) {
+	path, done := writeHealthRules(t)
+	defer done()
+	mc, mcli, f := fixture()
+	mc.Err = make([]error, 5)
+	mc.P = []string{"LM-X - Tier 1", "LM-X - Tier 2"}
+	mc.L = []pulse.BuildResult{{ID: 12}}
+	mc.H = []pulse.BuildResult{{ID: 12, Complete: true, Success: true, End: time.Now().Add(-48 * time.Hour)}}
+	mc.M = pulse.Messages{{Severity: pulse.SeverityWarning, Message: "deprecated option"}}
+	f.Project, f.Rules = "LM-X", path
+	out, err := mcli.Health()
+	mc.Check(t)
+	if len(out) != 0 {
+		t.Errorf("expected out to be empty, was %v instead", out)
+	}
+	if len(err) != 1 {
+		t.Fatalf("expected len(err) to be 1, was %d instead", len(err))
+	}
+	s := fmt.Sprint(err...)
+	for _, exp := range []string{"LM-X - Tier 1 (build 12)", "no successful build of LM-X - Tier 1 within 24h"} {
+		if !strings.Contains(s, exp) {
+			t.Errorf("expected err to contain %q, was %q instead", exp, s)
+		}
+	}
+	for _, notexp := range []string{"Tier 2", "deprecated option"} {
+		if strings.Contains(s, notexp) {
+			t.Errorf("expected err to not contain %q, was %q instead", notexp, s)
+		}
+	}
+}
+
+func TestHealthStuck(t *testing.T) {
+	path, done := writeHealthRules(t)
+	defer done()
+	mc, mcli, f := fixture()
+	mc.Err = make([]error, 5)
+	mc.P = []string{"LM-X - Tier 1"}
+	mc.A = pulse.Agents{
+		{Name: "Windows XP", Status: pulse.AgentSync},
+		{Name: "Linux", Status: pulse.AgentSync},
+		{Name: "Linux x64", Status: pulse.AgentIdle},
+	}
+	start := time.Now().Add(-4 * time.Hour)
+	mc.H = []pulse.BuildResult{{
+		ID:     14,
+		Start:  start,
+		Stages: []pulse.StageResult{{Name: "Build - Windows", Agent: pulse.AgentPending}},
+	}}
+	for i := int64(1); i <= 3; i++ {
+		mc.H = append(mc.H, pulse.BuildResult{ID: 14 - i, Complete: true, Start: start.Add(-24 * time.Hour),
+			End: start.Add(-23 * time.Hour)})
+	}
+	f.Rules, f.Stuck = path, true
+	out, err := mcli.Health()
+	mc.Check(t)
+	if len(out) != 0 {
+		t.Errorf("expected out to be empty, was %v instead", out)
+	}
+	if len(err) != 3 {
+		t.Fatalf("expected len(err) to be 3, was %d instead: %v", len(err), err)
+	}
+	expected := []string{
+		`pulsecli: build 14 of "LM-X - Tier 1" runs for 4h0m0s, while its median is 1h0m0s`,
+		`pulsecli: stage "Build - Windows" of build 14 of "LM-X - Tier 1" waits for an agent for 4h0m0s`,
+		`pulsecli: agent "Linux" is synchronizing without progress since `,
+	}
+	for i, exp := range expected {
+		if s := fmt.Sprint(err[i]); !strings.HasPrefix(s, exp) {
+			t.Errorf("expected %q, was %q instead (i=%d)", exp, s, i)
+		}
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pulsekit")
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	defer os.RemoveAll(dir)
+	cases := []struct {
+		flags map[string]string
+		sinks []string
+		err   bool
+	}{{
+		nil,
+		[]string{"*watch.Log"},
+		false,
+	}, {
+		map[string]string{"exec": "notify-send $PULSE_TEXT", "webhook": "http://chat/hook"},
+		[]string{"watch.Command", "watch.Webhook"},
+		false,
+	}, {
+		map[string]string{"smtp": "smtp:25", "mail-from": "pulse@example.com", "mail-to": "a@example.com, b@example.com",
+			"log": filepath.Join(dir, "events.jsonl")},
+		[]string{"watch.Mail", "*watch.Log"},
+		false,
+	}, {
+		map[string]string{"smtp": "smtp:25", "mail-from": "pulse@example.com"},
+		nil,
+		true,
+	}, {
+		map[string]string{"interval": "often"},
+		nil,
+		true,
+	}}
+	for i, cas := range cases {
+		mc, mcli, _ := fixture()
+		mcli.cli.c = mc
+		l := flag.NewFlagSet("watch pulsecli test", flag.PanicOnError)
+		l.String("interval", "1m", "")
+		l.String("state", filepath.Join(dir, "watch.yml"), "")
+		for _, name := range []string{"exec", "webhook", "smtp", "smtp-user", "mail-from", "mail-to", "log"} {
+			l.String(name, "", "")
+		}
+		for k, v := range cas.flags {
+			l.Set(k, v)
+		}
+		w, err := mcli.cli.watcher(cli.NewContext(mcli.cli.app, l, l))
+		if cas.err {
+			if err == nil {
+				t.Errorf("expected err to be non-nil (i=%d)", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expected err to be nil, was %q instead (i=%d)", err, i)
+			continue
+		}
+		var sinks []string
+		for _, s := range w.Sinks {
+			sinks = append(sinks, fmt.Sprintf("%T", s))
+		}
+		if !reflect.DeepEqual(sinks, cas.sinks) {
+			t.Errorf("expected sinks to be %v, was %v instead (i=%d)", cas.sinks, sinks, i)
+		}
+	}
+}
+
+func TestWatchState(t *testing.T) {
+	_, mcli, _ := fixture()
+	paths := make(map[string]bool)
+	for _, p := range []struct{ name, url string }{
+		{"default", "http://pulse"},
+		{"staging", "http://pulse"},
+		{"default", "http://pulse:8080"},
+	} {
+		mcli.cli.name, mcli.cli.cred = p.name, &Creds{URL: p.url}
+		path, err := mcli.cli.watchState()
+		if err != nil {
+			t.Fatalf("expected err to be nil, was %q instead", err)
+		}
+		if filepath.Base(filepath.Dir(path)) != "watch" {
+			t.Errorf("expected %s to be within the watch directory", path)
+		}
+		paths[path] = true
+	}
+	if len(paths) != 3 {
+		t.Errorf("expected a separate state for every profile and server, was %v instead", paths)
+	}
+}
+
+func TestReport(t *testing.T) {
+	start := time.Now().Add(-24 * time.Hour)
+	cases := []struct {
+		format string
+		exp    string
+	}{
+		{"csv", "project,Pulse CLI,,,,2,1,0.5000,90,120,,,,"},
+		{"json", `"project": "Pulse CLI"`},
+	}
+	for i, cas := range cases {
+		mc, mcli, f := fixture()
+		mc.Err = make([]error, 2)
+		mc.P = []string{"Pulse CLI"}
+		mc.H = []pulse.BuildResult{
+			{ID: 2, Complete: true, Start: start, End: start.Add(2 * time.Minute)},
+			{ID: 1, Complete: true, Success: true, Start: start, End: start.Add(time.Minute)},
+		}
+		f.Format = cas.format
+		out, err := mcli.Report()
+		mc.Check(t)
+		if len(err) != 0 {
+			t.Errorf("expected err to be empty, was %v instead (i=%d)", err, i)
+		}
+		if len(out) != 1 || !strings.Contains(fmt.Sprint(out[0]), cas.exp) {
+			t.Errorf("expected output to contain %q, was %v instead (i=%d)", cas.exp, out, i)
+		}
+	}
+}
+
+func TestReportErr(t *testing.T) {
+	for i, flags := range [][2]string{{"week", "text"}, {"7d", "pdf"}} {
+		_, mcli, f := fixture()
+		f.Since, f.Format = flags[0], flags[1]
+		out, err := mcli.Report()
+		if len(out) != 0 {
+			t.Errorf("expected out to be empty, was %v instead (i=%d)", out, i)
+		}
+		if len(err) != 1 {
+			t.Errorf("expected an error, was %v instead (i=%d)", err, i)
+		}
+	}
+}
+
+func TestFlaky(t *testing.T) {
+	mc, mcli, f := fixture()
+	mc.Err = []error{nil, nil, errInvalidBuild}
+	mc.P = []string{"Pulse CLI", "Pulse CLI - Docs"}
+	stage := func(id int64, success bool) pulse.BuildResult {
+		return pulse.BuildResult{ID: id, Complete: true, Revision: "5f3e2a1", Stages: []pulse.StageResult{
+			{Name: "Test", Complete: true, Success: success},
+		}}
+	}
+	mc.H = []pulse.BuildResult{stage(3, true), stage(2, false), stage(1, true)}
+	f.Project, f.Last = "^Pulse CLI", 3
+	out, err := mcli.Flaky()
+	mc.Check(t)
+	if len(err) != 0 {
+		t.Fatalf("expected err to be empty, was %v instead", err)
+	}
+	if len(out) != 1 {
+		t.Fatalf("expected len(out) to be 1, was %d instead", len(out))
+	}
+	var flaky []report.Flaky
+	if e := json.Unmarshal([]byte(out[0].(string)), &flaky); e != nil {
+		t.Fatalf("expected err to be nil, was %q instead", e)
+	}
+	if len(flaky) != 1 || flaky[0].Project != "Pulse CLI" || flaky[0].Stage != "Test" || flaky[0].Flips != 2 {
+		t.Errorf("expected Test stage of Pulse CLI to be flaky, was %+v instead", flaky)
+	}
+}
+
 func TestProjects(t *testing.T) {
 	mc, mcli, _ := fixture()
 	mc.Err, mc.P = make([]error, 1), []string{"Pulse CLI"}
@@ -674,3 +1883,128 @@ func TestStatusEmpty(t *testing.T) {
 func TestArtifact(t *testing.T) {
 	t.Skip("TODO(ppieprzyk)")
 }
+
+func TestUploadErr_MissingName(t *testing.T) {
+	mc, mcli, f := fixture()
+	f.Project = "Pulse CLI"
+	out, err := mcli.Upload()
+	expected := "pulsecli: an artifact --name is missing"
+	mc.Check(t)
+	if out != nil && len(out) != 0 {
+		t.Error("expected out to be empty")
+	}
+	if err == nil || len(err) != 1 {
+		t.Fatalf("expected err!=nil, len(err)=1; was err=%v, len(err)=%d",
+			err, len(err))
+	}
+	if s, ok := err[0].(string); !ok || s != expected {
+		t.Errorf("expected %s, got %v", expected, err[0])
+	}
+}
+
+// uploadClient sends uploads to a test server instead of the mock.
+type uploadClient struct {
+	*mock.Client
+	url string
+}
+
+func (c uploadClient) Upload(id int64, project, name, url string, files []string) error {
+	if err := c.Client.Upload(id, project, name, url, files); err != nil {
+		return err
+	}
+	return pulse.NewArtifactUploader(c.url, "token").Upload(project, id, name, files)
+}
+
+func TestUpload(t *testing.T) {
+	up := make(map[string]string)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil || r.Method != "PUT" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		up[r.RequestURI] = string(b)
+	}))
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "pulsekit")
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	defer os.RemoveAll(dir)
+	var files []string
+	for _, name := range []string{"qa.log", "screenshot.png"} {
+		files = append(files, filepath.Join(dir, name))
+		if err = ioutil.WriteFile(files[len(files)-1], []byte(name), 0644); err != nil {
+			t.Fatalf("expected err to be nil, was %q instead", err)
+		}
+	}
+	mc := mock.NewClient()
+	mcli := NewMockCLI(uploadClient{mc, srv.URL})
+	mcli.f.Project, mcli.f.Build = "Pulse CLI", 130
+	mcli.f.Args = append([]string{"--name", "qa-logs"}, files...)
+	mc.Err = make([]error, 2)
+	out, e := mcli.Upload()
+	mc.Check(t)
+	if len(e) != 0 {
+		t.Fatalf("expected err to be empty, was %v instead", e)
+	}
+	if !reflect.DeepEqual(out, []interface{}{files[0], files[1]}) {
+		t.Errorf("expected out to be %v, was %v instead", files, out)
+	}
+	expected := map[string]string{
+		"/browse/projects/Pulse%20CLI/builds/130/artifacts/qa-logs/qa.log":         "qa.log",
+		"/browse/projects/Pulse%20CLI/builds/130/artifacts/qa-logs/screenshot.png": "screenshot.png",
+	}
+	if !reflect.DeepEqual(up, expected) {
+		t.Errorf("expected up to be %v, was %v instead", expected, up)
+	}
+	mcli.f.Args = []string{"--name", "qa-logs", filepath.Join(dir, "missing.log")}
+	if _, e = mcli.Upload(); len(e) != 1 {
+		t.Errorf("expected missing file to be reported, was %v instead", e)
+	}
+}
+
+func TestCleanupApply(t *testing.T) {
+	mc, mcli, f := fixture()
+	f.Project = "^Go"
+	mc.Err, mc.P = make([]error, 7), []string{"Go - Master", "Go - Devel", "C++"}
+	mc.PC = []pulse.ProjectCleanup{{Name: "default"}, {Name: "60 days"}}
+	out, err := mcli.CleanupApply()
+	mc.Check(t)
+	if n := len(err); n != 0 {
+		t.Fatalf("want len(err)=0; got %d", n)
+	}
+	expected := []interface{}{
+		`default	"Go - Master"`,
+		`60 days	"Go - Master"`,
+		`default	"Go - Devel"`,
+		`60 days	"Go - Devel"`,
+	}
+	if !reflect.DeepEqual(out, expected) {
+		t.Fatalf("want out=%v; got %v", expected, out)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	var (
+		buf bytes.Buffer
+		now = time.Unix(0, 0)
+	)
+	p := &progress{w: &buf, d: time.Second, now: func() time.Time { return now }}
+	events := []pulse.Progress{
+		{N: 512, Size: 2048, Total: 512, TotalSize: 4096, TotalFiles: 2},
+		{N: 1024, Size: 2048, Total: 1024, TotalSize: 4096, TotalFiles: 2},
+		{N: 2048, Size: 2048, Total: 2048, TotalSize: 4096, TotalFiles: 2},
+		{N: 2048, Size: 2048, Total: 4096, TotalSize: 4096, Files: 2, TotalFiles: 2},
+	}
+	for i := range events {
+		p.Report(events[i])
+		now = now.Add(600 * time.Millisecond)
+	}
+	expected := "downloaded 512 B/4.0 KiB (0/2 files)\n" +
+		"downloaded 2.0 KiB/4.0 KiB (0/2 files)\n" +
+		"downloaded 4.0 KiB/4.0 KiB (2/2 files)\n"
+	if s := buf.String(); s != expected {
+		t.Errorf("expected %q, got %q", expected, s)
+	}
+}
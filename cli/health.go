@@ -0,0 +1,337 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/x-formation/pulsekit"
+	"github.com/x-formation/pulsekit/report"
+	"github.com/x-formation/pulsekit/util"
+
+	"gopkg.in/v1/yaml"
+)
+
+// HealthRules describes thresholds of health checks. Rules are read from
+// a YAML file, e.g.:
+//
+//	agents:
+//	  ignore: ["^Windows XP"]
+//	  max_offline: 1
+//	  max_offline_percent: 10
+//	  max_sync_percent: 49
+//	  warn_offline: 0
+//	  warn_sync_percent: 25
+//	projects:
+//	- match: "^LM-X - Tier"
+//	  max_age: 48h
+//	  tolerate: ["deprecated"]
+//	stuck:
+//	  factor: 3
+//	  history: 10
+//	  max_pending: 30m
+//	  samples: 3
+//	  interval: 30s
+//
+// Thresholds, which are not set, are not checked. Thresholds of the Nagios
+// metrics and the PRTG sensor channels are derived from the rules as well.
+type HealthRules struct {
+	Agents   AgentRules    `yaml:"agents"`
+	Projects []ProjectRule `yaml:"projects"`
+	Stuck    StuckRules    `yaml:"stuck"`
+}
+
+// AgentRules describes thresholds of the Pulse server health check.
+type AgentRules struct {
+	// Ignore are name patterns of agents, which are not checked.
+	Ignore []string `yaml:"ignore"`
+	// MaxOffline is a maximum number of offline agents.
+	MaxOffline *int `yaml:"max_offline"`
+	// MaxOfflinePercent is a maximum percentage of offline agents.
+	MaxOfflinePercent *int `yaml:"max_offline_percent"`
+	// MaxSyncPercent is a maximum percentage of synchronizing agents.
+	MaxSyncPercent *int `yaml:"max_sync_percent"`
+	// WarnOffline is a number of offline agents, above which the Nagios
+	// and PRTG checks warn.
+	WarnOffline *int `yaml:"warn_offline"`
+	// WarnSyncPercent is a percentage of synchronizing agents, above which
+	// the Nagios and PRTG checks warn.
+	WarnSyncPercent *int `yaml:"warn_sync_percent"`
+
+	ignore []*regexp.Regexp
+}
+
+// ProjectRule describes thresholds of the project health check.
+type ProjectRule struct {
+	// Match is a name pattern of projects the rule applies to. The first rule
+	// matching a project applies to it.
+	Match string `yaml:"match"`
+	// MaxAge is a maximum age of the last successful build, e.g. "48h".
+	MaxAge string `yaml:"max_age"`
+	// Tolerate are patterns of warning messages, which do not fail the check.
+	Tolerate []string `yaml:"tolerate"`
+
+	match    *regexp.Regexp
+	maxAge   time.Duration
+	tolerate []*regexp.Regexp
+}
+
+// StuckRules describes thresholds of the stuck builds and hung agents
+// detection, see util.Detector for details. Agents are hung when they make
+// no progress across all the samples.
+type StuckRules struct {
+	// Factor is a multiple of the median duration of previous builds, after
+	// which a build in progress is stuck, 3 by default.
+	Factor float64 `yaml:"factor"`
+	// History is a number of builds the median is computed of, 10 by default.
+	History int `yaml:"history"`
+	// MaxPending is a maximum time a stage may wait for an agent, "30m"
+	// by default.
+	MaxPending string `yaml:"max_pending"`
+	// Samples is a number of samples taken, 3 by default.
+	Samples int `yaml:"samples"`
+	// Interval is a time between two samples, "30s" by default.
+	Interval string `yaml:"interval"`
+
+	maxPending time.Duration
+	interval   time.Duration
+}
+
+// DefaultHealthRules gives rules of the health checks used when no rules file
+// is given. The checks fail when any agent is offline, at least half of them
+// are synchronizing or latest build of a project has a warning or an error.
+func DefaultHealthRules() *HealthRules {
+	zero, half := 0, 49
+	r := &HealthRules{
+		Agents:   AgentRules{MaxOffline: &zero, MaxSyncPercent: &half},
+		Projects: []ProjectRule{{Match: ".*"}},
+	}
+	if err := r.compile(); err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// ReadHealthRules reads rules of the health checks from a YAML file.
+func ReadHealthRules(path string) (*HealthRules, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &HealthRules{}
+	if err = yaml.Unmarshal(b, r); err != nil {
+		return nil, fmt.Errorf("pulsecli: invalid health rules %s: %v", path, err)
+	}
+	if err = r.compile(); err != nil {
+		return nil, fmt.Errorf("pulsecli: invalid health rules %s: %v", path, err)
+	}
+	return r, nil
+}
+
+// healthRules gives rules of the health checks read from the given file,
+// from ~/.pulsecli.d/health.yml if it exists when no file is given, or
+// the default ones otherwise.
+func healthRules(path string) (*HealthRules, error) {
+	if path == "" {
+		var err error
+		if path, err = configDir("health.yml"); err != nil {
+			return nil, err
+		}
+		if !exists(path) {
+			return DefaultHealthRules(), nil
+		}
+	}
+	return ReadHealthRules(path)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func (r *HealthRules) compile() (err error) {
+	if err = r.Stuck.compile(); err != nil {
+		return
+	}
+	if r.Agents.ignore, err = compile(r.Agents.Ignore); err != nil {
+		return
+	}
+	for i := range r.Projects {
+		p := &r.Projects[i]
+		if p.match, err = regexp.Compile(p.Match); err != nil {
+			return
+		}
+		if p.tolerate, err = compile(p.Tolerate); err != nil {
+			return
+		}
+		if p.MaxAge != "" {
+			if p.maxAge, err = time.ParseDuration(p.MaxAge); err != nil {
+				return
+			}
+		}
+	}
+	return nil
+}
+
+func (r *StuckRules) compile() (err error) {
+	if r.Factor == 0 {
+		r.Factor = 3
+	}
+	if r.History == 0 {
+		r.History = 10
+	}
+	if r.Samples == 0 {
+		r.Samples = 3
+	}
+	if r.MaxPending == "" {
+		r.MaxPending = "30m"
+	}
+	if r.Interval == "" {
+		r.Interval = "30s"
+	}
+	if r.Factor < 0 || r.History < 0 || r.Samples < 0 {
+		return fmt.Errorf("stuck thresholds must not be negative")
+	}
+	if r.maxPending, err = time.ParseDuration(r.MaxPending); err != nil {
+		return
+	}
+	r.interval, err = time.ParseDuration(r.Interval)
+	return
+}
+
+// Detector gives a detector configured with the rules.
+func (r *StuckRules) Detector(c pulse.Client) *util.Detector {
+	d := util.NewDetector(c)
+	d.Factor, d.History, d.MaxPending = r.Factor, r.History, r.maxPending
+	d.Hang = time.Duration(r.Samples-1) * r.interval
+	return d
+}
+
+func compile(patterns []string) ([]*regexp.Regexp, error) {
+	re := make([]*regexp.Regexp, 0, len(patterns))
+	for _, s := range patterns {
+		r, err := regexp.Compile(s)
+		if err != nil {
+			return nil, err
+		}
+		re = append(re, r)
+	}
+	return re, nil
+}
+
+func matchAny(re []*regexp.Regexp, s string) bool {
+	for _, re := range re {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter gives agents, which are not ignored by the rules.
+func (r *AgentRules) Filter(a pulse.Agents) pulse.Agents {
+	if len(r.ignore) == 0 {
+		return a
+	}
+	return a.FilterOut(func(a *pulse.Agent) bool { return matchAny(r.ignore, a.Name) })
+}
+
+// Check checks the agents against the rules. It returns messages describing
+// violated rules, nil if there are none.
+func (r *AgentRules) Check(a pulse.Agents) []interface{} {
+	a = r.Filter(a)
+	sync, offline := a.Filter(pulse.Sync), a.Filter(pulse.Offline)
+	if r.MaxSyncPercent != nil && percent(len(sync), len(a)) > *r.MaxSyncPercent {
+		return []interface{}{fmt.Sprintf("pulsecli: >=%d%% of Pulse agents are hanging now!",
+			*r.MaxSyncPercent+1)}
+	}
+	if (r.MaxOffline != nil && len(offline) > *r.MaxOffline) ||
+		(r.MaxOfflinePercent != nil && percent(len(offline), len(a)) > *r.MaxOfflinePercent) {
+		msg := make([]interface{}, 0, len(offline))
+		for i := range offline {
+			msg = append(msg, offline[i])
+		}
+		return msg
+	}
+	return nil
+}
+
+func percent(n, total int) int {
+	if total == 0 {
+		return 0
+	}
+	return 100 * n / total
+}
+
+// maxCount gives the maximum number of agents out of total, which does not
+// exceed the given number nor the given percentage. It gives nil if neither
+// of them is set.
+func maxCount(max, maxPercent *int, total int) *int {
+	if maxPercent != nil && total != 0 {
+		// The largest n for which percent(n, total) <= *maxPercent.
+		n := ((*maxPercent+1)*total - 1) / 100
+		if max == nil || n < *max {
+			max = &n
+		}
+	}
+	return max
+}
+
+// OfflineLimits gives warning and critical thresholds of the number of offline
+// agents out of total, nil when a threshold is not set.
+func (r *AgentRules) OfflineLimits(total int) (warning, critical *int) {
+	return r.WarnOffline, maxCount(r.MaxOffline, r.MaxOfflinePercent, total)
+}
+
+// SyncLimits gives warning and critical thresholds of the number of
+// synchronizing agents out of total, nil when a threshold is not set.
+func (r *AgentRules) SyncLimits(total int) (warning, critical *int) {
+	return maxCount(nil, r.WarnSyncPercent, total), maxCount(nil, r.MaxSyncPercent, total)
+}
+
+// Project gives a rule for the given project, nil if no rule matches it.
+func (r *HealthRules) Project(name string) *ProjectRule {
+	for i := range r.Projects {
+		if r.Projects[i].match.MatchString(name) {
+			return &r.Projects[i]
+		}
+	}
+	return nil
+}
+
+// Filter gives error messages and warning messages, which are not tolerated
+// by the rule.
+func (r *ProjectRule) Filter(m pulse.Messages) pulse.Messages {
+	m = m.FilterOut(pulse.Info)
+	if len(r.tolerate) == 0 || len(m) == 0 {
+		return m
+	}
+	return m.FilterOut(func(m *pulse.Message) bool {
+		return m.Severity == pulse.SeverityWarning && matchAny(r.tolerate, m.Message)
+	})
+}
+
+// CheckAge checks whether the last successful build of the project is not
+// older than the rule allows, going back from the build with the given ID.
+// Builds in progress are skipped.
+func (r *ProjectRule) CheckAge(c pulse.Client, project string, id int64) error {
+	if r.maxAge == 0 {
+		return nil
+	}
+	since := time.Now().Add(-r.maxAge)
+	b, err := report.History(c, project, since)
+	if err != nil {
+		return err
+	}
+	for i := range b {
+		if b[i].ID > id || !b[i].Complete || b[i].End.Before(since) {
+			continue
+		}
+		if b[i].Success {
+			return nil
+		}
+	}
+	return fmt.Errorf("pulsecli: no successful build of %s within %s", project, r.MaxAge)
+}
@@ -0,0 +1,127 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/x-formation/pulsekit"
+)
+
+// isTerminal reports whether the file is a character device, which is good
+// enough to tell a terminal from a pipe or a regular file.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// progress renders a progress of artifact downloads. When the output is
+// a terminal it draws a progress bar, otherwise it prints a plain summary
+// periodically.
+type progress struct {
+	w    io.Writer
+	tty  bool
+	d    time.Duration
+	now  func() time.Time
+	last time.Time
+}
+
+func newProgress(f *os.File) *progress {
+	p := &progress{w: f, tty: isTerminal(f), now: time.Now}
+	if p.tty {
+		p.d = 100 * time.Millisecond
+	} else {
+		p.d = 5 * time.Second
+	}
+	return p
+}
+
+// Report implements pulse.ProgressFunc.
+func (p *progress) Report(pr pulse.Progress) {
+	done := pr.Files+pr.Failed == pr.TotalFiles
+	if now := p.now(); done || now.Sub(p.last) >= p.d {
+		p.last = now
+	} else {
+		return
+	}
+	if p.tty {
+		fmt.Fprintf(p.w, "\r%s %s\x1b[K", bar(pr), filepath.Base(pr.File))
+		if done {
+			fmt.Fprintln(p.w)
+		}
+		return
+	}
+	if pr.Failed != 0 {
+		fmt.Fprintf(p.w, "downloaded %s (%d/%d files, %d failed)\n", summary(pr), pr.Files,
+			pr.TotalFiles, pr.Failed)
+		return
+	}
+	fmt.Fprintf(p.w, "downloaded %s (%d/%d files)\n", summary(pr), pr.Files, pr.TotalFiles)
+}
+
+const barWidth = 30
+
+// bar gives a progress bar of all files, or of the current one when
+// the total size is unknown.
+func bar(pr pulse.Progress) string {
+	n, size := pr.Total, pr.TotalSize
+	if size < 0 {
+		n, size = pr.N, pr.Size
+	}
+	var pct int64
+	if size > 0 {
+		pct = 100 * n / size
+	}
+	fill := int(pct) * barWidth / 100
+	b := strings.Repeat("=", fill) + strings.Repeat(" ", barWidth-fill)
+	if fill > 0 && fill < barWidth {
+		b = b[:fill-1] + ">" + b[fill:]
+	}
+	return fmt.Sprintf("[%s] %3d%% %s %d/%d", b, pct, summary(pr), pr.Files, pr.TotalFiles)
+}
+
+func summary(pr pulse.Progress) string {
+	if pr.TotalSize < 0 {
+		return bytesize(pr.Total)
+	}
+	return bytesize(pr.Total) + "/" + bytesize(pr.TotalSize)
+}
+
+// bytesize formats n as a human-readable size.
+func bytesize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// stageProgress prints changes of stages of builds, one per line.
+type stageProgress struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+// Report gives a function, which prints a stage name, its state and the agent
+// it runs on, followed by a progress when the stage is not complete yet.
+// Every line starts with the given prefix.
+func (p *stageProgress) Report(prefix string) func(pulse.StageResult) {
+	return func(s pulse.StageResult) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if s.Complete || s.Progress < 0 || s.Agent == pulse.AgentPending {
+			fmt.Fprintf(p.w, "%s%q\t%s\t%q\n", prefix, s.Name, s.State, s.Agent)
+			return
+		}
+		fmt.Fprintf(p.w, "%s%q\t%s\t%q\t%d%%\n", prefix, s.Name, s.State, s.Agent, s.Progress)
+	}
+}
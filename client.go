@@ -3,7 +3,9 @@ package pulse
 import (
 	"errors"
 	"fmt"
+	"regexp"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/kolo/xmlrpc"
@@ -19,15 +21,33 @@ type Client interface {
 	// BuildID gives a build ID associated with given request ID. If a build
 	// is queued and not started yet it waits up to 15 seconds before timing out.
 	BuildID(reqid string) (int64, error)
+	// BuildQueue gives every build request waiting in the build queue.
+	BuildQueue() ([]QueuedBuild, error)
 	// BuildResults gives full statistics and information for a build with given
 	// ID and project name.
 	BuildResult(project string, id int64) ([]BuildResult, error)
+	// BuildHistory gives statistics for up to n latest builds of a given
+	// project, including the ones which are still in progress.
+	BuildHistory(project string, n int) ([]BuildResult, error)
+	// Cancel requests a build in progress with given ID and project name
+	// to be cancelled.
+	Cancel(project string, id int64) error
 	// Clear clears a working directories on agents for a given project name.
 	Clear(project string) error
+	// Cleanup runs a cleanup rule with a given name for a given project,
+	// removing the build data the rule matches.
+	Cleanup(project, name string) error
 	// Close terminates the user session.
 	Close() error
+	// ConfigCleanup gives every cleanup rule configured for a given project.
+	ConfigCleanup(project string) ([]ProjectCleanup, error)
 	// ConfigStage TODO(rjeczalik): document
 	ConfigStage(project, stage string) (ProjectStage, error)
+	// ConfigStages gives configuration of every stage of a given project.
+	ConfigStages(project string) ([]ProjectStage, error)
+	// DeleteConfigCleanup removes a cleanup rule with a given name from
+	// a given project's configuration.
+	DeleteConfigCleanup(project, name string) error
 	// Init (re-)initializes the project with a given name. It stops the SCM polling,
 	// clears Pulse server's local clone of a repository, configured for
 	// a given project, and checks it out again.
@@ -38,24 +58,50 @@ type Client interface {
 	// Messages returns all info, warning and error messages for a particular
 	// build of a given project.
 	Messages(project string, id int64) (Messages, error)
+	// PreparePersonalBuild checks whether the user holding the session may
+	// request a personal build of a given project, giving details of its SCM.
+	PreparePersonalBuild(project string) (PersonalDetails, error)
 	// Projects gives every project name that the user holding the session
 	// has an access to.
 	Projects() ([]string, error)
 	// Stages gives every stage name for a given project.
 	Stages(project string) ([]string, error)
+	// Token gives a token of the user session, which can be passed to
+	// NewClientToken in order to reuse the session.
+	Token() string
+	// SetLogin sets a function, which creates a new user session when a call
+	// is rejected because the session is no longer valid. The call is retried
+	// once with a token of the new session. A nil function disables it.
+	SetLogin(fn LoginFunc)
 	// SetTimeout TODO(rjeczalik): document
 	SetTimeout(d time.Duration)
 	// SetConfigStage TODO(rjeczalik): document
 	SetConfigStage(project string, s ProjectStage) error
+	// SetConfigCleanup adds a cleanup rule to a given project's configuration
+	// or updates the rule if one with the same name already exists.
+	SetConfigCleanup(project string, cl ProjectCleanup) error
+	// SetCache sets a local cache, which is consulted by the Artifact method
+	// before downloading a file. A nil cache disables the caching.
+	SetCache(ac *ArtifactCache)
+	// SetProgress sets a callback, which is used to report a progress of
+	// downloads started by the Artifact method. A nil callback disables
+	// the reporting.
+	SetProgress(fn ProgressFunc)
 	// Trigger triggers a build for a given project returning request IDs
 	// of builds caused by that trigger.
 	Trigger(project string) ([]string, error)
 	// Artifact downloads artifacts for given project and build number
 	Artifact(id int64, project, dir, url string) error
+	// Upload uploads local files as an artifact with a given name for given
+	// project and build number.
+	Upload(id int64, project, name, url string, files []string) error
 }
 
 var ErrTimeout = errors.New("pulse: request has timed out")
 
+// LoginFunc creates a new user session, giving its token.
+type LoginFunc func() (tok string, err error)
+
 // InvalidBuildError TODO(rjeczalik): document
 type InvalidBuildError struct {
 	ID     int64
@@ -69,9 +115,13 @@ func (e InvalidBuildError) Error() string {
 }
 
 type client struct {
-	rpc *xmlrpc.Client
-	tok string
-	d   time.Duration
+	rpc   *xmlrpc.Client
+	mu    sync.Mutex // protects tok and login
+	tok   string
+	login LoginFunc
+	d     time.Duration
+	prog  ProgressFunc
+	ac    *ArtifactCache
 }
 
 // NewClient authenticates with Pulse server for a user session, creating
@@ -87,46 +137,170 @@ func NewClient(url, user, pass string) (Client, error) {
 	return c, nil
 }
 
+// NewClientToken creates a RPC client for a user session of the given token,
+// which was obtained from a client created by NewClient. The token is not
+// validated up front, as the Remote API has no call for it - a session, which
+// is no longer valid, e.g. because it expired, is renewed by the first call
+// rejecting it with a LoginFunc set by SetLogin.
+func NewClientToken(url, tok string) (Client, error) {
+	c, err := &client{d: 15 * time.Second, tok: tok}, (error)(nil)
+	if c.rpc, err = xmlrpc.NewClient(url+"/xmlrpc", nil); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *client) Token() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tok
+}
+
+func (c *client) SetLogin(fn LoginFunc) {
+	c.mu.Lock()
+	c.login = fn
+	c.mu.Unlock()
+}
+
+// reAuth matches faults of calls made with a token, which was rejected.
+var reAuth = regexp.MustCompile(`AuthenticationException|[Ii]nvalid token|[Ss]ession.*expired`)
+
+func authFault(err error) bool {
+	return reAuth.MatchString(err.Error())
+}
+
+// call calls the Remote API method with the session token followed by args.
+// When the token is rejected, it logs in again with the LoginFunc set by
+// SetLogin, if any, and retries the call once with a token of the new session.
+func (c *client) call(method string, reply interface{}, args ...interface{}) error {
+	tok := c.Token()
+	err := c.rpc.Call(method, append([]interface{}{tok}, args...), reply)
+	if err == nil || !authFault(err) {
+		return err
+	}
+	if tok, err = c.relogin(tok, err); err != nil {
+		return err
+	}
+	return c.rpc.Call(method, append([]interface{}{tok}, args...), reply)
+}
+
+// relogin gives a token, which replaces the rejected one. Calls rejected
+// concurrently log in only once.
+func (c *client) relogin(rejected string, err error) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tok != rejected {
+		return c.tok, nil
+	}
+	if c.login == nil {
+		return "", err
+	}
+	tok, err := c.login()
+	if err != nil {
+		return "", err
+	}
+	c.tok = tok
+	return tok, nil
+}
+
 func (c *client) SetTimeout(d time.Duration) { c.d = d }
 
+func (c *client) SetProgress(fn ProgressFunc) { c.prog = fn }
+
+func (c *client) SetCache(ac *ArtifactCache) { c.ac = ac }
+
 func (c *client) Init(project string) (ok bool, err error) {
-	err = c.rpc.Call("RemoteApi.initialiseProject", []interface{}{c.tok, project}, &ok)
+	err = c.call("RemoteApi.initialiseProject", &ok, project)
 	return
 }
 
 func (c *client) Messages(project string, id int64) (Messages, error) {
-	var (
-		m, warn, info Messages
-		req           = []interface{}{c.tok, project, int(id)}
-	)
-	if err := c.rpc.Call("RemoteApi.getErrorMessagesInBuild", req, &m); err != nil {
+	var m, warn, info Messages
+	if err := c.call("RemoteApi.getErrorMessagesInBuild", &m, project, int(id)); err != nil {
 		return nil, err
 	}
-	if err := c.rpc.Call("RemoteApi.getWarningMessagesInBuild", req, &warn); err != nil {
+	if err := c.call("RemoteApi.getWarningMessagesInBuild", &warn, project, int(id)); err != nil {
 		return nil, err
 	}
-	if err := c.rpc.Call("RemoteApi.getInfoMessagesInBuild", req, &info); err != nil {
+	if err := c.call("RemoteApi.getInfoMessagesInBuild", &info, project, int(id)); err != nil {
 		return nil, err
 	}
 	return append(append(m, warn...), info...), nil
 }
 
 func (c *client) ConfigStage(project, stage string) (s ProjectStage, err error) {
-	req := []interface{}{c.tok, fmt.Sprintf("projects/%s/stages/%s", project, stage)}
-	err = c.rpc.Call("RemoteApi.getConfig", req, &s)
+	err = c.call("RemoteApi.getConfig", &s, fmt.Sprintf("projects/%s/stages/%s", project, stage))
 	return
 }
 
+func (c *client) ConfigStages(project string) ([]ProjectStage, error) {
+	path := fmt.Sprintf("projects/%s/stages", project)
+	names, err := c.configListing(path)
+	if err != nil {
+		return nil, err
+	}
+	s := make([]ProjectStage, len(names))
+	for i := range names {
+		if err = c.call("RemoteApi.getConfig", &s[i], path+"/"+names[i]); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
 func (c *client) SetConfigStage(project string, s ProjectStage) (err error) {
-	req := []interface{}{c.tok, fmt.Sprintf("projects/%s/stages/%s", project, s.Name), &s, false}
-	err = c.rpc.Call("RemoteApi.saveConfig", req, new(string))
+	err = c.call("RemoteApi.saveConfig", new(string), fmt.Sprintf("projects/%s/stages/%s", project, s.Name), &s, false)
+	return
+}
+
+func (c *client) configListing(path string) (s []string, err error) {
+	err = c.call("RemoteApi.getConfigListing", &s, path)
 	return
 }
 
+func (c *client) ConfigCleanup(project string) ([]ProjectCleanup, error) {
+	path := fmt.Sprintf("projects/%s/cleanup", project)
+	names, err := c.configListing(path)
+	if err != nil {
+		return nil, err
+	}
+	cl := make([]ProjectCleanup, len(names))
+	for i := range names {
+		if err = c.call("RemoteApi.getConfig", &cl[i], path+"/"+names[i]); err != nil {
+			return nil, err
+		}
+	}
+	return cl, nil
+}
+
+func (c *client) SetConfigCleanup(project string, cl ProjectCleanup) error {
+	if cl.Meta == "" {
+		cl.Meta = ProjectCleanupMeta
+	}
+	path := fmt.Sprintf("projects/%s/cleanup", project)
+	names, err := c.configListing(path)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name == cl.Name {
+			return c.call("RemoteApi.saveConfig", new(string), path+"/"+cl.Name, &cl, false)
+		}
+	}
+	return c.call("RemoteApi.insertConfig", new(string), path, &cl)
+}
+
+func (c *client) DeleteConfigCleanup(project, name string) error {
+	return c.call("RemoteApi.deleteConfig", new(bool), fmt.Sprintf("projects/%s/cleanup/%s", project, name))
+}
+
+func (c *client) Cleanup(project, name string) error {
+	return c.call("RemoteApi.doConfigAction", nil, fmt.Sprintf("projects/%s/cleanup/%s", project, name), "clean")
+}
+
 func (c *client) BuildID(reqid string) (int64, error) {
 	timeout, rep := int(c.d.Seconds())*1000, &BuildRequestStatus{}
-	err := c.rpc.Call("RemoteApi.waitForBuildRequestToBeActivated",
-		[]interface{}{c.tok, reqid, timeout}, &rep)
+	err := c.call("RemoteApi.waitForBuildRequestToBeActivated", &rep, reqid, timeout)
 	if err != nil {
 		return 0, err
 	}
@@ -139,11 +313,16 @@ func (c *client) BuildID(reqid string) (int64, error) {
 	return strconv.ParseInt(rep.ID, 10, 64)
 }
 
+func (c *client) BuildQueue() (q []QueuedBuild, err error) {
+	err = c.call("RemoteApi.getBuildQueueSnapshot", &q)
+	return
+}
+
 func (c *client) BuildResult(project string, id int64) (res []BuildResult, err error) {
 	if project == ProjectPersonal {
-		err = c.rpc.Call("RemoteApi.getPersonalBuild", []interface{}{c.tok, int(id)}, &res)
+		err = c.call("RemoteApi.getPersonalBuild", &res, int(id))
 	} else {
-		err = c.rpc.Call("RemoteApi.getBuild", []interface{}{c.tok, project, int(id)}, &res)
+		err = c.call("RemoteApi.getBuild", &res, project, int(id))
 	}
 	if err != nil {
 		return nil, err
@@ -154,6 +333,21 @@ func (c *client) BuildResult(project string, id int64) (res []BuildResult, err e
 	return res, nil
 }
 
+func (c *client) BuildHistory(project string, n int) (res []BuildResult, err error) {
+	if project == ProjectPersonal {
+		err = c.call("RemoteApi.getLatestPersonalBuilds", &res, false, n)
+	} else {
+		err = c.call("RemoteApi.getLatestBuildsForProject", &res, project, false, n)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, &InvalidBuildError{Status: BuildNeverBuilt}
+	}
+	return res, nil
+}
+
 func (c *client) Stages(project string) ([]string, error) {
 	// TODO(rjeczalik): It would be better to get stages list from project's configuration.
 	//                  I ran away screaming while trying to get that information from
@@ -177,9 +371,9 @@ func (c *client) Stages(project string) ([]string, error) {
 
 func (c *client) LatestBuildResult(project string) (res []BuildResult, err error) {
 	if project == ProjectPersonal {
-		err = c.rpc.Call("RemoteApi.getLatestPersonalBuildForProject", []interface{}{c.tok, true}, &res)
+		err = c.call("RemoteApi.getLatestPersonalBuildForProject", &res, true)
 	} else {
-		err = c.rpc.Call("RemoteApi.getLatestBuildForProject", []interface{}{c.tok, project, true}, &res)
+		err = c.call("RemoteApi.getLatestBuildForProject", &res, project, true)
 	}
 	if err != nil {
 		return nil, err
@@ -190,15 +384,28 @@ func (c *client) LatestBuildResult(project string) (res []BuildResult, err error
 	return res, nil
 }
 
+// Close implements Client. A session, which was already rejected, is closed
+// without an error.
 func (c *client) Close() error {
-	if err := c.rpc.Call("RemoteApi.logout", c.tok, nil); err != nil {
+	if err := c.rpc.Call("RemoteApi.logout", c.Token(), nil); err != nil && !authFault(err) {
 		return err
 	}
 	return c.rpc.Close()
 }
 
+func (c *client) Cancel(project string, id int64) error {
+	var ok bool
+	if err := c.call("RemoteApi.cancelBuild", &ok, project, int(id)); err != nil {
+		return err
+	}
+	if !ok {
+		return &InvalidBuildError{ID: id, Status: BuildUnknown}
+	}
+	return nil
+}
+
 func (c *client) Clear(project string) error {
-	return c.rpc.Call("RemoteApi.doConfigAction", []interface{}{c.tok, "projects/" + project, "clean"}, nil)
+	return c.call("RemoteApi.doConfigAction", nil, "projects/"+project, "clean")
 }
 
 func (c *client) Trigger(project string) (id []string, err error) {
@@ -207,23 +414,28 @@ func (c *client) Trigger(project string) (id []string, err error) {
 	req := struct {
 		R bool `xmlrpc:"rebuild"`
 	}{true}
-	err = c.rpc.Call("RemoteApi.triggerBuild", []interface{}{c.tok, project, req}, &id)
+	err = c.call("RemoteApi.triggerBuild", &id, project, req)
+	return
+}
+
+func (c *client) PreparePersonalBuild(project string) (d PersonalDetails, err error) {
+	err = c.call("RemoteApi.preparePersonalBuild", &d, project)
 	return
 }
 
 func (c *client) Projects() (s []string, err error) {
-	err = c.rpc.Call("RemoteApi.getAllProjectNames", c.tok, &s)
+	err = c.call("RemoteApi.getAllProjectNames", &s)
 	return
 }
 
 func (c *client) Agents() (Agents, error) {
 	var names []string
-	if err := c.rpc.Call("RemoteApi.getAllAgentNames", c.tok, &names); err != nil {
+	if err := c.call("RemoteApi.getAllAgentNames", &names); err != nil {
 		return nil, err
 	}
 	a := make(Agents, len(names))
 	for i := range names {
-		if err := c.rpc.Call("RemoteApi.getAgentDetails", []interface{}{c.tok, names[i]}, &a[i]); err != nil {
+		if err := c.call("RemoteApi.getAgentDetails", &a[i], names[i]); err != nil {
 			return nil, err
 		}
 		a[i].Name = names[i]
@@ -235,9 +447,9 @@ func (c *client) Agents() (Agents, error) {
 func (c *client) Artifact(id int64, project, dir, url string) (err error) {
 	var art []BuildArtifact
 	if project == ProjectPersonal {
-		err = c.rpc.Call("RemoteApi.getArtifactsInPersonalBuild", []interface{}{c.tok, int(id)}, &art)
+		err = c.call("RemoteApi.getArtifactsInPersonalBuild", &art, int(id))
 	} else {
-		err = c.rpc.Call("RemoteApi.getArtifactsInBuild", []interface{}{c.tok, project, int(id)}, &art)
+		err = c.call("RemoteApi.getArtifactsInBuild", &art, project, int(id))
 	}
 	if err != nil {
 		return err
@@ -245,22 +457,22 @@ func (c *client) Artifact(id int64, project, dir, url string) (err error) {
 
 	for i := range art {
 		if project == ProjectPersonal {
-			err = c.rpc.Call("RemoteApi.getArtifactFileListingPersonal", []interface{}{c.tok, int(id), art[i].Stage, art[i].Command, art[i].Name, ""},
-				&art[i].Files)
+			err = c.call("RemoteApi.getArtifactFileListingPersonal", &art[i].Files, int(id), art[i].Stage,
+				art[i].Command, art[i].Name, "")
 		} else {
-			err = c.rpc.Call("RemoteApi.getArtifactFileListing", []interface{}{c.tok, project, int(id), art[i].Stage, art[i].Command, art[i].Name, ""},
-				&art[i].Files)
+			err = c.call("RemoteApi.getArtifactFileListing", &art[i].Files, project, int(id), art[i].Stage,
+				art[i].Command, art[i].Name, "")
 		}
 		if err != nil {
 			return err
 		}
 	}
 
-	af := NewArtifactFetcher(url, c.tok, dir)
-	for i := range art {
-		if err = af.Fetch(&art[i], project); err != nil {
-			return err
-		}
-	}
-	return nil
+	af := NewArtifactFetcher(url, c.Token(), dir)
+	af.Progress, af.Cache = c.prog, c.ac
+	return af.FetchAll(art, project)
+}
+
+func (c *client) Upload(id int64, project, name, url string, files []string) error {
+	return NewArtifactUploader(url, c.Token()).Upload(project, id, name, files)
 }
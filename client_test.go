@@ -1,6 +1,11 @@
 package pulse
 
 import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/rjeczalik/fakerpc"
@@ -84,6 +89,64 @@ func TestProjects(t *testing.T) {
 	}
 }
 
+const (
+	projectsResponse = `<?xml version="1.0"?><methodResponse><params><param><value><array><data>` +
+		`<value><string>Pulse CLI</string></value></data></array></value></param></params></methodResponse>`
+	faultResponse = `<?xml version="1.0"?><methodResponse><fault><value><struct>` +
+		`<member><name>faultCode</name><value><int>0</int></value></member>` +
+		`<member><name>faultString</name><value><string>java.lang.Exception: ` +
+		`com.zutubi.pulse.master.api.AuthenticationException: Invalid token</string></value></member>` +
+		`</struct></value></fault></methodResponse>`
+)
+
+func TestRelogin(t *testing.T) {
+	var toks []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("expected err to be nil, was %q instead", err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/xml")
+		if strings.Contains(string(body), "<string>3xp1r3d</string>") {
+			toks = append(toks, "3xp1r3d")
+			w.Write([]byte(faultResponse))
+			return
+		}
+		toks = append(toks, "n3wt0k3n")
+		w.Write([]byte(projectsResponse))
+	}))
+	defer srv.Close()
+	c, err := NewClientToken(srv.URL, "3xp1r3d")
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	if _, err = c.Projects(); err == nil {
+		t.Fatal("expected err to be non-nil")
+	}
+	logins := 0
+	c.SetLogin(func() (string, error) {
+		logins++
+		return "n3wt0k3n", nil
+	})
+	toks = nil
+	for i := 0; i < 2; i++ {
+		p, err := c.Projects()
+		if err != nil {
+			t.Fatalf("expected err to be nil, was %q instead (i=%d)", err, i)
+		}
+		if !reflect.DeepEqual(p, []string{"Pulse CLI"}) {
+			t.Errorf("expected p to be [Pulse CLI], was %v instead (i=%d)", p, i)
+		}
+	}
+	if exp := []string{"3xp1r3d", "n3wt0k3n", "n3wt0k3n"}; !reflect.DeepEqual(toks, exp) {
+		t.Errorf("expected calls with %v tokens, were %v instead", exp, toks)
+	}
+	if logins != 1 || c.Token() != "n3wt0k3n" {
+		t.Errorf("expected a single login, were %d with %q token instead", logins, c.Token())
+	}
+}
+
 func TestSetStage(t *testing.T) {
 	t.Skip("TODO(rjeczalik)")
 }
@@ -1,13 +1,19 @@
 package dev
 
 import (
-	"bufio"
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
-	"os/exec"
-	"strconv"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
+	"unicode/utf16"
 
 	"github.com/x-formation/pulsekit"
 )
@@ -18,190 +24,229 @@ type Personal struct {
 	Project  string
 	Stages   []string
 	Revision string
+	// Type is a type of the patch, PatchGit if empty.
+	Type PatchType
+	// DisableStages makes the Stages disabled in the project configuration
+	// for the time the request is sent, instead of being overridden for
+	// the personal build only. It is a fallback for servers, which ignore
+	// the overrides; the configuration is shared by all the users.
+	DisableStages bool
 }
 
-var ErrTimeout = errors.New("pulsedev: waiting for command to finish has timed out")
-
-// Exec TODO(rjeczalik): document
-type Exec interface {
-	// LookPath TODO(rjeczalik): document
-	LookPath(string) (string, error)
-	// CombinedOutput TODO(rjeczalik): document
-	CombinedOutput(string, []string) (io.Writer, io.Reader, func(time.Duration) error, error)
-}
-
-type cmdExec struct{}
-
-func (cmdExec) LookPath(file string) (string, error) {
-	return exec.LookPath(file)
-}
-
-func (cmdExec) CombinedOutput(file string, args []string) (stdin io.Writer,
-	stdout io.Reader, wait func(time.Duration) error, err error) {
-	cmd := exec.Command(file, args...)
-	if stdin, err = cmd.StdinPipe(); err != nil {
-		return
-	}
-	if stdout, err = cmd.StdoutPipe(); err != nil {
-		return
-	}
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return
-	}
-	stdout = io.MultiReader(stdout, stderr)
-	if err = cmd.Start(); err != nil {
-		return
-	}
-	wait = func(d time.Duration) (err error) {
-		done := make(chan error)
-		go func() {
-			done <- cmd.Wait()
-			close(done)
-		}()
-		select {
-		case err, _ = <-done:
-		case <-time.After(d):
-			err = ErrTimeout
-		}
-		return
-	}
-	return
-}
-
-// DefaultExec TODO(rjeczalik): document
-var DefaultExec Exec = new(cmdExec)
-
 // Tool TODO(rjeczalik): document
 type Tool interface {
-	// TODO(rjeczalik): document
-	Personal(p *Personal) (int64, error)
+	// Personal requests a personal build. A rejected request is reported with
+	// ErrAuthFailed, *ProjectNotFoundError or *PatchRejectedError.
+	Personal(p *Personal) (*PersonalResult, error)
 	SetTimeout(d time.Duration)
+	// SetJournal sets a journal, which records original configurations of
+	// stages disabled for a personal build with Personal.DisableStages until
+	// they are restored.
+	SetJournal(j *Journal)
 }
 
+// personalPath is a path of the Pulse server endpoint, which accepts personal
+// build requests. It is the same endpoint the pulse command line tool posts
+// patches to, after preparing the build with the Remote API.
+const personalPath = "/personal/personalBuild.action"
+
 type tool struct {
-	exec Exec
 	c    pulse.Client
+	http *http.Client
 	url  string
 	user string
 	pass string
-	exe  string
-	d    time.Duration
+	j    *Journal
 }
 
+// New gives a Tool, which sends personal build requests directly to the Pulse
+// server under the given URL, authenticating with the given user and password.
+// Personal builds are prepared with the Remote API within the session of c.
 func New(c pulse.Client, url, user, pass string) (Tool, error) {
-	var err error
+	if _, err := parseURL(url); err != nil {
+		return nil, err
+	}
 	t := &tool{
-		exec: DefaultExec,
 		c:    c,
-		url:  url,
+		http: &http.Client{Timeout: 15 * time.Second},
+		url:  strings.TrimRight(url, "/"),
 		user: user,
 		pass: pass,
-		d:    15 * time.Second,
-	}
-	if t.exe, err = t.exec.LookPath("pulse"); err != nil {
-		return nil, err
-	}
-	if err = t.valid(); err != nil {
-		return nil, err
 	}
 	return t, nil
 }
 
-func (t *tool) valid() error {
-	for _, args := range [][]string{{"help"}, {"help", "personal"}} {
-		_, _, wait, err := t.exec.CombinedOutput(t.exe, args)
-		if err != nil {
-			return err
-		}
-		if err = wait(t.d); err != nil {
-			return err
-		}
+func parseURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("pulsedev: invalid Pulse server URL: %q", s)
 	}
-	return nil
+	return u, nil
 }
 
-func (t *tool) Personal(p *Personal) (id int64, err error) {
-	var (
-		line   []byte
-		res    []byte
-		stages []pulse.ProjectStage
-		delim  = byte('\n')
-	)
-	args := []string{
-		"personal",
-		"-s", t.url,
-		"-u", t.user,
-		"-p", t.pass,
-		"-r", p.Project,
-		"-t", "git",
-		"-f", p.Patch,
-	}
-	if p.Revision != "" {
-		args = append(args, "-e", p.Revision)
-	}
-	if p.Stages != nil {
-		stages = make([]pulse.ProjectStage, len(p.Stages))
-		for i, s := range p.Stages {
-			stages[i], err = t.c.ConfigStage(p.Project, s)
-			if err != nil {
-				return
-			}
-			stages[i].Enabled = false
-			if err = t.c.SetConfigStage(p.Project, stages[i]); err != nil {
-				return
-			}
-		}
+func (t *tool) Personal(p *Personal) (res *PersonalResult, err error) {
+	if err = t.prepare(p.Project); err != nil {
+		return nil, err
+	}
+	if p.Patch == "" {
+		return nil, errors.New("pulsedev: a patch file is missing")
 	}
-	in, out, wait, err := t.exec.CombinedOutput(t.exe, args)
+	patch, err := os.Open(p.Patch)
 	if err != nil {
-		return
+		return nil, err
 	}
-	r := bufio.NewReader(out)
-INTERACTIVE:
-	for {
-		line, err = r.ReadBytes(delim)
-		if err == io.EOF {
-			continue
-		}
-		if err != nil {
-			break INTERACTIVE
-		}
-		s := string(line)
-		switch delim {
-		case '\n':
-			if strings.Contains(s, "Continue anyway?") {
-				delim, res = '>', []byte("Yes\n")
-			}
-			if strings.Contains(s, "Synchronise now?") {
-				delim, res = '>', []byte("No\n")
-			}
-			if strings.Contains(s, "Choose revision to build against") {
-				delim, res = '>', []byte("1!\n")
+	defer patch.Close()
+	if p.DisableStages && p.Stages != nil {
+		stages := make([]pulse.ProjectStage, 0, len(p.Stages))
+		// The stages are restored even if the request fails or panics.
+		defer func() {
+			if e := t.restore(p.Project, stages); e != nil && err == nil {
+				err = e
 			}
-			i := strings.Index(s, "Patch accepted: personal build")
-			if i != -1 {
-				id, err = strconv.ParseInt(s[31+i:len(s)-2], 10, 64)
-				break INTERACTIVE
+		}()
+		for _, s := range p.Stages {
+			stage, err := t.c.ConfigStage(p.Project, s)
+			if err != nil {
+				return nil, err
 			}
-			if strings.Contains(s, "Error") || strings.Contains(s, "Exception") {
-				err = errors.New(s)
-				break INTERACTIVE
+			if err = t.disable(p.Project, stage); err != nil {
+				if err != ErrJournalClosed {
+					stages = append(stages, stage)
+				}
+				return nil, err
 			}
-		case '>':
-			if _, err = in.Write(res); err != nil && err != io.EOF {
-				break INTERACTIVE
+			stages = append(stages, stage)
+		}
+	}
+	return t.send(p, patch)
+}
+
+// disable disables the stage in the project configuration, recording its
+// original configuration in the journal first.
+func (t *tool) disable(project string, stage pulse.ProjectStage) error {
+	disabled := stage
+	disabled.Enabled = false
+	fn := func() error { return t.c.SetConfigStage(project, disabled) }
+	if t.j == nil {
+		return fn()
+	}
+	return t.j.Modify(project, stage, fn)
+}
+
+// prepare validates the project for a personal build with the Remote API,
+// as the pulse command line tool does before sending a patch.
+func (t *tool) prepare(project string) error {
+	_, err := t.c.PreparePersonalBuild(project)
+	return parseFault(err)
+}
+
+// stageOverride is a format of a key of the overrides property, which disables
+// a stage for the personal build only.
+const stageOverride = "stage.%s.enabled"
+
+// overrides gives the overrides of the personal build encoded as Java
+// properties, which disable every stage of the p.Stages, unless they are
+// disabled in the project configuration instead.
+func overrides(p *Personal) string {
+	if p.DisableStages {
+		return ""
+	}
+	var buf bytes.Buffer
+	for _, s := range p.Stages {
+		fmt.Fprintf(&buf, "%s=false\n", escapeKey(fmt.Sprintf(stageOverride, s)))
+	}
+	return buf.String()
+}
+
+// escapeKey escapes the string as a key of a Java properties file.
+func escapeKey(s string) string {
+	var buf bytes.Buffer
+	for _, r := range s {
+		switch {
+		case r == ' ':
+			buf.WriteString(`\ `)
+		case strings.ContainsRune(`\=:#!`, r):
+			buf.WriteByte('\\')
+			buf.WriteRune(r)
+		case r == '\t':
+			buf.WriteString(`\t`)
+		case r == '\n':
+			buf.WriteString(`\n`)
+		case r == '\r':
+			buf.WriteString(`\r`)
+		case r == '\f':
+			buf.WriteString(`\f`)
+		case r < 0x20 || r > 0x7e:
+			for _, r := range utf16.Encode([]rune{r}) {
+				fmt.Fprintf(&buf, `\u%04X`, r)
 			}
-			delim = '\n'
+		default:
+			buf.WriteRune(r)
 		}
 	}
-	if e := wait(t.d); (err == io.EOF || err == nil) && e != nil {
-		err = e
+	return buf.String()
+}
+
+// send posts the personal build request as a multipart/form-data and parses
+// the result out of the response.
+func (t *tool) send(p *Personal, patch io.Reader) (*PersonalResult, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	fields := [][2]string{
+		{"project", p.Project},
+		{"revision", p.Revision},
+		{"reason", ""},
+		{"overrides", overrides(p)},
+		{"patchFormat", p.Type.format()},
+	}
+	for _, f := range fields {
+		if err := w.WriteField(f[0], f[1]); err != nil {
+			return nil, err
+		}
+	}
+	part, err := w.CreateFormFile("patch.zip", filepath.Base(p.Patch))
+	if err != nil {
+		return nil, err
 	}
-	if stages != nil {
-		for i := range stages {
-			stages[i].Enabled = true
-			if e := t.c.SetConfigStage(p.Project, stages[i]); e != nil && err == nil {
+	if _, err = io.Copy(part, patch); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", t.url+personalPath, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(t.user, t.pass)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	resp, err := t.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return parseResult(p, resp.StatusCode, b)
+}
+
+// restore sets back original configurations of the stages, removing them from
+// the journal. Stages which failed to restore are kept in the journal.
+func (t *tool) restore(project string, stages []pulse.ProjectStage) (err error) {
+	for i := range stages {
+		if e := t.c.SetConfigStage(project, stages[i]); e != nil {
+			if err == nil {
+				err = e
+			}
+			continue
+		}
+		if t.j != nil {
+			if e := t.j.Done(project, stages[i].Name); e != nil && err == nil {
 				err = e
 			}
 		}
@@ -210,5 +255,9 @@ INTERACTIVE:
 }
 
 func (t *tool) SetTimeout(d time.Duration) {
-	t.d = d
+	t.http.Timeout = d
+}
+
+func (t *tool) SetJournal(j *Journal) {
+	t.j = j
 }
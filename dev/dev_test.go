@@ -1,62 +1,456 @@
 package dev
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
 
+	"github.com/x-formation/pulsekit"
 	"github.com/x-formation/pulsekit/mock"
-
-	"github.com/rjeczalik/fakerpc"
 )
 
-func fixture(t *testing.T) (*mock.Client, Tool, func()) {
-	url, teardown := fakerpc.Fixture(t)
+// transmission and record mirror types of github.com/rjeczalik/fakerpc, which
+// was used to record the traffic of the pulse command line tool under testdata.
+type transmission struct {
+	Src, Dst *net.TCPAddr
+	Raw      []byte
+}
+
+type record struct {
+	Network net.IPNet
+	Filter  string
+	T       []transmission
+}
+
+// exchange is a recorded request together with the response to it.
+type exchange struct {
+	key  string
+	req  *http.Request
+	body []byte
+	resp *http.Response
+	out  []byte
+}
+
+var reMethod = regexp.MustCompile(`<methodName>([^<]+)</methodName>`)
+
+// key identifies a request by its path and the XML-RPC method it calls.
+func key(path string, body []byte) string {
+	if m := reMethod.FindSubmatch(body); m != nil {
+		return path + " " + string(m[1])
+	}
+	return path
+}
+
+// load reads exchanges recorded in the testdata file of the given name.
+func load(t *testing.T, name string) []exchange {
+	f, err := os.Open(filepath.Join("testdata", name+".gzob"))
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	var rec record
+	if err = gob.NewDecoder(r).Decode(&rec); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	// A single request or response may span a few transmissions.
+	var raw [][]byte
+	for i := range rec.T {
+		if i != 0 && rec.T[i].Src.String() == rec.T[i-1].Src.String() {
+			raw[len(raw)-1] = append(raw[len(raw)-1], rec.T[i].Raw...)
+			continue
+		}
+		raw = append(raw, append([]byte(nil), rec.T[i].Raw...))
+	}
+	if len(raw)%2 != 0 {
+		t.Fatalf("expected every request in %s to have a response", name)
+	}
+	ex := make([]exchange, len(raw)/2)
+	for i := range ex {
+		e := &ex[i]
+		if e.req, err = http.ReadRequest(bufio.NewReader(bytes.NewReader(raw[2*i]))); err != nil {
+			t.Fatalf("expected err to be nil, was %q instead", err)
+		}
+		if e.body, err = ioutil.ReadAll(e.req.Body); err != nil {
+			t.Fatalf("expected err to be nil, was %q instead", err)
+		}
+		if e.resp, err = http.ReadResponse(bufio.NewReader(bytes.NewReader(raw[2*i+1])), e.req); err != nil {
+			t.Fatalf("expected err to be nil, was %q instead", err)
+		}
+		if e.out, err = ioutil.ReadAll(e.resp.Body); err != nil {
+			t.Fatalf("expected err to be nil, was %q instead", err)
+		}
+		e.key = key(e.req.URL.Path, e.body)
+	}
+	return ex
+}
+
+// form parses a multipart/form-data body of the request.
+func form(r *http.Request, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest("POST", r.URL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = r.Header
+	return req, req.ParseMultipartForm(1 << 20)
+}
+
+// check compares a personal build request with the recorded one. Overrides
+// are not compared, as the recorded ones are empty.
+func (e *exchange) check(t *testing.T, r *http.Request, body []byte) {
+	if auth := e.req.Header.Get("Authorization"); r.Header.Get("Authorization") != auth {
+		t.Errorf("expected Authorization to be %q, was %q instead", auth, r.Header.Get("Authorization"))
+	}
+	exp, err := form(e.req, e.body)
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	req, err := form(r, body)
+	if err != nil {
+		t.Errorf("expected err to be nil, was %q instead", err)
+		return
+	}
+	for k, v := range exp.MultipartForm.Value {
+		if k == "overrides" {
+			if _, ok := req.MultipartForm.Value[k]; !ok {
+				t.Error("expected overrides to be sent")
+			}
+			continue
+		}
+		if !reflect.DeepEqual(req.MultipartForm.Value[k], v) {
+			t.Errorf("expected %s to be %q, was %q instead", k, v, req.MultipartForm.Value[k])
+		}
+	}
+	if len(req.MultipartForm.Value) != len(exp.MultipartForm.Value) {
+		t.Errorf("expected fields to be %v, was %v instead", exp.MultipartForm.Value, req.MultipartForm.Value)
+	}
+	for k, v := range exp.MultipartForm.File {
+		f := req.MultipartForm.File[k]
+		if len(f) != len(v) || f[0].Filename != v[0].Filename {
+			t.Errorf("expected %s file to be %q, was %v instead", k, v[0].Filename, f)
+		}
+	}
+}
+
+// replay is a server, which replays responses recorded for the requests of
+// the pulse command line tool.
+type replay struct {
+	srv *httptest.Server
+	mu  sync.Mutex
+	ex  []exchange
+	// Overrides are overrides of every personal build request received.
+	Overrides []string
+}
+
+func (rp *replay) serve(t *testing.T, w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		t.Errorf("expected err to be nil, was %q instead", err)
+		return
+	}
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	k := key(r.URL.Path, body)
+	if len(rp.ex) == 0 || rp.ex[0].key != k {
+		t.Errorf("unexpected request %q", k)
+		http.Error(w, "unexpected request", http.StatusInternalServerError)
+		return
+	}
+	e := rp.ex[0]
+	rp.ex = rp.ex[1:]
+	if r.URL.Path == personalPath {
+		e.check(t, r, body)
+		if req, err := form(r, body); err == nil {
+			rp.Overrides = append(rp.Overrides, req.FormValue("overrides"))
+		}
+	}
+	w.Header().Set("Content-Type", e.resp.Header.Get("Content-Type"))
+	w.WriteHeader(e.resp.StatusCode)
+	w.Write(e.out)
+}
+
+// Close stops the server, failing the test if any of the recorded requests
+// was not received.
+func (rp *replay) Close(t *testing.T) {
+	rp.srv.Close()
+	for _, e := range rp.ex {
+		t.Errorf("expected %q request to be received", e.key)
+	}
+}
+
+func fixture(t *testing.T, name string) (*mock.Client, Tool, *replay) {
+	rp := &replay{}
+	// The recorded requests of the pulse command line tool prepare personal
+	// builds over the Remote API, which the Tool does with its pulse.Client.
+	for _, e := range load(t, name) {
+		if !strings.HasPrefix(e.key, "/xmlrpc ") {
+			rp.ex = append(rp.ex, e)
+		}
+	}
+	rp.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rp.serve(t, w, r)
+	}))
 	mc := mock.NewClient()
-	tool, err := New(mc, url, "pulse_test", "pulse_test")
+	tool, err := New(mc, rp.srv.URL, "pulse_test", "pulse_test")
 	if err != nil {
-		t.Skip("pulsekit/dev: skipping test: ", err)
+		rp.srv.Close()
+		t.Fatalf("expected err to be nil, was %q instead", err)
 	}
-	return mc, tool, teardown
+	return mc, tool, rp
 }
 
 func TestPersonalOK(t *testing.T) {
-	_, tool, teardown := fixture(t)
-	defer teardown()
+	_, tool, rp := fixture(t, "testpersonalok")
+	defer rp.Close(t)
 	p := []Personal{{
-		Patch:   "dev_test.go",
-		Project: "Pulse CLI - Failure",
+		Patch:    "dev_test.go",
+		Project:  "Pulse CLI - Failure",
+		Revision: "075dbeed83626439d6fb07ccb66e1ef525ec05cb",
 	}, {
 		Patch:    "dev_test.go",
 		Project:  "Pulse CLI - Failure",
 		Revision: "HEAD",
 	}}
 	for i, p := range p {
-		id, err := tool.Personal(&p)
+		res, err := tool.Personal(&p)
 		if err != nil {
 			t.Errorf("expected err to be nil, was %q instead (i=%d)", err, i)
+			continue
+		}
+		if id := int64(151 + i); res.ID != id {
+			t.Errorf("expected id to be %d, was %d instead (i=%d)", id, res.ID, i)
 		}
-		if id <= 0 {
-			t.Errorf("expected i to be greater than 0, was %d instead (i=%d)", id, i)
+		if res.Requested != p.Revision {
+			t.Errorf("expected requested revision to be %q, was %q instead (i=%d)",
+				p.Revision, res.Requested, i)
 		}
 	}
 }
 
 func TestPersonalErr(t *testing.T) {
-	_, tool, teardown := fixture(t)
-	defer teardown()
-	p := []Personal{{
-		Patch:   "dev_test.go",
-		Project: "X",
+	mc, tool, rp := fixture(t, "testpersonalerr")
+	defer rp.Close(t)
+	mc.Err = []error{
+		errors.New("java.lang.Exception: java.lang.IllegalArgumentException: Unknown project 'X'"),
+		nil,
+		errors.New("java.lang.Exception: java.lang.IllegalArgumentException: Unknown project ''"),
+	}
+	table := []struct {
+		p   Personal
+		err error
+	}{{
+		Personal{Patch: "dev_test.go", Project: "X"},
+		&ProjectNotFoundError{Project: "X"},
+	}, {
+		Personal{Project: "Pulse CLI - Failure", Revision: "HEAD"},
+		errors.New("pulsedev: a patch file is missing"),
+	}, {
+		Personal{},
+		&ProjectNotFoundError{},
+	}}
+	for i, tt := range table {
+		res, err := tool.Personal(&tt.p)
+		if !reflect.DeepEqual(err, tt.err) {
+			t.Errorf("expected err to be %#v, was %#v instead (i=%d)", tt.err, err, i)
+		}
+		if res != nil {
+			t.Errorf("expected res to be nil (i=%d)", i)
+		}
+	}
+}
+
+func TestParseResult(t *testing.T) {
+	p := &Personal{Project: "Pulse CLI", Revision: "1234"}
+	table := []struct {
+		status int
+		body   string
+		res    *PersonalResult
+		err    error
+	}{{
+		200,
+		"<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<response number=\"151\">\n</response>\n",
+		&PersonalResult{ID: 151, Requested: "1234"},
+		nil,
+	}, {
+		200,
+		`<?xml version="1.0" encoding="UTF-8"?>
+<response number="152" revision="075dbee">
+  <warning>Skipping synchronisation: the revision is not floating</warning>
+  <warning>Stage "Windows" has no agent</warning>
+</response>`,
+		&PersonalResult{
+			ID:        152,
+			Revision:  "075dbee",
+			Requested: "1234",
+			Warnings: []string{
+				"Skipping synchronisation: the revision is not floating",
+				`Stage "Windows" has no agent`,
+			},
+			SyncSkipped: true,
+		},
+		nil,
+	}, {
+		200,
+		"<response>\n<error>Unable to apply patch</error>\n<error>Conflicts in main.go</error>\n</response>",
+		nil,
+		&PatchRejectedError{Reason: "Unable to apply patch; Conflicts in main.go"},
+	}, {
+		200,
+		"patch does not apply",
+		nil,
+		&PatchRejectedError{Reason: "patch does not apply"},
 	}, {
+		400,
+		"invalid patch format",
+		nil,
+		&PatchRejectedError{Reason: "status=400, invalid patch format"},
+	}, {
+		500,
+		"internal error",
+		nil,
+		errors.New("pulsedev: personal build request failed: status=500, internal error"),
+	}, {
+		401,
+		"authentication failed",
+		nil,
+		ErrAuthFailed,
+	}}
+	for i, tt := range table {
+		res, err := parseResult(p, tt.status, []byte(tt.body))
+		if !reflect.DeepEqual(err, tt.err) {
+			t.Errorf("expected err to be %#v, was %#v instead (i=%d)", tt.err, err, i)
+		}
+		if !reflect.DeepEqual(res, tt.res) {
+			t.Errorf("expected res to be %+v, was %+v instead (i=%d)", tt.res, res, i)
+		}
+	}
+}
+
+func TestParseFault(t *testing.T) {
+	table := []struct {
+		fault string
+		err   error
+	}{{
+		"java.lang.Exception: java.lang.IllegalArgumentException: Unknown project 'Pulse CLI'",
+		&ProjectNotFoundError{Project: "Pulse CLI"},
+	}, {
+		"java.lang.Exception: org.acegisecurity.BadCredentialsException: Bad credentials",
+		ErrAuthFailed,
+	}, {
+		"java.lang.Exception: Invalid token",
+		ErrAuthFailed,
+	}, {
+		"connection refused",
+		errors.New("connection refused"),
+	}}
+	for i, tt := range table {
+		if err := parseFault(errors.New(tt.fault)); !reflect.DeepEqual(err, tt.err) {
+			t.Errorf("expected err to be %#v, was %#v instead (i=%d)", tt.err, err, i)
+		}
+	}
+}
+
+func TestPersonalStages(t *testing.T) {
+	mc, tool, rp := fixture(t, "testpersonalok")
+	mc.Err = make([]error, 5)
+	p := []Personal{{
+		Patch:    "dev_test.go",
 		Project:  "Pulse CLI - Failure",
-		Revision: "HEAD",
-	}, {}}
-	for _, p := range p {
-		id, err := tool.Personal(&p)
-		if err == nil {
-			t.Error("expected err to be non-nil")
+		Revision: "075dbeed83626439d6fb07ccb66e1ef525ec05cb",
+		Stages:   []string{"Build - Linux x86", "Test=All: ł"},
+	}, {
+		Patch:         "dev_test.go",
+		Project:       "Pulse CLI - Failure",
+		Revision:      "HEAD",
+		Stages:        []string{"Build - Linux x86"},
+		DisableStages: true,
+	}}
+	for i := range p {
+		if _, err := tool.Personal(&p[i]); err != nil {
+			t.Errorf("expected err to be nil, was %q instead (i=%d)", err, i)
 		}
-		if id != 0 {
-			t.Error("expected i to be 0")
+	}
+	rp.Close(t)
+	mc.Check(t)
+	expected := []string{
+		"stage.Build\\ -\\ Linux\\ x86.enabled=false\n" +
+			"stage.Test\\=All\\:\\ \\u0142.enabled=false\n",
+		"",
+	}
+	if !reflect.DeepEqual(rp.Overrides, expected) {
+		t.Errorf("expected overrides to be %q, was %q instead", expected, rp.Overrides)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pulsekit")
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	defer os.RemoveAll(dir)
+	j, err := NewJournal(dir)
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	stages := []pulse.ProjectStage{
+		{Name: "Build - Linux x86", Enabled: true},
+		{Name: "Build - Windows x86", Enabled: false},
+	}
+	for _, s := range stages {
+		if err := j.Add("LM-X - Tier 1", s); err != nil {
+			t.Fatalf("expected err to be nil, was %q instead", err)
 		}
 	}
+	mc := mock.NewClient()
+	mc.Err = []error{nil, errors.New("connection lost")}
+	if err := j.Restore(mc); err == nil {
+		t.Fatal("expected err to be non-nil")
+	}
+	mc.Check(t)
+	j.Close()
+	if err := j.Modify("LM-X - Tier 1", stages[0], nil); err != ErrJournalClosed {
+		t.Errorf("expected err to be ErrJournalClosed, was %v instead", err)
+	}
+	if n := j.Len(); n != 1 {
+		t.Errorf("expected 1 stage left to restore, was %d instead", n)
+	}
+	// The journal of a running process must not be restored by others.
+	mc = mock.NewClient()
+	if rec, err := RestoreAll(mc, dir); err != nil || len(rec) != 0 {
+		t.Errorf("expected no records to be restored, was %v instead (err=%v)", rec, err)
+	}
+	mc.Check(t)
+	if err := os.Rename(j.path, filepath.Join(dir, "1073741824.yml")); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	mc = mock.NewClient()
+	mc.Err = make([]error, 1)
+	rec, err := RestoreAll(mc, dir)
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	mc.Check(t)
+	expected := []Record{{Project: "LM-X - Tier 1", Stage: stages[1]}}
+	if !reflect.DeepEqual(rec, expected) {
+		t.Errorf("expected rec to be %+v, was %+v instead", expected, rec)
+	}
+	if fi, err := ioutil.ReadDir(dir); err != nil || len(fi) != 0 {
+		t.Errorf("expected journal directory to be empty, was %v (err=%v)", fi, err)
+	}
 }
@@ -0,0 +1,111 @@
+package dev
+
+import (
+	"io"
+	"strings"
+)
+
+// Git describes which changes of a git repository make a personal build patch.
+// The zero value describes uncommitted changes of the working tree in
+// the current directory.
+type Git struct {
+	// Dir is a path to the working tree, current directory if empty.
+	Dir string
+	// Staged limits the uncommitted changes to the staged ones only.
+	Staged bool
+	// Upstream makes a patch of the commits of the current branch, which
+	// are not in its upstream branch.
+	Upstream bool
+	// Range is a commit range the patch is made of, e.g. "HEAD~2..HEAD".
+	// A single revision means the range from the revision to HEAD.
+	Range string
+}
+
+// Patch writes a patch to w and returns a base revision the patch applies to.
+// The patch includes binary files and detects renames.
+//
+// For uncommitted changes the base revision is HEAD, unless HEAD was not pushed
+// to any remote branch - then it's a merge base of HEAD and its upstream branch
+// and the patch includes the local commits as well.
+func (g *Git) Patch(w io.Writer) (rev string, err error) {
+	var from, to string
+	switch {
+	case g.Range != "":
+		from, to, err = g.parseRange(g.Range)
+	case g.Upstream:
+		from, to = "@{upstream}", "HEAD"
+		if from, err = g.git("merge-base", from, to); err != nil {
+			return "", err
+		}
+	default:
+		from, err = g.base()
+	}
+	if err != nil {
+		return "", err
+	}
+	args := []string{"diff", "--binary", "--full-index", "-M", "--no-color", "--no-ext-diff"}
+	if to == "" && g.Staged {
+		args = append(args, "--cached")
+	}
+	if args = append(args, from); to != "" {
+		args = append(args, to)
+	}
+	if _, err = run(w, g.Dir, "git", args...); err != nil {
+		return "", err
+	}
+	return from, nil
+}
+
+// parseRange gives both ends of the range as commit SHAs. For a symmetric
+// difference range ("A...B") the start is a merge base of A and B.
+func (g *Git) parseRange(r string) (from, to string, err error) {
+	sep := ".."
+	if strings.Contains(r, "...") {
+		sep = "..."
+	}
+	s := strings.SplitN(r, sep, 2)
+	if len(s) == 1 {
+		s = append(s, "HEAD")
+	}
+	for i := range s {
+		if s[i] == "" {
+			s[i] = "HEAD"
+		}
+	}
+	if sep == "..." {
+		from, err = g.git("merge-base", s[0], s[1])
+	} else {
+		from, err = g.git("rev-parse", "--verify", s[0]+"^{commit}")
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if to, err = g.git("rev-parse", "--verify", s[1]+"^{commit}"); err != nil {
+		return "", "", err
+	}
+	return from, to, nil
+}
+
+// base gives a revision of HEAD if it's already pushed, or a merge base of HEAD
+// and its upstream branch otherwise.
+func (g *Git) base() (string, error) {
+	head, err := g.git("rev-parse", "--verify", "HEAD^{commit}")
+	if err != nil {
+		return "", err
+	}
+	remote, err := g.git("branch", "-r", "--contains", head)
+	if err != nil || remote != "" {
+		return head, err
+	}
+	if base, err := g.git("merge-base", "@{upstream}", head); err == nil {
+		return base, nil
+	}
+	return head, nil
+}
+
+// Type implements Patcher.
+func (g *Git) Type() PatchType { return PatchGit }
+
+func (g *Git) git(args ...string) (string, error) {
+	return run(nil, g.Dir, "git", args...)
+}
@@ -0,0 +1,104 @@
+package dev
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func gitFixture(t *testing.T) (*Git, func()) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("pulsekit/dev: skipping test: ", err)
+	}
+	dir, err := ioutil.TempDir("", "pulsekit")
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	g := &Git{Dir: dir}
+	run := func(args ...string) {
+		if _, err := g.git(args...); err != nil {
+			os.RemoveAll(dir)
+			t.Fatalf("expected err to be nil, was %q instead", err)
+		}
+	}
+	write := func(name, s string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(s), 0644); err != nil {
+			os.RemoveAll(dir)
+			t.Fatalf("expected err to be nil, was %q instead", err)
+		}
+	}
+	run("init", "-q")
+	run("config", "user.name", "pulsekit")
+	run("config", "user.email", "pulsekit@example.com")
+	write("a.txt", strings.Repeat("line\n", 20))
+	run("add", "a.txt")
+	run("commit", "-q", "-m", "first")
+	run("mv", "a.txt", "b.txt")
+	write("c.bin", "\x00\x01\x02\x03")
+	run("add", "c.bin")
+	run("commit", "-q", "-m", "second")
+	write("d.txt", "staged\n")
+	run("add", "d.txt")
+	write("b.txt", strings.Repeat("line\n", 21))
+	return g, func() { os.RemoveAll(dir) }
+}
+
+func TestGitPatch(t *testing.T) {
+	g, teardown := gitFixture(t)
+	defer teardown()
+	head, err := g.git("rev-parse", "HEAD")
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	first, err := g.git("rev-parse", "HEAD~1")
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	table := []struct {
+		g        Git
+		rev      string
+		contains []string
+		excludes []string
+	}{{
+		Git{Range: "HEAD~1"},
+		first,
+		[]string{"rename from a.txt", "rename to b.txt", "GIT binary patch"},
+		[]string{"d.txt"},
+	}, {
+		Git{},
+		head,
+		[]string{"b.txt", "d.txt"},
+		[]string{"c.bin"},
+	}, {
+		Git{Staged: true},
+		head,
+		[]string{"d.txt"},
+		[]string{"b.txt", "c.bin"},
+	}}
+	for i, tt := range table {
+		var buf bytes.Buffer
+		tt.g.Dir = g.Dir
+		rev, err := tt.g.Patch(&buf)
+		if err != nil {
+			t.Errorf("expected err to be nil, was %q instead (i=%d)", err, i)
+			continue
+		}
+		if rev != tt.rev {
+			t.Errorf("expected rev to be %q, was %q instead (i=%d)", tt.rev, rev, i)
+		}
+		for _, s := range tt.contains {
+			if !strings.Contains(buf.String(), s) {
+				t.Errorf("expected patch to contain %q (i=%d)", s, i)
+			}
+		}
+		for _, s := range tt.excludes {
+			if strings.Contains(buf.String(), s) {
+				t.Errorf("expected patch to not contain %q (i=%d)", s, i)
+			}
+		}
+	}
+}
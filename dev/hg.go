@@ -0,0 +1,40 @@
+package dev
+
+import (
+	"io"
+	"strings"
+)
+
+// Hg describes which changes of a Mercurial working copy make a personal build
+// patch. The zero value describes uncommitted changes of the working copy
+// in the current directory.
+type Hg struct {
+	// Dir is a path to the working copy, current directory if empty.
+	Dir string
+	// Range is a revision range the patch is made of, e.g. "tip~2:tip".
+	// A single revision means the range from the revision to the working copy.
+	Range string
+}
+
+// Patch implements Patcher. The patch is made in the git format, so it includes
+// binary files and renames.
+func (h *Hg) Patch(w io.Writer) (rev string, err error) {
+	from, args := ".", []string{"diff", "--git"}
+	if h.Range != "" {
+		s := strings.SplitN(strings.Replace(h.Range, "::", ":", 1), ":", 2)
+		from = s[0]
+		for _, r := range s {
+			args = append(args, "-r", r)
+		}
+	}
+	if rev, err = run(nil, h.Dir, "hg", "log", "-r", from, "--template", "{node}"); err != nil {
+		return "", err
+	}
+	if _, err = run(w, h.Dir, "hg", args...); err != nil {
+		return "", err
+	}
+	return rev, nil
+}
+
+// Type implements Patcher.
+func (h *Hg) Type() PatchType { return PatchHg }
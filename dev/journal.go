@@ -0,0 +1,198 @@
+package dev
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/x-formation/pulsekit"
+
+	"gopkg.in/v1/yaml"
+)
+
+// Record is an original configuration of a project stage, which was modified
+// for a personal build.
+type Record struct {
+	Project string
+	Stage   pulse.ProjectStage
+}
+
+// Journal records original configurations of project stages, which were
+// modified for a personal build, until they are restored. The records are
+// persisted before a stage is modified, so they survive a crash of the process
+// and can be restored later with RestoreAll.
+//
+// Every process writes its own journal file within the journal directory.
+type Journal struct {
+	dir    string
+	path   string
+	mu     sync.Mutex
+	rec    []Record
+	op     sync.RWMutex // held for reading while a stage is being modified
+	closed bool
+}
+
+// ErrJournalClosed is returned by Modify after the journal is closed.
+var ErrJournalClosed = errors.New("pulsedev: the journal is closed, stages are being restored")
+
+// NewJournal gives a journal for the current process, which is stored within
+// the given directory. The directory is created if it does not exist.
+func NewJournal(dir string) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	j := &Journal{
+		dir:  dir,
+		path: filepath.Join(dir, fmt.Sprintf("%d.yml", os.Getpid())),
+	}
+	return j, nil
+}
+
+// Add records an original configuration of the stage.
+func (j *Journal) Add(project string, s pulse.ProjectStage) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.rec = append(j.rec, Record{Project: project, Stage: s})
+	return j.flush()
+}
+
+// Modify records an original configuration of the stage and calls fn, which
+// modifies it. It fails with ErrJournalClosed without calling fn once
+// the journal is closed.
+func (j *Journal) Modify(project string, s pulse.ProjectStage, fn func() error) error {
+	j.op.RLock()
+	defer j.op.RUnlock()
+	if j.closed {
+		return ErrJournalClosed
+	}
+	if err := j.Add(project, s); err != nil {
+		return err
+	}
+	return fn()
+}
+
+// Close waits for modifications in progress to complete and makes further
+// ones fail, so every modified stage is recorded by the time it returns and
+// none is modified after it is restored, e.g. on interrupt.
+func (j *Journal) Close() {
+	j.op.Lock()
+	j.closed = true
+	j.op.Unlock()
+}
+
+// Len gives a number of stages, which are not restored yet.
+func (j *Journal) Len() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return len(j.rec)
+}
+
+// Done removes the record of the stage after it has been restored.
+func (j *Journal) Done(project, stage string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for i := range j.rec {
+		if j.rec[i].Project == project && j.rec[i].Stage.Name == stage {
+			j.rec = append(j.rec[:i], j.rec[i+1:]...)
+			break
+		}
+	}
+	return j.flush()
+}
+
+// Restore restores every stage recorded by the journal.
+func (j *Journal) Restore(c pulse.Client) error {
+	j.mu.Lock()
+	rec := append([]Record(nil), j.rec...)
+	j.mu.Unlock()
+	for i := range rec {
+		if err := c.SetConfigStage(rec[i].Project, rec[i].Stage); err != nil {
+			return err
+		}
+		if err := j.Done(rec[i].Project, rec[i].Stage.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush writes the records to the journal file, removing the file when there
+// is nothing left to restore.
+func (j *Journal) flush() error {
+	if len(j.rec) == 0 {
+		if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	b, err := yaml.Marshal(j.rec)
+	if err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
+
+// RestoreAll restores stages recorded by all the journals within the given
+// directory, e.g. ones left behind by interrupted personal builds. Journals of
+// processes, which are still running, are skipped, as their stages are going
+// to be restored by the processes themselves. It returns the restored records.
+// A journal file is removed once all its records are restored.
+func RestoreAll(c pulse.Client, dir string) ([]Record, error) {
+	fi, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var restored []Record
+	for _, fi := range fi {
+		if !strings.HasSuffix(fi.Name(), ".yml") {
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimSuffix(fi.Name(), ".yml"))
+		if err == nil && alive(pid) {
+			continue
+		}
+		path := filepath.Join(dir, fi.Name())
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return restored, err
+		}
+		var rec []Record
+		if err = yaml.Unmarshal(b, &rec); err != nil {
+			return restored, fmt.Errorf("pulsedev: invalid journal %s: %v", path, err)
+		}
+		j := &Journal{dir: dir, path: path, rec: rec}
+		if err = j.Restore(c); err != nil {
+			return restored, err
+		}
+		restored = append(restored, rec...)
+	}
+	return restored, nil
+}
+
+// alive reports whether a process with the given PID is running.
+func alive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// On Windows FindProcess fails for a process, which does not exist.
+	if runtime.GOOS == "windows" {
+		p.Release()
+		return true
+	}
+	return p.Signal(syscall.Signal(0)) == nil
+}
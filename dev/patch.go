@@ -0,0 +1,112 @@
+package dev
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// PatchType is a format of a personal build patch, which depends on a version
+// control system the patch was made with.
+type PatchType string
+
+const (
+	PatchGit     PatchType = "git"
+	PatchSvn     PatchType = "svn"
+	PatchHg      PatchType = "hg"
+	PatchUnified PatchType = "unified"
+)
+
+// format gives a name of the patch format as Pulse server knows it. Mercurial
+// patches are made in the git format.
+func (t PatchType) format() string {
+	switch t {
+	case PatchGit, PatchHg:
+		return "git"
+	case "":
+		return string(PatchGit)
+	}
+	return string(PatchUnified)
+}
+
+// ParsePatchType gives a PatchType for its name.
+func ParsePatchType(s string) (PatchType, error) {
+	switch t := PatchType(s); t {
+	case PatchGit, PatchSvn, PatchHg, PatchUnified:
+		return t, nil
+	}
+	return "", fmt.Errorf("pulsedev: unknown patch type: %q", s)
+}
+
+// Patcher generates a personal build patch out of a working copy.
+type Patcher interface {
+	// Patch writes a patch to w and returns a base revision the patch
+	// applies to.
+	Patch(w io.Writer) (rev string, err error)
+	// Type gives the type of the patch.
+	Type() PatchType
+}
+
+// NewPatcher gives a Patcher of a given type for a working copy in dir. The rng
+// is a revision range in a format of the version control system, empty for
+// uncommitted changes.
+func NewPatcher(t PatchType, dir, rng string) (Patcher, error) {
+	switch t {
+	case PatchGit:
+		return &Git{Dir: dir, Range: rng}, nil
+	case PatchSvn:
+		return &Svn{Dir: dir, Range: rng}, nil
+	case PatchHg:
+		return &Hg{Dir: dir, Range: rng}, nil
+	}
+	return nil, fmt.Errorf("pulsedev: unable to generate a patch of %q type", t)
+}
+
+// DetectPatchType gives a type of a working copy the dir belongs to, looking
+// for a version control system metadata in the dir and its parents. It returns
+// PatchUnified if none is found.
+func DetectPatchType(dir string) (PatchType, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	meta := []struct {
+		name string
+		t    PatchType
+	}{{".git", PatchGit}, {".hg", PatchHg}, {".svn", PatchSvn}}
+	for {
+		for _, m := range meta {
+			if _, err := os.Stat(filepath.Join(dir, m.name)); err == nil {
+				return m.t, nil
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return PatchUnified, nil
+		}
+		dir = parent
+	}
+}
+
+// run runs a command in the dir. When w is nil it gives the trimmed output,
+// otherwise the output is written to w.
+func run(w io.Writer, dir, name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	var stdout, stderr bytes.Buffer
+	if cmd.Stdout, cmd.Stderr = w, &stderr; w == nil {
+		cmd.Stdout = &stdout
+	}
+	if err := cmd.Run(); err != nil {
+		cmdline := name + " " + strings.Join(args, " ")
+		if s := strings.TrimSpace(stderr.String()); s != "" {
+			return "", fmt.Errorf("pulsedev: %s: %s", cmdline, s)
+		}
+		return "", fmt.Errorf("pulsedev: %s: %v", cmdline, err)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
@@ -0,0 +1,72 @@
+package dev
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectPatchType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pulsekit")
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	defer os.RemoveAll(dir)
+	dirs := []string{
+		filepath.Join(dir, "git", ".git"),
+		filepath.Join(dir, "git", "src", "pkg"),
+		filepath.Join(dir, "hg", ".hg"),
+		filepath.Join(dir, "svn", ".svn"),
+		filepath.Join(dir, "svn", "trunk"),
+		filepath.Join(dir, "none"),
+	}
+	for _, d := range dirs {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatalf("expected err to be nil, was %q instead", err)
+		}
+	}
+	table := map[string]PatchType{
+		filepath.Join(dir, "git", "src", "pkg"): PatchGit,
+		filepath.Join(dir, "hg"):                PatchHg,
+		filepath.Join(dir, "svn", "trunk"):      PatchSvn,
+		filepath.Join(dir, "none"):              PatchUnified,
+	}
+	for d, exp := range table {
+		typ, err := DetectPatchType(d)
+		if err != nil {
+			t.Errorf("expected err to be nil, was %q instead (d=%s)", err, d)
+			continue
+		}
+		// The temporary directory itself may be a part of a working copy.
+		if exp == PatchUnified && typ != PatchUnified {
+			t.Logf("temporary directory belongs to a %q working copy", typ)
+			continue
+		}
+		if typ != exp {
+			t.Errorf("expected typ to be %q, was %q instead (d=%s)", exp, typ, d)
+		}
+	}
+}
+
+func TestParsePatchType(t *testing.T) {
+	table := map[string]string{
+		"git":     "git",
+		"hg":      "git",
+		"svn":     "unified",
+		"unified": "unified",
+	}
+	for s, format := range table {
+		typ, err := ParsePatchType(s)
+		if err != nil {
+			t.Errorf("expected err to be nil, was %q instead (s=%s)", err, s)
+			continue
+		}
+		if typ.format() != format {
+			t.Errorf("expected format to be %q, was %q instead (s=%s)", format, typ.format(), s)
+		}
+	}
+	if _, err := ParsePatchType("cvs"); err == nil {
+		t.Error("expected err to be non-nil")
+	}
+}
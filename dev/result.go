@@ -0,0 +1,132 @@
+package dev
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// PersonalResult is a result of an accepted personal build request.
+type PersonalResult struct {
+	// ID is a number of the personal build.
+	ID int64
+	// Revision is a revision the Pulse server accepted the patch against,
+	// empty when the server does not report it.
+	Revision string
+	// Requested is a revision chosen by the client, empty for the latest one.
+	Requested string
+	// Warnings are warnings emitted by the Pulse server while processing
+	// the request.
+	Warnings []string
+	// SyncSkipped reports whether the Pulse server skipped synchronisation
+	// of the working copy with the repository.
+	SyncSkipped bool
+}
+
+// ErrAuthFailed is returned when the Pulse server rejects the credentials
+// a personal build was requested with.
+var ErrAuthFailed = errors.New("pulsedev: authentication failed")
+
+// ProjectNotFoundError is returned when the project a personal build was
+// requested for does not exist.
+type ProjectNotFoundError struct {
+	Project string
+}
+
+func (e *ProjectNotFoundError) Error() string {
+	return fmt.Sprintf("pulsedev: project not found: %q", e.Project)
+}
+
+// PatchRejectedError is returned when the Pulse server rejects the patch,
+// e.g. because it does not apply.
+type PatchRejectedError struct {
+	Reason string
+}
+
+func (e *PatchRejectedError) Error() string {
+	return "pulsedev: patch rejected: " + e.Reason
+}
+
+// response is a body of a response of the Pulse server to a personal build
+// request, e.g.:
+//
+//	<?xml version="1.0" encoding="UTF-8"?>
+//	<response number="151" revision="075dbee">
+//	  <warning>Skipping synchronisation: the revision is not floating</warning>
+//	</response>
+//
+// The revision and the warnings are reported by newer servers only. A rejected
+// request has no number, and has its reasons reported with error elements.
+type response struct {
+	Number   int64    `xml:"number,attr"`
+	Revision string   `xml:"revision,attr"`
+	Warnings []string `xml:"warning"`
+	Errors   []string `xml:"error"`
+}
+
+var reSkipped = regexp.MustCompile(`(?i)skipping synchroni[sz]ation|synchroni[sz]ation skipped`)
+
+// parseResult parses a response of the Pulse server to the personal build
+// request. A request, which is not accepted with a build number, has its
+// patch rejected, unless the server fails to process it.
+func parseResult(p *Personal, status int, body []byte) (*PersonalResult, error) {
+	msg := strings.TrimSpace(string(body))
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return nil, ErrAuthFailed
+	case status/100 == 5:
+		return nil, fmt.Errorf("pulsedev: personal build request failed: status=%d, %s",
+			status, msg)
+	case status/100 != 2:
+		return nil, &PatchRejectedError{Reason: fmt.Sprintf("status=%d, %s", status, msg)}
+	}
+	var resp response
+	if err := xml.Unmarshal(body, &resp); err != nil {
+		return nil, &PatchRejectedError{Reason: msg}
+	}
+	if resp.Number <= 0 {
+		if len(resp.Errors) != 0 {
+			msg = strings.Join(resp.Errors, "; ")
+		}
+		return nil, &PatchRejectedError{Reason: msg}
+	}
+	res := &PersonalResult{
+		ID:        resp.Number,
+		Revision:  resp.Revision,
+		Requested: p.Revision,
+	}
+	for _, w := range resp.Warnings {
+		w = strings.TrimSpace(w)
+		res.Warnings = append(res.Warnings, w)
+		if reSkipped.MatchString(w) {
+			res.SyncSkipped = true
+		}
+	}
+	return res, nil
+}
+
+var (
+	reProject = regexp.MustCompile(`Unknown project '(.*)'`)
+	reAuth    = regexp.MustCompile(`AuthenticationException|BadCredentialsException|[Ii]nvalid token`)
+)
+
+// parseFault gives a typed error for a fault returned by the Remote API, e.g.:
+//
+//	java.lang.Exception: java.lang.IllegalArgumentException: Unknown project 'X'
+//
+// Other errors are returned unchanged.
+func parseFault(err error) error {
+	if err == nil {
+		return nil
+	}
+	if m := reProject.FindStringSubmatch(err.Error()); m != nil {
+		return &ProjectNotFoundError{Project: m[1]}
+	}
+	if reAuth.MatchString(err.Error()) {
+		return ErrAuthFailed
+	}
+	return err
+}
@@ -0,0 +1,48 @@
+package dev
+
+import (
+	"regexp"
+
+	"github.com/x-formation/pulsekit"
+)
+
+// Selection is a result of selecting stages of a project for a personal build.
+type Selection struct {
+	// Run are enabled stages, which run in the personal build.
+	Run []pulse.ProjectStage
+	// Skip are enabled stages, which are disabled for the personal build.
+	Skip []pulse.ProjectStage
+	// Disabled are stages disabled in the project configuration.
+	Disabled []pulse.ProjectStage
+}
+
+// Names gives names of the stages to skip, which is what Personal.Stages
+// expects.
+func (s *Selection) Names() []string {
+	if len(s.Skip) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(s.Skip))
+	for i := range s.Skip {
+		names = append(names, s.Skip[i].Name)
+	}
+	return names
+}
+
+// SelectStages selects enabled stages, which names match the run pattern and
+// do not match the skip one, to run in a personal build. A nil skip pattern
+// does not skip any stage.
+func SelectStages(stages []pulse.ProjectStage, run, skip *regexp.Regexp) *Selection {
+	s := &Selection{}
+	for i := range stages {
+		switch {
+		case !stages[i].Enabled:
+			s.Disabled = append(s.Disabled, stages[i])
+		case run.MatchString(stages[i].Name) && (skip == nil || !skip.MatchString(stages[i].Name)):
+			s.Run = append(s.Run, stages[i])
+		default:
+			s.Skip = append(s.Skip, stages[i])
+		}
+	}
+	return s
+}
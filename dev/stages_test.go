@@ -0,0 +1,44 @@
+package dev
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/x-formation/pulsekit"
+)
+
+func TestSelectStages(t *testing.T) {
+	stages := []pulse.ProjectStage{
+		{Name: "Build - Linux x86", Enabled: true},
+		{Name: "Build - Linux x64", Enabled: true},
+		{Name: "Build - MAC OS X 10.9", Enabled: true},
+		{Name: "Build - Windows x86", Enabled: false},
+		{Name: "Test - Linux x86", Enabled: true},
+	}
+	table := []struct {
+		run, skip string
+		names     []string
+	}{
+		{".*", "", nil},
+		{"Build - (MAC OS X|Linux x86$)", "", []string{"Build - Linux x64", "Test - Linux x86"}},
+		{".*", "Linux", []string{"Build - Linux x86", "Build - Linux x64", "Test - Linux x86"}},
+		{"^Build", "x64$", []string{"Build - Linux x64", "Test - Linux x86"}},
+	}
+	for i, tt := range table {
+		var skip *regexp.Regexp
+		if tt.skip != "" {
+			skip = regexp.MustCompile(tt.skip)
+		}
+		s := SelectStages(stages, regexp.MustCompile(tt.run), skip)
+		if names := s.Names(); !reflect.DeepEqual(names, tt.names) {
+			t.Errorf("expected names to be %v, was %v instead (i=%d)", tt.names, names, i)
+		}
+		if len(s.Disabled) != 1 || s.Disabled[0].Name != "Build - Windows x86" {
+			t.Errorf("expected only the Windows stage to be disabled, was %v instead (i=%d)", s.Disabled, i)
+		}
+		if len(s.Run)+len(s.Skip) != 4 {
+			t.Errorf("expected 4 enabled stages, was %d instead (i=%d)", len(s.Run)+len(s.Skip), i)
+		}
+	}
+}
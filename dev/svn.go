@@ -0,0 +1,52 @@
+package dev
+
+import (
+	"errors"
+	"io"
+	"strings"
+)
+
+// Svn describes which changes of a Subversion working copy make a personal
+// build patch. The zero value describes uncommitted changes of the working copy
+// in the current directory.
+type Svn struct {
+	// Dir is a path to the working copy, current directory if empty.
+	Dir string
+	// Range is a revision range the patch is made of, e.g. "1200:1210".
+	// A single revision means the range from the revision to the working copy.
+	Range string
+}
+
+// Patch implements Patcher.
+func (s *Svn) Patch(w io.Writer) (rev string, err error) {
+	args := []string{"diff", "--non-interactive"}
+	if s.Range == "" {
+		if rev, err = s.revision(); err != nil {
+			return "", err
+		}
+	} else {
+		rev = strings.SplitN(s.Range, ":", 2)[0]
+		args = append(args, "-r", s.Range)
+	}
+	if _, err = run(w, s.Dir, "svn", args...); err != nil {
+		return "", err
+	}
+	return rev, nil
+}
+
+// revision gives a revision the working copy was updated to.
+func (s *Svn) revision() (string, error) {
+	out, err := run(nil, s.Dir, "svn", "info", "--non-interactive")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "Revision:") {
+			return strings.TrimSpace(line[len("Revision:"):]), nil
+		}
+	}
+	return "", errors.New("pulsedev: unable to read a revision of the working copy")
+}
+
+// Type implements Patcher.
+func (s *Svn) Type() PatchType { return PatchSvn }
@@ -13,14 +13,23 @@ type Client struct {
 	A   pulse.Agents
 	BI  int64
 	BR  []pulse.BuildResult
+	H   []pulse.BuildResult
 	I   bool
 	L   []pulse.BuildResult
 	M   pulse.Messages
+	PD  pulse.PersonalDetails
 	PS  pulse.ProjectStage
+	CS  []pulse.ProjectStage
+	PC  []pulse.ProjectCleanup
+	Q   []pulse.QueuedBuild
 	P   []string
 	S   []string
 	T   []string
 	D   time.Duration
+	Tok string
+	PF  pulse.ProgressFunc
+	AC  *pulse.ArtifactCache
+	LF  pulse.LoginFunc
 	i   int
 	rw  sync.RWMutex
 }
@@ -53,10 +62,22 @@ func (c *Client) BuildID(reqid string) (int64, error) {
 	return c.BI, c.err()
 }
 
+func (c *Client) BuildQueue() ([]pulse.QueuedBuild, error) {
+	return c.Q, c.err()
+}
+
 func (c *Client) BuildResult(project string, id int64) ([]pulse.BuildResult, error) {
 	return c.BR, c.err()
 }
 
+func (c *Client) BuildHistory(project string, n int) ([]pulse.BuildResult, error) {
+	return c.H, c.err()
+}
+
+func (c *Client) Cancel(project string, id int64) error {
+	return c.err()
+}
+
 func (c *Client) Clear(project string) error {
 	return c.err()
 }
@@ -65,10 +86,30 @@ func (c *Client) Close() error {
 	return c.err()
 }
 
+func (c *Client) Cleanup(project, name string) error {
+	return c.err()
+}
+
+func (c *Client) ConfigCleanup(project string) ([]pulse.ProjectCleanup, error) {
+	return c.PC, c.err()
+}
+
+func (c *Client) DeleteConfigCleanup(project, name string) error {
+	return c.err()
+}
+
+func (c *Client) SetConfigCleanup(project string, cl pulse.ProjectCleanup) error {
+	return c.err()
+}
+
 func (c *Client) ConfigStage(project, stage string) (pulse.ProjectStage, error) {
 	return c.PS, c.err()
 }
 
+func (c *Client) ConfigStages(project string) ([]pulse.ProjectStage, error) {
+	return c.CS, c.err()
+}
+
 func (c *Client) Init(project string) (bool, error) {
 	return c.I, c.err()
 }
@@ -81,6 +122,10 @@ func (c *Client) Messages(project string, id int64) (pulse.Messages, error) {
 	return c.M, c.err()
 }
 
+func (c *Client) PreparePersonalBuild(project string) (pulse.PersonalDetails, error) {
+	return c.PD, c.err()
+}
+
 func (c *Client) Projects() ([]string, error) {
 	return c.P, c.err()
 }
@@ -93,6 +138,22 @@ func (c *Client) SetTimeout(d time.Duration) {
 	c.D = d
 }
 
+func (c *Client) Token() string {
+	return c.Tok
+}
+
+func (c *Client) SetLogin(fn pulse.LoginFunc) {
+	c.LF = fn
+}
+
+func (c *Client) SetCache(ac *pulse.ArtifactCache) {
+	c.AC = ac
+}
+
+func (c *Client) SetProgress(fn pulse.ProgressFunc) {
+	c.PF = fn
+}
+
 func (c *Client) Stages(project string) ([]string, error) {
 	return c.S, c.err()
 }
@@ -105,6 +166,10 @@ func (c *Client) Artifact(id int64, project, dir, url string) error {
 	return c.err()
 }
 
+func (c *Client) Upload(id int64, project, name, url string, files []string) error {
+	return c.err()
+}
+
 func NewClient() *Client {
 	return &Client{}
 }
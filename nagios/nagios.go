@@ -0,0 +1,172 @@
+// Package nagios formats results of health checks as output of a Nagios
+// (or Icinga) plugin.
+package nagios
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var output io.Writer = os.Stdout
+var exit func(int) = os.Exit
+
+// Status is a status of a plugin, which is also its exit code.
+type Status int
+
+const (
+	OK Status = iota
+	Warning
+	Critical
+	Unknown
+)
+
+var status = [...]string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+func (s Status) String() string {
+	if s < OK || s > Unknown {
+		return status[Unknown]
+	}
+	return status[s]
+}
+
+// Threshold holds upper warning and critical thresholds of a metric. A metric
+// is in a warning or critical state when its value exceeds the threshold.
+// A nil threshold is not checked.
+type Threshold struct {
+	Warning  *int
+	Critical *int
+}
+
+// ParseThresholds parses comma-separated thresholds of metrics, each in
+// the "label=warning:critical" form, where either of thresholds may be empty,
+// e.g. "offline=:0,syncing=25:49".
+func ParseThresholds(s string) (map[string]Threshold, error) {
+	m := make(map[string]Threshold)
+	if s == "" {
+		return m, nil
+	}
+	for _, s := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(s), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("nagios: invalid threshold %q", s)
+		}
+		wc := strings.SplitN(kv[1], ":", 2)
+		if len(wc) != 2 {
+			return nil, fmt.Errorf("nagios: invalid threshold %q", s)
+		}
+		var t Threshold
+		for i, p := range []**int{&t.Warning, &t.Critical} {
+			if wc[i] == "" {
+				continue
+			}
+			n, err := strconv.Atoi(wc[i])
+			if err != nil {
+				return nil, fmt.Errorf("nagios: invalid threshold %q", s)
+			}
+			*p = &n
+		}
+		m[kv[0]] = t
+	}
+	return m, nil
+}
+
+// Metric is a single metric of a result, reported as performance data.
+type Metric struct {
+	Label string
+	Value int
+	// Unit is a unit of the value, e.g. "%", empty for a count.
+	Unit string
+	Threshold
+	Min *int
+	Max *int
+}
+
+// Status gives a status of the metric according to its thresholds.
+func (m *Metric) Status() Status {
+	switch {
+	case m.Critical != nil && m.Value > *m.Critical:
+		return Critical
+	case m.Warning != nil && m.Value > *m.Warning:
+		return Warning
+	}
+	return OK
+}
+
+// String gives the metric in the performance data format,
+// 'label'=value[unit];[warning];[critical];[min];[max].
+func (m *Metric) String() string {
+	label := m.Label
+	if strings.ContainsAny(label, " '=") {
+		label = "'" + strings.Replace(label, "'", "''", -1) + "'"
+	}
+	s := []string{strconv.Itoa(m.Value) + m.Unit, "", "", "", ""}
+	for i, p := range []*int{m.Warning, m.Critical, m.Min, m.Max} {
+		if p != nil {
+			s[i+1] = strconv.Itoa(*p)
+		}
+	}
+	return label + "=" + strings.TrimRight(strings.Join(s, ";"), ";")
+}
+
+// Result is a result of a health check.
+type Result struct {
+	// Text is a human-readable summary of the result.
+	Text    string
+	Metrics []Metric
+}
+
+// Status gives the worst status of the result's metrics.
+func (r *Result) Status() Status {
+	s := OK
+	for i := range r.Metrics {
+		if st := r.Metrics[i].Status(); st > s {
+			s = st
+		}
+	}
+	return s
+}
+
+// Write writes the result to w in the plugin output format.
+func (r *Result) Write(w io.Writer) error {
+	s := "PULSE " + r.Status().String()
+	if r.Text != "" {
+		s += " - " + r.Text
+	}
+	if len(r.Metrics) != 0 {
+		perf := make([]string, 0, len(r.Metrics))
+		for i := range r.Metrics {
+			perf = append(perf, r.Metrics[i].String())
+		}
+		s += " | " + strings.Join(perf, " ")
+	}
+	_, err := fmt.Fprintln(w, s)
+	return err
+}
+
+// Out reports a *Result when it is its only argument, exiting with the status
+// of the result, or an OK status otherwise.
+func Out(args ...interface{}) {
+	r, ok := (*Result)(nil), len(args) == 1
+	if ok {
+		r, ok = args[0].(*Result)
+	}
+	if !ok {
+		r = &Result{}
+	}
+	r.Write(output)
+	exit(int(r.Status()))
+}
+
+// Err reports an UNKNOWN status with a text made of its arguments, as it means
+// the check could not be performed.
+func Err(args ...interface{}) {
+	s := make([]string, 0, len(args))
+	for _, arg := range args {
+		s = append(s, fmt.Sprint(arg))
+	}
+	fmt.Fprintf(output, "PULSE %s - %s\n", Unknown, strings.Join(s, "; "))
+	exit(int(Unknown))
+}
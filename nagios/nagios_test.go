@@ -0,0 +1,89 @@
+package nagios
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func fixture() (*bytes.Buffer, *int) {
+	var (
+		buf  bytes.Buffer
+		code int
+	)
+	output, exit = &buf, func(n int) { code = n }
+	return &buf, &code
+}
+
+func intp(n int) *int { return &n }
+
+func TestParseThresholds(t *testing.T) {
+	th, err := ParseThresholds("offline=:0, syncing=25:49,tests=10:")
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	exp := map[string]Threshold{
+		"offline": {Critical: intp(0)},
+		"syncing": {Warning: intp(25), Critical: intp(49)},
+		"tests":   {Warning: intp(10)},
+	}
+	if !reflect.DeepEqual(th, exp) {
+		t.Errorf("expected thresholds to be %+v, was %+v instead", exp, th)
+	}
+	for _, s := range []string{"offline", "offline=1", "offline=a:b"} {
+		if _, err := ParseThresholds(s); err == nil {
+			t.Errorf("expected err to be non-nil for %q", s)
+		}
+	}
+}
+
+func TestOut(t *testing.T) {
+	table := []struct {
+		r    *Result
+		exp  string
+		code int
+	}{{
+		&Result{
+			Text: "OK",
+			Metrics: []Metric{
+				{Label: "offline", Value: 0, Threshold: Threshold{Critical: intp(0)}, Min: intp(0), Max: intp(3)},
+				{Label: "syncing", Value: 33, Unit: "%", Threshold: Threshold{intp(25), intp(49)}},
+			},
+		},
+		"PULSE WARNING - OK | offline=0;;0;0;3 syncing=33%;25;49\n",
+		1,
+	}, {
+		&Result{
+			Text:    "offline: A name 1@A host 1",
+			Metrics: []Metric{{Label: "offline agents", Value: 1, Threshold: Threshold{intp(0), intp(0)}}},
+		},
+		"PULSE CRITICAL - offline: A name 1@A host 1 | 'offline agents'=1;0;0\n",
+		2,
+	}, {
+		&Result{Metrics: []Metric{{Label: "tests", Value: 10}}},
+		"PULSE OK | tests=10\n",
+		0,
+	}}
+	for i, tt := range table {
+		buf, code := fixture()
+		Out(tt.r)
+		if buf.String() != tt.exp {
+			t.Errorf("expected buf to be %q, was %q instead (i=%d)", tt.exp, buf.String(), i)
+		}
+		if *code != tt.code {
+			t.Errorf("expected code to be %d, was %d instead (i=%d)", tt.code, *code, i)
+		}
+	}
+}
+
+func TestErr(t *testing.T) {
+	buf, code := fixture()
+	Err(errors.New("An error."), "A string")
+	if exp := "PULSE UNKNOWN - An error.; A string\n"; buf.String() != exp {
+		t.Errorf("expected buf to be %q, was %q instead", exp, buf.String())
+	}
+	if *code != 3 {
+		t.Errorf("expected code to be 3, was %d instead", *code)
+	}
+}
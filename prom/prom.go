@@ -0,0 +1,263 @@
+// Package prom exposes metrics of a Pulse server in the Prometheus text
+// exposition format.
+package prom
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/x-formation/pulsekit"
+)
+
+// ContentType is a content type of the Prometheus text exposition format.
+const ContentType = "text/plain; version=0.0.4"
+
+// Collector periodically collects metrics of a Pulse server and serves
+// the most recent ones over HTTP.
+type Collector struct {
+	// Client is used to communicate with a Pulse server.
+	Client pulse.Client
+	// Projects filters projects metrics are collected for, all projects
+	// if nil.
+	Projects func([]string) []string
+	// Interval is a time between two collections.
+	Interval time.Duration
+
+	mu   sync.RWMutex
+	data []byte // metrics of the last successful collection
+	last []byte // data followed by metrics of the last collection
+}
+
+// NewCollector gives a Collector, which collects metrics using the given
+// client every 30 seconds.
+func NewCollector(c pulse.Client) *Collector {
+	return &Collector{Client: c, Interval: 30 * time.Second}
+}
+
+// Run collects metrics every c.Interval until the stop channel is closed.
+func (c *Collector) Run(stop <-chan struct{}) {
+	for {
+		c.Collect()
+		select {
+		case <-stop:
+			return
+		case <-time.After(c.Interval):
+		}
+	}
+}
+
+// Collect collects metrics once, replacing the ones served by ServeHTTP.
+// When the collection fails the previously collected metrics are served,
+// with pulse_up reporting the failure.
+func (c *Collector) Collect() error {
+	start := time.Now()
+	var data, meta set
+	err := c.collect(&data)
+	meta.add("pulse_up", "Whether the last collection of metrics succeeded.", bool2f(err == nil))
+	meta.add("pulse_collect_duration_seconds", "Time the last collection of metrics took.",
+		time.Since(start).Seconds())
+	meta.add("pulse_collect_timestamp_seconds", "Time of the last collection of metrics.",
+		float64(start.Unix()))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		var buf bytes.Buffer
+		data.write(&buf)
+		c.data = buf.Bytes()
+	}
+	buf := bytes.NewBuffer(append([]byte(nil), c.data...))
+	meta.write(buf)
+	c.last = buf.Bytes()
+	return err
+}
+
+var statuses = []pulse.AgentStatus{
+	pulse.AgentOffline,
+	pulse.AgentSync,
+	pulse.AgentIdle,
+	pulse.AgentBuilding,
+	pulse.AgentDisabled,
+}
+
+func (c *Collector) collect(s *set) error {
+	a, err := c.Client.Agents()
+	if err != nil {
+		return err
+	}
+	for i := range a {
+		s.add("pulse_agent_status", "Status of the agent, 1 for the current one.", 1,
+			"agent", a[i].Name, "host", a[i].Host, "status", string(a[i].Status))
+	}
+	for _, st := range statuses {
+		n := len(a.Filter(func(a *pulse.Agent) bool { return a.Status == st }))
+		s.add("pulse_agents", "Number of agents with the status.", float64(n), "status", string(st))
+	}
+	q, err := c.Client.BuildQueue()
+	if err != nil {
+		return err
+	}
+	s.add("pulse_queue_depth", "Number of build requests waiting in the build queue.", float64(len(q)))
+	queued := make(map[string]int)
+	for i := range q {
+		queued[q[i].Project]++
+	}
+	projects := make([]string, 0, len(queued))
+	for p := range queued {
+		projects = append(projects, p)
+	}
+	sort.Strings(projects)
+	for _, p := range projects {
+		n := queued[p]
+		s.add("pulse_queue_builds", "Number of build requests of the project waiting in the build queue.",
+			float64(n), "project", p)
+	}
+	p, err := c.Client.Projects()
+	if err != nil {
+		return err
+	}
+	if c.Projects != nil {
+		p = c.Projects(p)
+	}
+	for _, p := range p {
+		b, err := c.Client.LatestBuildResult(p)
+		if err != nil {
+			if _, ok := err.(*pulse.InvalidBuildError); ok {
+				continue
+			}
+			return err
+		}
+		for i := range b {
+			build(s, p, &b[i])
+		}
+	}
+	return nil
+}
+
+func build(s *set, p string, b *pulse.BuildResult) {
+	s.add("pulse_build_id", "Number of the latest completed build of the project.", float64(b.ID),
+		"project", p)
+	s.add("pulse_build_success", "Whether the latest completed build of the project succeeded.",
+		bool2f(b.Success), "project", p)
+	s.add("pulse_build_state", "State of the latest completed build of the project, 1 for the current one.",
+		1, "project", p, "state", string(b.State))
+	if d, ok := duration(b.Start, b.End); ok {
+		s.add("pulse_build_duration_seconds", "Duration of the latest completed build of the project.",
+			d, "project", p)
+	}
+	tests(s, "pulse_build_tests", "Number of tests of the latest completed build of the project.",
+		&b.Test, "project", p)
+	for i := range b.Stages {
+		st := &b.Stages[i]
+		l := []string{"project", p, "stage", st.Name, "agent", st.Agent}
+		s.add("pulse_stage_success", "Whether the stage of the latest completed build succeeded.",
+			bool2f(st.Success), l...)
+		if d, ok := duration(st.Start, st.End); ok {
+			s.add("pulse_stage_duration_seconds", "Duration of the stage of the latest completed build.",
+				d, l...)
+		}
+		tests(s, "pulse_stage_tests", "Number of tests of the stage of the latest completed build.",
+			&st.Test, l...)
+	}
+}
+
+func tests(s *set, name, help string, t *pulse.TestSummary, l ...string) {
+	for _, r := range []struct {
+		name string
+		n    int
+	}{
+		{"total", t.Total},
+		{"passed", t.Passed},
+		{"failures", t.Failures},
+		{"errors", t.Errors},
+		{"skipped", t.Skipped},
+		{"expected_failures", t.ExpectedFailures},
+	} {
+		s.add(name, help, float64(r.n), append(l, "result", r.name)...)
+	}
+}
+
+func duration(start, end time.Time) (float64, bool) {
+	if start.IsZero() || end.IsZero() || end.Before(start) {
+		return 0, false
+	}
+	return end.Sub(start).Seconds(), true
+}
+
+func bool2f(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// ServeHTTP serves the most recently collected metrics.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.RLock()
+	last := c.last
+	c.mu.RUnlock()
+	if last == nil {
+		http.Error(w, "pulse: metrics not collected yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", ContentType)
+	w.Write(last)
+}
+
+// metric is a single metric family with all its samples.
+type metric struct {
+	name    string
+	help    string
+	samples []string
+}
+
+// set is an ordered set of metric families.
+type set struct {
+	m []*metric
+}
+
+// add adds a sample of the metric with the given labels, given as name
+// and value pairs.
+func (s *set) add(name, help string, v float64, labels ...string) {
+	var m *metric
+	for _, mm := range s.m {
+		if mm.name == name {
+			m = mm
+			break
+		}
+	}
+	if m == nil {
+		m = &metric{name: name, help: help}
+		s.m = append(s.m, m)
+	}
+	var l string
+	if len(labels) != 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], escape(labels[i+1])))
+		}
+		l = "{" + strings.Join(pairs, ",") + "}"
+	}
+	m.samples = append(m.samples, name+l+" "+strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+func (s *set) write(buf *bytes.Buffer) {
+	for _, m := range s.m {
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s gauge\n", m.name, m.help, m.name)
+		for _, sample := range m.samples {
+			buf.WriteString(sample)
+			buf.WriteByte('\n')
+		}
+	}
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
@@ -0,0 +1,111 @@
+package prom
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/x-formation/pulsekit"
+	"github.com/x-formation/pulsekit/mock"
+)
+
+func fixture() *mock.Client {
+	mc := mock.NewClient()
+	mc.A = pulse.Agents{
+		{Name: "Linux x86", Status: pulse.AgentIdle, Host: "linux86:8090"},
+		{Name: "Windows", Status: pulse.AgentOffline, Host: "win:8090"},
+	}
+	mc.Q = []pulse.QueuedBuild{{Project: "Pulse CLI"}, {Project: "Pulse CLI"}, {Project: "C++"}}
+	mc.P = []string{"Pulse CLI"}
+	start := time.Date(2014, 7, 1, 12, 0, 0, 0, time.UTC)
+	mc.L = []pulse.BuildResult{{
+		ID:      130,
+		Success: false,
+		State:   pulse.BuildFailure,
+		Start:   start,
+		End:     start.Add(90 * time.Second),
+		Test:    pulse.TestSummary{Total: 10, Passed: 9, Failures: 1},
+		Stages: []pulse.StageResult{{
+			Name:    `Build - "Linux" x86`,
+			Agent:   "Linux x86",
+			Success: false,
+			Start:   start,
+			End:     start.Add(60 * time.Second),
+		}},
+	}}
+	return mc
+}
+
+func TestCollect(t *testing.T) {
+	mc := fixture()
+	mc.Err = make([]error, 4)
+	c := NewCollector(mc)
+	if err := c.Collect(); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	mc.Check(t)
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, &http.Request{})
+	if ct := rec.HeaderMap.Get("Content-Type"); ct != ContentType {
+		t.Errorf("expected Content-Type to be %q, was %q instead", ContentType, ct)
+	}
+	out := rec.Body.String()
+	samples := []string{
+		"# TYPE pulse_agents gauge\n",
+		`pulse_agent_status{agent="Windows",host="win:8090",status="offline"} 1` + "\n",
+		`pulse_agents{status="offline"} 1` + "\n",
+		`pulse_agents{status="building"} 0` + "\n",
+		"pulse_queue_depth 3\n",
+		`pulse_queue_builds{project="C++"} 1` + "\n",
+		`pulse_queue_builds{project="Pulse CLI"} 2` + "\n",
+		`pulse_build_id{project="Pulse CLI"} 130` + "\n",
+		`pulse_build_success{project="Pulse CLI"} 0` + "\n",
+		`pulse_build_state{project="Pulse CLI",state="failure"} 1` + "\n",
+		`pulse_build_duration_seconds{project="Pulse CLI"} 90` + "\n",
+		`pulse_build_tests{project="Pulse CLI",result="failures"} 1` + "\n",
+		`pulse_stage_duration_seconds{project="Pulse CLI",stage="Build - \"Linux\" x86",agent="Linux x86"} 60` + "\n",
+		"pulse_up 1\n",
+	}
+	for _, s := range samples {
+		if !strings.Contains(out, s) {
+			t.Errorf("expected output to contain %q, was %q instead", s, out)
+		}
+	}
+	if n := strings.Count(out, "# TYPE pulse_agents gauge"); n != 1 {
+		t.Errorf("expected pulse_agents to be described once, was %d times instead", n)
+	}
+}
+
+func TestCollectErr(t *testing.T) {
+	mc := fixture()
+	mc.Err = make([]error, 5)
+	mc.Err[4] = errors.New("err")
+	c := NewCollector(mc)
+	if err := c.Collect(); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	if err := c.Collect(); err == nil {
+		t.Fatal("expected err to be non-nil")
+	}
+	mc.Check(t)
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, &http.Request{})
+	out := rec.Body.String()
+	if !strings.Contains(out, "pulse_up 0\n") {
+		t.Errorf("expected pulse_up to be 0, was %q instead", out)
+	}
+	if !strings.Contains(out, `pulse_build_id{project="Pulse CLI"} 130`) {
+		t.Errorf("expected previous metrics to be kept, was %q instead", out)
+	}
+}
+
+func TestServeHTTPNotCollected(t *testing.T) {
+	rec := httptest.NewRecorder()
+	NewCollector(mock.NewClient()).ServeHTTP(rec, &http.Request{})
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status to be %d, was %d instead", http.StatusServiceUnavailable, rec.Code)
+	}
+}
@@ -0,0 +1,134 @@
+package prtg
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Format is an output format of an advanced sensor.
+type Format string
+
+const (
+	FormatXML  Format = "xml"
+	FormatJSON Format = "json"
+)
+
+// Unit units of channel values.
+const (
+	UnitCount   = "Count"
+	UnitPercent = "Percent"
+)
+
+// Channel is a single channel of an advanced sensor.
+type Channel struct {
+	Name       string `xml:"channel" json:"channel"`
+	Value      int    `xml:"value" json:"value"`
+	Unit       string `xml:"unit,omitempty" json:"unit,omitempty"`
+	LimitMode  int    `xml:"limitmode,omitempty" json:"limitmode,omitempty"`
+	MaxWarning *int   `xml:"limitmaxwarning,omitempty" json:"limitmaxwarning,omitempty"`
+	MaxError   *int   `xml:"limitmaxerror,omitempty" json:"limitmaxerror,omitempty"`
+}
+
+// Limit sets upper warning and error limits of the channel, PRTG changes
+// a state of the channel when its value exceeds them. A nil limit is not set.
+func (c *Channel) Limit(l Limit) {
+	if c.MaxWarning, c.MaxError = l.Warning, l.Error; l.Warning != nil || l.Error != nil {
+		c.LimitMode = 1
+	}
+}
+
+// Limit holds upper warning and error limits of a channel.
+type Limit struct {
+	Warning *int
+	Error   *int
+}
+
+// ParseLimits parses comma-separated limits of channels, each in
+// the "name=warning:error" form, where either of limits may be empty,
+// e.g. "offline=:0,syncing=2:4".
+func ParseLimits(s string) (map[string]Limit, error) {
+	m := make(map[string]Limit)
+	if s == "" {
+		return m, nil
+	}
+	for _, s := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(s), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("prtg: invalid limit %q", s)
+		}
+		wr := strings.SplitN(kv[1], ":", 2)
+		if len(wr) != 2 {
+			return nil, fmt.Errorf("prtg: invalid limit %q", s)
+		}
+		var l Limit
+		for i, p := range []**int{&l.Warning, &l.Error} {
+			if wr[i] == "" {
+				continue
+			}
+			var n int
+			if _, err := fmt.Sscanf(wr[i], "%d", &n); err != nil {
+				return nil, fmt.Errorf("prtg: invalid limit %q", s)
+			}
+			*p = &n
+		}
+		m[kv[0]] = l
+	}
+	return m, nil
+}
+
+// Sensor is a result of an advanced sensor.
+type Sensor struct {
+	XMLName xml.Name  `xml:"prtg" json:"-"`
+	Result  []Channel `xml:"result" json:"result,omitempty"`
+	Text    string    `xml:"text,omitempty" json:"text,omitempty"`
+	Error   int       `xml:"error,omitempty" json:"error,omitempty"`
+}
+
+// Encode writes the sensor result to w in the given format.
+func (s *Sensor) Encode(w io.Writer, f Format) error {
+	if f == FormatJSON {
+		return json.NewEncoder(w).Encode(struct {
+			PRTG *Sensor `json:"prtg"`
+		}{s})
+	}
+	b, err := xml.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// Advanced gives Out and Err functions, which report a result in the advanced
+// sensor format. The out function reports a *Sensor when it is its only
+// argument, or a successful result otherwise. The err function reports
+// an error with a text made of its arguments.
+func Advanced(f Format) (out, err func(...interface{})) {
+	out = func(args ...interface{}) {
+		s, ok := (*Sensor)(nil), len(args) == 1
+		if ok {
+			s, ok = args[0].(*Sensor)
+		}
+		if !ok {
+			s = &Sensor{Result: []Channel{{Name: "Success", Value: 1}}, Text: "OK"}
+		}
+		if e := s.Encode(output, f); e != nil {
+			fmt.Fprintln(output, e)
+			exit(1)
+			return
+		}
+		exit(0)
+	}
+	err = func(args ...interface{}) {
+		s := make([]string, 0, len(args))
+		for _, arg := range args {
+			s = append(s, str(arg))
+		}
+		(&Sensor{Error: 1, Text: strings.Join(s, "; ")}).Encode(output, f)
+		exit(1)
+	}
+	return
+}
@@ -17,20 +17,23 @@ func Out(_ ...interface{}) {
 }
 
 func Err(args ...interface{}) {
-	s, str := make([]string, 0, len(args)), ""
+	s := make([]string, 0, len(args))
 	for _, arg := range args {
-		switch arg := arg.(type) {
-		case string:
-			str = arg
-		case fmt.Stringer:
-			str = arg.String()
-		case error:
-			str = arg.Error()
-		default:
-			str = fmt.Sprintf("%v", arg)
-		}
-		s = append(s, strconv.Quote(str))
+		s = append(s, strconv.Quote(str(arg)))
 	}
 	fmt.Fprintf(output, "2:1:%s\n", strings.Join(s, " "))
 	exit(1)
 }
+
+func str(arg interface{}) string {
+	switch arg := arg.(type) {
+	case string:
+		return arg
+	case fmt.Stringer:
+		return arg.String()
+	case error:
+		return arg.Error()
+	default:
+		return fmt.Sprintf("%v", arg)
+	}
+}
@@ -3,6 +3,7 @@ package prtg
 import (
 	"bytes"
 	"errors"
+	"reflect"
 	"testing"
 
 	"github.com/x-formation/pulsekit"
@@ -52,3 +53,70 @@ func TestErr(t *testing.T) {
 		}
 	}
 }
+
+func intp(n int) *int { return &n }
+
+func TestParseLimits(t *testing.T) {
+	l, err := ParseLimits("offline=:0, syncing=2:4,tests=10:")
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	exp := map[string]Limit{
+		"offline": {Error: intp(0)},
+		"syncing": {Warning: intp(2), Error: intp(4)},
+		"tests":   {Warning: intp(10)},
+	}
+	if !reflect.DeepEqual(l, exp) {
+		t.Errorf("expected limits to be %+v, was %+v instead", exp, l)
+	}
+	for _, s := range []string{"offline", "offline=1", "offline=a:b"} {
+		if _, err := ParseLimits(s); err == nil {
+			t.Errorf("expected err to be non-nil for %q", s)
+		}
+	}
+}
+
+func TestAdvanced(t *testing.T) {
+	s := &Sensor{
+		Result: []Channel{{Name: "Offline agents", Value: 2, Unit: UnitCount}},
+		Text:   "offline: A name 1@A host 1",
+	}
+	s.Result[0].Limit(Limit{Error: intp(0)})
+	table := []struct {
+		f   Format
+		exp string
+	}{{
+		FormatXML,
+		"<prtg>\n  <result>\n    <channel>Offline agents</channel>\n    <value>2</value>\n" +
+			"    <unit>Count</unit>\n    <limitmode>1</limitmode>\n    <limitmaxerror>0</limitmaxerror>\n" +
+			"  </result>\n  <text>offline: A name 1@A host 1</text>\n</prtg>\n",
+	}, {
+		FormatJSON,
+		`{"prtg":{"result":[{"channel":"Offline agents","value":2,"unit":"Count","limitmode":1,` +
+			`"limitmaxerror":0}],"text":"offline: A name 1@A host 1"}}` + "\n",
+	}}
+	for i, tt := range table {
+		buf, code := fixture()
+		out, _ := Advanced(tt.f)
+		out(s)
+		if buf.String() != tt.exp {
+			t.Errorf("expected buf to be %q, was %q instead (i=%d)", tt.exp, buf.String(), i)
+		}
+		if *code != 0 {
+			t.Errorf("expected code to be 0, was %d instead (i=%d)", *code, i)
+		}
+	}
+}
+
+func TestAdvancedErr(t *testing.T) {
+	buf, code := fixture()
+	_, err := Advanced(FormatJSON)
+	err(errors.New("An error."), "A string")
+	exp := `{"prtg":{"text":"An error.; A string","error":1}}` + "\n"
+	if buf.String() != exp {
+		t.Errorf("expected buf to be %q, was %q instead", exp, buf.String())
+	}
+	if *code != 1 {
+		t.Errorf("expected code to be 1, was %d instead", *code)
+	}
+}
@@ -0,0 +1,125 @@
+package report
+
+import (
+	"sort"
+
+	"github.com/x-formation/pulsekit"
+)
+
+// Flaky describes a stage or a command of a stage, which result changed
+// between consecutive builds of the same revision.
+type Flaky struct {
+	Project string `json:"project"`
+	Stage   string `json:"stage"`
+	// Command is a name of the command, empty for the whole stage.
+	Command string `json:"command,omitempty"`
+	// Runs is a number of completed runs.
+	Runs     int `json:"runs"`
+	Failures int `json:"failures"`
+	// Pairs is a number of consecutive runs, which built the same revision.
+	Pairs int `json:"pairs"`
+	// Flips is a number of the pairs, which results differ.
+	Flips int `json:"flips"`
+	// FlipRate is a ratio of the flips to the pairs.
+	FlipRate float64 `json:"flip_rate"`
+	// Builds are IDs of builds, which result differs from the previous one.
+	Builds []int64 `json:"builds"`
+	// Revisions are revisions the result changed on.
+	Revisions []string `json:"revisions"`
+}
+
+type run struct {
+	id       int64
+	revision string
+	success  bool
+}
+
+// FindFlaky finds stages and commands of the project, which result changed
+// between consecutive builds of the same revision, ranked from the flakiest
+// one. Builds, which are not complete, are skipped, as well as runs, which
+// did not complete or were skipped.
+func FindFlaky(project string, builds []pulse.BuildResult) []Flaky {
+	b := make([]pulse.BuildResult, 0, len(builds))
+	for i := range builds {
+		if builds[i].Complete {
+			b = append(b, builds[i])
+		}
+	}
+	sort.Sort(byID(b))
+	type key struct{ stage, command string }
+	runs := make(map[key][]run)
+	var keys []key
+	add := func(k key, r run) {
+		if _, ok := runs[k]; !ok {
+			keys = append(keys, k)
+		}
+		runs[k] = append(runs[k], r)
+	}
+	for i := range b {
+		for j := range b[i].Stages {
+			st := &b[i].Stages[j]
+			if !st.Complete || st.State == pulse.BuildSkipped {
+				continue
+			}
+			add(key{st.Name, ""}, run{b[i].ID, b[i].Revision, st.Success})
+			for k := range st.Command {
+				cmd := &st.Command[k]
+				if cmd.Complete {
+					add(key{st.Name, cmd.Name}, run{b[i].ID, b[i].Revision, cmd.Success})
+				}
+			}
+		}
+	}
+	var flaky []Flaky
+	for _, k := range keys {
+		f := Flaky{Project: project, Stage: k.stage, Command: k.command}
+		r := runs[k]
+		for i := range r {
+			f.Runs++
+			if !r[i].success {
+				f.Failures++
+			}
+			// A build of an unknown revision is not known to have no changes.
+			if i == 0 || r[i].revision == "" || r[i].revision != r[i-1].revision {
+				continue
+			}
+			f.Pairs++
+			if r[i].success != r[i-1].success {
+				f.Flips++
+				f.Builds = append(f.Builds, r[i].id)
+				if n := len(f.Revisions); n == 0 || f.Revisions[n-1] != r[i].revision {
+					f.Revisions = append(f.Revisions, r[i].revision)
+				}
+			}
+		}
+		if f.Flips != 0 {
+			f.FlipRate = rate(f.Flips, f.Pairs)
+			flaky = append(flaky, f)
+		}
+	}
+	SortFlaky(flaky)
+	return flaky
+}
+
+// SortFlaky sorts the stages and commands from the flakiest one.
+func SortFlaky(f []Flaky) {
+	sort.Sort(byFlakiness(f))
+}
+
+type byFlakiness []Flaky
+
+func (f byFlakiness) Len() int      { return len(f) }
+func (f byFlakiness) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+func (f byFlakiness) Less(i, j int) bool {
+	switch {
+	case f[i].FlipRate != f[j].FlipRate:
+		return f[i].FlipRate > f[j].FlipRate
+	case f[i].Flips != f[j].Flips:
+		return f[i].Flips > f[j].Flips
+	case f[i].Project != f[j].Project:
+		return f[i].Project < f[j].Project
+	case f[i].Stage != f[j].Stage:
+		return f[i].Stage < f[j].Stage
+	}
+	return f[i].Command < f[j].Command
+}
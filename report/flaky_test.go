@@ -0,0 +1,73 @@
+package report
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/x-formation/pulsekit"
+)
+
+func flakyBuild(id int64, rev string, test, lint bool) pulse.BuildResult {
+	return pulse.BuildResult{
+		ID:       id,
+		Complete: true,
+		Revision: rev,
+		Stages: []pulse.StageResult{{
+			Name:     "Test",
+			Complete: true,
+			Success:  test && lint,
+			Command: []pulse.CommandResult{
+				{Name: "go test", Complete: true, Success: test},
+				{Name: "golint", Complete: true, Success: lint},
+			},
+		}, {
+			Name:     "Build",
+			Complete: true,
+			Success:  true,
+		}},
+	}
+}
+
+func TestFindFlaky(t *testing.T) {
+	builds := []pulse.BuildResult{
+		flakyBuild(6, "c2", true, true),
+		flakyBuild(5, "c2", false, true),
+		flakyBuild(4, "c1", true, false),
+		flakyBuild(3, "c1", true, true),
+		flakyBuild(2, "c1", false, true),
+		flakyBuild(1, "c0", true, false),
+		{ID: 7, Revision: "c2"},
+	}
+	f := FindFlaky("Pulse CLI", builds)
+	if len(f) != 3 {
+		t.Fatalf("expected 3 flaky runs, was %+v instead", f)
+	}
+	exp := []struct {
+		command string
+		flips   int
+		builds  []int64
+	}{
+		{"", 3, []int64{3, 4, 6}},
+		{"go test", 2, []int64{3, 6}},
+		{"golint", 1, []int64{4}},
+	}
+	for i, exp := range exp {
+		if f[i].Stage != "Test" || f[i].Command != exp.command || f[i].Flips != exp.flips ||
+			f[i].Pairs != 3 || f[i].Runs != 6 || !reflect.DeepEqual(f[i].Builds, exp.builds) {
+			t.Errorf("expected %+v, was %+v instead (i=%d)", exp, f[i], i)
+		}
+	}
+	if rev := f[0].Revisions; !reflect.DeepEqual(rev, []string{"c1", "c2"}) {
+		t.Errorf("expected flips on c1 and c2, was %v instead", rev)
+	}
+}
+
+func TestFindFlakyUnknownRevision(t *testing.T) {
+	builds := []pulse.BuildResult{
+		flakyBuild(2, "", true, true),
+		flakyBuild(1, "", false, true),
+	}
+	if f := FindFlaky("Pulse CLI", builds); len(f) != 0 {
+		t.Errorf("expected no flaky runs, was %+v instead", f)
+	}
+}
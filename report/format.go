@@ -0,0 +1,154 @@
+package report
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// Format is an output format of a report.
+type Format string
+
+const (
+	FormatText Format = "text"
+	FormatCSV  Format = "csv"
+	FormatJSON Format = "json"
+	FormatHTML Format = "html"
+)
+
+// ParseFormat gives a format of the given name.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case FormatText, FormatCSV, FormatJSON, FormatHTML:
+		return f, nil
+	}
+	return "", fmt.Errorf("pulse: invalid report format %q", s)
+}
+
+// Write writes the report in the given format.
+func (r *Report) Write(w io.Writer, f Format) error {
+	switch f {
+	case FormatText:
+		return r.text(w)
+	case FormatCSV:
+		return r.csv(w)
+	case FormatJSON:
+		b, err := json.MarshalIndent(r, "", "\t")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(b, '\n'))
+		return err
+	case FormatHTML:
+		return page.Execute(w, r)
+	}
+	return fmt.Errorf("pulse: invalid report format %q", f)
+}
+
+func percent(f float64) string {
+	return strconv.FormatFloat(100*f, 'f', 1, 64) + "%"
+}
+
+func (r *Report) text(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Builds from %s to %s\n", r.Since.Format(time.RFC1123), r.Until.Format(time.RFC1123))
+	fmt.Fprintf(tw, "\nPROJECT\tBUILDS\tFAILURES\tSUCCESS\tMEAN\tP95\n")
+	for _, p := range r.Projects {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%v\t%v\n", p.Project, p.Builds, p.Failures,
+			percent(p.SuccessRate), p.Mean, p.P95)
+	}
+	fmt.Fprintf(tw, "\nPROJECT\tSTAGE\tRUNS\tFAILURES\tMEAN\tP95\n")
+	for _, s := range r.Stages {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%v\t%v\n", s.Project, s.Stage, s.Runs, s.Failures, s.Mean, s.P95)
+	}
+	fmt.Fprintf(tw, "\nFLAKY STAGE\tCOMMAND\tPROJECT\tFLIPS\tFLIP RATE\n")
+	for _, f := range r.Flaky {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", f.Stage, f.Command, f.Project, f.Flips, percent(f.FlipRate))
+	}
+	fmt.Fprintf(tw, "\nAGENT\tSTAGES\tBUSY\tUTILISATION\n")
+	for _, a := range r.Agents {
+		fmt.Fprintf(tw, "%s\t%d\t%v\t%s\n", a.Agent, a.Stages, a.Busy, percent(a.Utilisation))
+	}
+	return tw.Flush()
+}
+
+// csv writes every statistic as a single record, the first field of which
+// tells the kind of the statistic - "project", "stage", "flaky" or "agent".
+func (r *Report) csv(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"kind", "project", "stage", "command", "agent", "runs", "failures", "success_rate",
+		"mean_seconds", "p95_seconds", "flips", "flip_rate", "busy_seconds", "utilisation"})
+	sec := func(d Duration) string {
+		return strconv.FormatFloat(time.Duration(d).Seconds(), 'f', -1, 64)
+	}
+	f := func(f float64) string {
+		return strconv.FormatFloat(f, 'f', 4, 64)
+	}
+	for _, p := range r.Projects {
+		cw.Write([]string{"project", p.Project, "", "", "", strconv.Itoa(p.Builds), strconv.Itoa(p.Failures),
+			f(p.SuccessRate), sec(p.Mean), sec(p.P95), "", "", "", ""})
+	}
+	for _, s := range r.Stages {
+		cw.Write([]string{"stage", s.Project, s.Stage, "", "", strconv.Itoa(s.Runs), strconv.Itoa(s.Failures),
+			"", sec(s.Mean), sec(s.P95), "", "", "", ""})
+	}
+	for _, fl := range r.Flaky {
+		cw.Write([]string{"flaky", fl.Project, fl.Stage, fl.Command, "", strconv.Itoa(fl.Runs),
+			strconv.Itoa(fl.Failures), "", "", "", strconv.Itoa(fl.Flips), f(fl.FlipRate), "", ""})
+	}
+	for _, a := range r.Agents {
+		cw.Write([]string{"agent", "", "", "", a.Agent, strconv.Itoa(a.Stages), "", "", "", "", "", "",
+			sec(a.Busy), f(a.Utilisation)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+var page = template.Must(template.New("report").Funcs(template.FuncMap{
+	"percent": percent,
+	"date":    func(t time.Time) string { return t.Format(time.RFC1123) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Pulse report {{date .Since}} - {{date .Until}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { padding: 0.3em 0.8em; border-bottom: 1px solid #ddd; text-align: left; }
+th { background: #f0f0f0; }
+td.num { text-align: right; }
+.bad { color: #b22; }
+</style>
+</head>
+<body>
+<h1>Pulse report</h1>
+<p>Builds from {{date .Since}} to {{date .Until}}</p>
+<h2>Projects</h2>
+<table>
+<tr><th>Project</th><th>Builds</th><th>Failures</th><th>Success</th><th>Mean</th><th>P95</th></tr>
+{{range .Projects}}<tr><td>{{.Project}}</td><td class="num">{{.Builds}}</td><td class="num{{if .Failures}} bad{{end}}">{{.Failures}}</td><td class="num">{{percent .SuccessRate}}</td><td class="num">{{.Mean}}</td><td class="num">{{.P95}}</td></tr>
+{{end}}</table>
+<h2>Stages</h2>
+<table>
+<tr><th>Project</th><th>Stage</th><th>Runs</th><th>Failures</th><th>Mean</th><th>P95</th></tr>
+{{range .Stages}}<tr><td>{{.Project}}</td><td>{{.Stage}}</td><td class="num">{{.Runs}}</td><td class="num{{if .Failures}} bad{{end}}">{{.Failures}}</td><td class="num">{{.Mean}}</td><td class="num">{{.P95}}</td></tr>
+{{end}}</table>
+<h2>Flakiest stages</h2>
+<table>
+<tr><th>Stage</th><th>Command</th><th>Project</th><th>Flips</th><th>Flip rate</th></tr>
+{{range .Flaky}}<tr><td>{{.Stage}}</td><td>{{.Command}}</td><td>{{.Project}}</td><td class="num">{{.Flips}}</td><td class="num">{{percent .FlipRate}}</td></tr>
+{{end}}</table>
+<h2>Agents</h2>
+<table>
+<tr><th>Agent</th><th>Stages</th><th>Busy</th><th>Utilisation</th></tr>
+{{range .Agents}}<tr><td>{{.Agent}}</td><td class="num">{{.Stages}}</td><td class="num">{{.Busy}}</td><td>{{percent .Utilisation}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,296 @@
+// Package report aggregates build history of a Pulse server into statistics
+// of projects, stages and agents.
+package report
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/x-formation/pulsekit"
+)
+
+// Duration is a time.Duration, which is encoded in JSON as a number
+// of seconds.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d - d%Duration(time.Second)).String()
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.FormatFloat(time.Duration(d).Seconds(), 'f', -1, 64)), nil
+}
+
+// ProjectStats are statistics of builds of a project.
+type ProjectStats struct {
+	Project     string   `json:"project"`
+	Builds      int      `json:"builds"`
+	Failures    int      `json:"failures"`
+	SuccessRate float64  `json:"success_rate"`
+	Mean        Duration `json:"mean_seconds"`
+	P95         Duration `json:"p95_seconds"`
+}
+
+// StageStats are statistics of runs of a stage of a project.
+type StageStats struct {
+	Project  string   `json:"project"`
+	Stage    string   `json:"stage"`
+	Runs     int      `json:"runs"`
+	Failures int      `json:"failures"`
+	Mean     Duration `json:"mean_seconds"`
+	P95      Duration `json:"p95_seconds"`
+}
+
+// AgentStats are statistics of stages run by an agent.
+type AgentStats struct {
+	Agent  string   `json:"agent"`
+	Stages int      `json:"stages"`
+	Busy   Duration `json:"busy_seconds"`
+	// Utilisation is a ratio of the busy time to the reported period.
+	Utilisation float64 `json:"utilisation"`
+}
+
+// Report are statistics of completed builds, which started within a period.
+type Report struct {
+	Since    time.Time      `json:"since"`
+	Until    time.Time      `json:"until"`
+	Projects []ProjectStats `json:"projects"`
+	Stages   []StageStats   `json:"stages"`
+	// Flaky are stages and commands, which result changes the most often
+	// between builds of the same revision, see FindFlaky.
+	Flaky  []Flaky      `json:"flaky"`
+	Agents []AgentStats `json:"agents"`
+}
+
+// MaxFlaky is a maximum number of the flakiest stages and commands in a report.
+const MaxFlaky = 10
+
+// New aggregates the builds of every project into a report for the given
+// period. Incomplete builds and builds, which started out of the period, are
+// skipped.
+func New(builds map[string][]pulse.BuildResult, since, until time.Time) *Report {
+	r := &Report{Since: since, Until: until}
+	names := make([]string, 0, len(builds))
+	for p := range builds {
+		names = append(names, p)
+	}
+	sort.Strings(names)
+	agents := make(map[string]*AgentStats)
+	for _, p := range names {
+		b := completed(builds[p], since, until)
+		if len(b) == 0 {
+			continue
+		}
+		ps := ProjectStats{Project: p, Builds: len(b)}
+		var d []time.Duration
+		stages := make(map[string][]*pulse.StageResult)
+		var order []string
+		for i := range b {
+			if !b[i].Success {
+				ps.Failures++
+			}
+			if dur, ok := duration(b[i].Start, b[i].End); ok {
+				d = append(d, dur)
+			}
+			for j := range b[i].Stages {
+				st := &b[i].Stages[j]
+				dur, ok := duration(st.Start, st.End)
+				if !ok || st.State == pulse.BuildSkipped {
+					continue
+				}
+				if _, ok := stages[st.Name]; !ok {
+					order = append(order, st.Name)
+				}
+				stages[st.Name] = append(stages[st.Name], st)
+				if st.Agent == "" || st.Agent == pulse.AgentPending {
+					continue
+				}
+				a, ok := agents[st.Agent]
+				if !ok {
+					a = &AgentStats{Agent: st.Agent}
+					agents[st.Agent] = a
+				}
+				a.Stages++
+				a.Busy += Duration(dur)
+			}
+		}
+		ps.SuccessRate = rate(ps.Builds-ps.Failures, ps.Builds)
+		ps.Mean, ps.P95 = Duration(Mean(d)), Duration(Percentile(d, 95))
+		r.Projects = append(r.Projects, ps)
+		sort.Strings(order)
+		for _, name := range order {
+			r.Stages = append(r.Stages, stageStats(p, name, stages[name]))
+		}
+		r.Flaky = append(r.Flaky, FindFlaky(p, b)...)
+	}
+	SortFlaky(r.Flaky)
+	if len(r.Flaky) > MaxFlaky {
+		r.Flaky = r.Flaky[:MaxFlaky]
+	}
+	period := until.Sub(since)
+	for _, a := range agents {
+		if period > 0 {
+			a.Utilisation = math.Min(1, float64(a.Busy)/float64(period))
+		}
+		r.Agents = append(r.Agents, *a)
+	}
+	sort.Sort(byAgent(r.Agents))
+	return r
+}
+
+// completed gives the completed builds, which started within the period,
+// ordered by their IDs.
+func completed(b []pulse.BuildResult, since, until time.Time) []pulse.BuildResult {
+	c := make([]pulse.BuildResult, 0, len(b))
+	for i := range b {
+		if b[i].Complete && !b[i].Start.Before(since) && b[i].Start.Before(until) {
+			c = append(c, b[i])
+		}
+	}
+	sort.Sort(byID(c))
+	return c
+}
+
+// stageStats gives statistics of the runs of a stage.
+func stageStats(project, stage string, runs []*pulse.StageResult) StageStats {
+	s := StageStats{Project: project, Stage: stage, Runs: len(runs)}
+	d := make([]time.Duration, 0, len(runs))
+	for _, st := range runs {
+		if !st.Success {
+			s.Failures++
+		}
+		dur, _ := duration(st.Start, st.End)
+		d = append(d, dur)
+	}
+	s.Mean, s.P95 = Duration(Mean(d)), Duration(Percentile(d, 95))
+	return s
+}
+
+func duration(start, end time.Time) (time.Duration, bool) {
+	if start.IsZero() || end.IsZero() || end.Before(start) {
+		return 0, false
+	}
+	return end.Sub(start), true
+}
+
+func rate(n, total int) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+// Mean gives an arithmetic mean of the durations, 0 if there are none.
+func Mean(d []time.Duration) time.Duration {
+	if len(d) == 0 {
+		return 0
+	}
+	var sum time.Duration
+	for _, d := range d {
+		sum += d
+	}
+	return sum / time.Duration(len(d))
+}
+
+// Percentile gives the p-th percentile of the durations using the nearest-rank
+// method, 0 if there are none.
+func Percentile(d []time.Duration, p float64) time.Duration {
+	if len(d) == 0 {
+		return 0
+	}
+	s := make(durations, len(d))
+	copy(s, d)
+	sort.Sort(s)
+	i := int(math.Ceil(p/100*float64(len(s)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return s[i]
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+type byID []pulse.BuildResult
+
+func (b byID) Len() int           { return len(b) }
+func (b byID) Less(i, j int) bool { return b[i].ID < b[j].ID }
+func (b byID) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+type byAgent []AgentStats
+
+func (a byAgent) Len() int           { return len(a) }
+func (a byAgent) Less(i, j int) bool { return a[i].Agent < a[j].Agent }
+func (a byAgent) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// History gives builds of the project, which started since the given time.
+// Builds are requested in growing batches until the oldest one started before
+// that time.
+func History(c pulse.Client, project string, since time.Time) ([]pulse.BuildResult, error) {
+	for n := 50; ; n *= 2 {
+		b, err := c.BuildHistory(project, n)
+		if err != nil {
+			if _, ok := err.(*pulse.InvalidBuildError); ok {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if len(b) < n || oldest(b).Before(since) {
+			return b, nil
+		}
+	}
+}
+
+func oldest(b []pulse.BuildResult) time.Time {
+	t := b[0].Start
+	for i := range b {
+		if !b[i].Start.IsZero() && b[i].Start.Before(t) {
+			t = b[i].Start
+		}
+	}
+	return t
+}
+
+// Collect requests history of every project and aggregates builds, which
+// started within the last period, into a report.
+func Collect(c pulse.Client, projects []string, period time.Duration) (*Report, error) {
+	until := time.Now()
+	since := until.Add(-period)
+	builds := make(map[string][]pulse.BuildResult, len(projects))
+	for _, p := range projects {
+		b, err := History(c, p, since)
+		if err != nil {
+			return nil, err
+		}
+		builds[p] = b
+	}
+	return New(builds, since, until), nil
+}
+
+// ParsePeriod parses a period like time.ParseDuration does, accepting also
+// days and weeks, e.g. "7d" or "2w".
+func ParsePeriod(s string) (time.Duration, error) {
+	if n := len(s); n > 1 && (s[n-1] == 'd' || s[n-1] == 'w') {
+		v, err := strconv.ParseFloat(s[:n-1], 64)
+		if err != nil || v < 0 {
+			return 0, fmt.Errorf("pulse: invalid period %q", s)
+		}
+		day := 24 * time.Hour
+		if s[n-1] == 'w' {
+			day *= 7
+		}
+		return time.Duration(v * float64(day)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("pulse: invalid period %q", s)
+	}
+	return d, nil
+}
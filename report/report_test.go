@@ -0,0 +1,167 @@
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/x-formation/pulsekit"
+	"github.com/x-formation/pulsekit/mock"
+)
+
+var since = time.Date(2014, 7, 1, 0, 0, 0, 0, time.UTC)
+
+func build(id int64, hours, minutes int, stages ...pulse.StageResult) pulse.BuildResult {
+	start := since.Add(time.Duration(hours) * time.Hour)
+	b := pulse.BuildResult{
+		ID:       id,
+		Complete: true,
+		Success:  true,
+		Start:    start,
+		End:      start.Add(time.Duration(minutes) * time.Minute),
+	}
+	for _, st := range stages {
+		st.Start, st.End = start, start.Add(time.Duration(minutes)*time.Minute)
+		b.Success = b.Success && st.Success
+		b.Stages = append(b.Stages, st)
+	}
+	return b
+}
+
+func stage(name, agent string, success bool) pulse.StageResult {
+	return pulse.StageResult{Name: name, Agent: agent, Complete: true, Success: success}
+}
+
+func fixture() map[string][]pulse.BuildResult {
+	b := map[string][]pulse.BuildResult{
+		"Pulse CLI": {
+			build(4, 30, 20, stage("Test", "Linux", true)),
+			build(3, 20, 10, stage("Test", "Linux", false)),
+			build(2, 10, 10, stage("Test", "Linux", true)),
+			build(1, -10, 10, stage("Test", "Linux", false)),
+		},
+		"LM-X": {
+			build(7, 1, 60, stage("Build - Linux", "Linux", true), stage("Build - Windows", "Windows", true)),
+			{ID: 8, Start: since.Add(2 * time.Hour)},
+		},
+	}
+	// Builds 3 and 4 rebuilt the revision of build 2, build 1 is out of
+	// the period.
+	for i := range b["Pulse CLI"] {
+		b["Pulse CLI"][i].Revision = "c1"
+	}
+	b["LM-X"][0].Revision = "c2"
+	return b
+}
+
+func TestNew(t *testing.T) {
+	r := New(fixture(), since, since.Add(48*time.Hour))
+	if len(r.Projects) != 2 || r.Projects[0].Project != "LM-X" || r.Projects[1].Project != "Pulse CLI" {
+		t.Fatalf("expected stats of both projects, was %+v instead", r.Projects)
+	}
+	p := r.Projects[1]
+	if p.Builds != 3 || p.Failures != 1 || p.Mean != Duration(40*time.Minute/3) || p.P95 != Duration(20*time.Minute) {
+		t.Errorf("expected stats of builds 2-4, was %+v instead", p)
+	}
+	if len(r.Stages) != 3 {
+		t.Fatalf("expected len(r.Stages) to be 3, was %d instead", len(r.Stages))
+	}
+	if s := r.Stages[2]; s.Stage != "Test" || s.Runs != 3 || s.Failures != 1 {
+		t.Errorf("expected Test stage to fail once, was %+v instead", s)
+	}
+	if len(r.Flaky) != 1 || r.Flaky[0].Stage != "Test" || r.Flaky[0].Flips != 2 || r.Flaky[0].FlipRate != 1 {
+		t.Errorf("expected Test stage to flip twice, was %+v instead", r.Flaky)
+	}
+	if len(r.Agents) != 2 || r.Agents[0].Agent != "Linux" || r.Agents[0].Stages != 4 ||
+		r.Agents[0].Busy != Duration(100*time.Minute) || r.Agents[0].Utilisation != 100.0/2880 {
+		t.Errorf("expected Linux agent to be busy for 1h40m, was %+v instead", r.Agents)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	d := []time.Duration{5, 1, 4, 2, 3, 6, 7, 8, 9, 10}
+	cases := map[float64]time.Duration{0: 1, 50: 5, 95: 10, 100: 10}
+	for p, exp := range cases {
+		if v := Percentile(d, p); v != exp {
+			t.Errorf("expected %v, was %v instead (p=%v)", exp, v, p)
+		}
+	}
+	if m := Mean(d); m != 5 {
+		t.Errorf("expected mean to be 5, was %v instead", m)
+	}
+}
+
+func TestParsePeriod(t *testing.T) {
+	cases := map[string]time.Duration{
+		"7d":   7 * 24 * time.Hour,
+		"2w":   14 * 24 * time.Hour,
+		"36h":  36 * time.Hour,
+		"0.5d": 12 * time.Hour,
+	}
+	for s, exp := range cases {
+		if d, err := ParsePeriod(s); err != nil || d != exp {
+			t.Errorf("expected %v, was %v instead (s=%q, err=%v)", exp, d, s, err)
+		}
+	}
+	for _, s := range []string{"", "d", "-1d", "week", "-1h"} {
+		if _, err := ParsePeriod(s); err == nil {
+			t.Errorf("expected err to be non-nil (s=%q)", s)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	r := New(fixture(), since, since.Add(48*time.Hour))
+	cases := map[Format][]string{
+		FormatText: {"Pulse CLI  3", "66.7%", "13m20s", "FLAKY STAGE", "Linux    4       1h40m0s  3.5%"},
+		FormatCSV:  {"kind,project,stage", "project,Pulse CLI,,,,3,1,0.6667,800,1200", "stage,Pulse CLI,Test,,,3,1,,800,1200", "flaky,Pulse CLI,Test,,,3,1,,,,2,1.0000", "agent,,,,Linux,4,,,,,,,6000,0.0347"},
+		FormatJSON: {`"mean_seconds": 800`, `"flip_rate": 1`},
+		FormatHTML: {"<!DOCTYPE html>", "<td>Pulse CLI</td>", "<h2>Flakiest stages</h2>"},
+	}
+	for f, exp := range cases {
+		var buf bytes.Buffer
+		if err := r.Write(&buf, f); err != nil {
+			t.Errorf("expected err to be nil, was %q instead (f=%s)", err, f)
+			continue
+		}
+		for _, exp := range exp {
+			if !strings.Contains(buf.String(), exp) {
+				t.Errorf("expected output to contain %q, was %q instead (f=%s)", exp, buf.String(), f)
+			}
+		}
+		if f == FormatJSON {
+			var v map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &v); err != nil {
+				t.Errorf("expected valid JSON, was %q instead (err=%v)", buf.String(), err)
+			}
+		}
+	}
+	if _, err := ParseFormat("pdf"); err == nil {
+		t.Error("expected err to be non-nil")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	mc := mock.NewClient()
+	mc.Err = []error{nil, nil, errInvalidBuild, errors.New("err")}
+	for i := 0; i < 50; i++ {
+		mc.H = append(mc.H, pulse.BuildResult{ID: int64(100 - i), Start: since.Add(-time.Duration(i) * time.Minute)})
+	}
+	// The oldest build of the first batch started after since, so the history
+	// is requested again.
+	if b, err := History(mc, "Pulse CLI", since.Add(-time.Hour)); err != nil || len(b) != 50 {
+		t.Errorf("expected 50 builds, was %d instead (err=%v)", len(b), err)
+	}
+	if b, err := History(mc, "Pulse CLI", since); err != nil || b != nil {
+		t.Errorf("expected no builds and no error, was %v (err=%v)", b, err)
+	}
+	if _, err := History(mc, "Pulse CLI", since); err == nil {
+		t.Error("expected err to be non-nil")
+	}
+	mc.Check(t)
+}
+
+var errInvalidBuild = &pulse.InvalidBuildError{Status: pulse.BuildNeverBuilt}
@@ -0,0 +1,175 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/pbkdf2"
+	"gopkg.in/v1/yaml"
+)
+
+// ErrPassphrase is returned by a File store when its file can not be
+// decrypted with the given passphrase.
+var ErrPassphrase = errors.New("pulse: invalid passphrase for the secrets file")
+
+// Parameters of the key derivation (PBKDF2 with HMAC-SHA256) and the layout
+// of the encrypted file, which is a salt, followed by a nonce and the sealed
+// YAML map of the secrets.
+const (
+	saltLen    = 16
+	nonceLen   = 12
+	iterations = 100000
+)
+
+// File is a store, which keeps secrets in a file encrypted with AES-GCM using
+// a key derived from a passphrase. The file is created with 0600 mode, and it
+// is not read if it is accessible by other users.
+type File struct {
+	path       string
+	passphrase func() (string, error)
+	once       sync.Once
+	key        []byte
+	err        error
+}
+
+// NewFile gives a store, which keeps secrets in a file under the given path.
+// The passphrase is requested on first access to the file.
+func NewFile(path string, passphrase func() (string, error)) *File {
+	return &File{path: path, passphrase: passphrase}
+}
+
+// Get implements Store.
+func (f *File) Get(key string) (string, error) {
+	m, _, err := f.read()
+	if err != nil {
+		return "", err
+	}
+	s, ok := m[key]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return s, nil
+}
+
+// Set implements Store.
+func (f *File) Set(key, secret string) error {
+	m, pass, err := f.read()
+	if err != nil {
+		return err
+	}
+	m[key] = secret
+	return f.write(m, pass)
+}
+
+// Delete implements Store.
+func (f *File) Delete(key string) error {
+	m, pass, err := f.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := m[key]; !ok {
+		return nil
+	}
+	delete(m, key)
+	return f.write(m, pass)
+}
+
+func (f *File) pass() ([]byte, error) {
+	f.once.Do(func() {
+		var s string
+		if s, f.err = f.passphrase(); f.err == nil {
+			if s == "" {
+				f.err = errors.New("pulse: empty passphrase for the secrets file")
+			}
+			f.key = []byte(s)
+		}
+	})
+	return f.key, f.err
+}
+
+// read gives the decrypted secrets together with the passphrase, or empty
+// secrets if the file does not exist yet.
+func (f *File) read() (map[string]string, []byte, error) {
+	m := make(map[string]string)
+	b, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		pass, err := f.pass()
+		return m, pass, err
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = CheckMode(f.path); err != nil {
+		return nil, nil, err
+	}
+	pass, err := f.pass()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(b) < saltLen+nonceLen {
+		return nil, nil, ErrPassphrase
+	}
+	gcm, err := newGCM(pass, b[:saltLen])
+	if err != nil {
+		return nil, nil, err
+	}
+	p, err := gcm.Open(nil, b[saltLen:saltLen+nonceLen], b[saltLen+nonceLen:], nil)
+	if err != nil {
+		return nil, nil, ErrPassphrase
+	}
+	if err = yaml.Unmarshal(p, &m); err != nil {
+		return nil, nil, err
+	}
+	return m, pass, nil
+}
+
+// write encrypts the secrets with a fresh salt and nonce and replaces the file
+// with a new one.
+func (f *File) write(m map[string]string, pass []byte) error {
+	p, err := yaml.Marshal(m)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, saltLen+nonceLen)
+	if _, err = io.ReadFull(rand.Reader, b); err != nil {
+		return err
+	}
+	gcm, err := newGCM(pass, b[:saltLen])
+	if err != nil {
+		return err
+	}
+	b = gcm.Seal(b, b[saltLen:], p, nil)
+	if err = os.MkdirAll(filepath.Dir(f.path), 0700); err != nil {
+		return err
+	}
+	tmp := f.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	// WriteFile does not change mode of an already existing file.
+	if err = os.Chmod(tmp, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, f.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func newGCM(pass, salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2.Key(pass, salt, iterations, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
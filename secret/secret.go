@@ -0,0 +1,181 @@
+// Package secret stores secrets, like passwords, outside of plain text
+// configuration files - in the freedesktop Secret Service, in pass (the
+// standard unix password manager) or in a file encrypted with a passphrase.
+package secret
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// ErrNotFound is returned by a Store when there is no secret under a key.
+var ErrNotFound = errors.New("pulse: secret not found")
+
+// Store persists secrets under keys.
+type Store interface {
+	// Get gives a secret stored under the key, ErrNotFound if there is none.
+	Get(key string) (string, error)
+	// Set stores the secret under the key, replacing the previous one.
+	Set(key, secret string) error
+	// Delete removes a secret stored under the key. It is not an error
+	// if there is none.
+	Delete(key string) error
+}
+
+// Names of the stores, which are accepted by New.
+const (
+	NameService = "secret-service"
+	NamePass    = "pass"
+	NameFile    = "file"
+)
+
+// New gives a store of the given name. The path and passphrase are used
+// only by the file store.
+func New(name, path string, passphrase func() (string, error)) (Store, error) {
+	switch name {
+	case NameService:
+		return Service{}, nil
+	case NamePass:
+		return Pass{}, nil
+	case NameFile:
+		return NewFile(path, passphrase), nil
+	}
+	return nil, fmt.Errorf("pulse: invalid secret store %q", name)
+}
+
+// Service is a store backed by the freedesktop Secret Service (e.g. GNOME
+// Keyring or KWallet), which is accessed with the secret-tool command.
+type Service struct{}
+
+// Get implements Store.
+func (Service) Get(key string) (string, error) {
+	out, err := run("", "secret-tool", "lookup", "service", "pulsecli", "account", key)
+	if err != nil {
+		return "", err
+	}
+	// Lookup of a missing secret succeeds with older versions of secret-tool.
+	if out == "" {
+		return "", ErrNotFound
+	}
+	return out, nil
+}
+
+// Set implements Store.
+func (Service) Set(key, secret string) error {
+	_, err := run(secret, "secret-tool", "store", "--label", "pulsecli "+key,
+		"service", "pulsecli", "account", key)
+	return err
+}
+
+// Delete implements Store.
+func (Service) Delete(key string) error {
+	_, err := run("", "secret-tool", "clear", "service", "pulsecli", "account", key)
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// Pass is a store backed by pass, the standard unix password manager. Secrets
+// are stored under the pulsecli directory of the password store.
+type Pass struct{}
+
+func passName(key string) string {
+	return "pulsecli/" + url.QueryEscape(key)
+}
+
+// Get implements Store.
+func (Pass) Get(key string) (string, error) {
+	out, err := run("", "pass", "show", passName(key))
+	if err != nil {
+		return "", err
+	}
+	// The secret is the first line, the next ones are optional metadata.
+	if i := strings.IndexByte(out, '\n'); i != -1 {
+		out = out[:i]
+	}
+	return out, nil
+}
+
+// Set implements Store.
+func (Pass) Set(key, secret string) error {
+	_, err := run(secret+"\n", "pass", "insert", "--multiline", "--force", passName(key))
+	return err
+}
+
+// Delete implements Store.
+func (Pass) Delete(key string) error {
+	_, err := run("", "pass", "rm", "--force", passName(key))
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// run runs the command with the given standard input and gives its standard
+// output. A command, which exits with 1 and no error message, is treated as
+// ErrNotFound.
+var run = func(stdin, name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var out, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if _, ok := err.(*exec.ExitError); ok && (msg == "" || strings.Contains(msg, "not in the password store")) {
+			return "", ErrNotFound
+		}
+		if msg != "" {
+			return "", fmt.Errorf("pulse: %s failed: %s", name, msg)
+		}
+		return "", fmt.Errorf("pulse: %s failed: %v", name, err)
+	}
+	return strings.TrimRight(out.String(), "\n"), nil
+}
+
+// CheckMode returns an error if a file under the given path is accessible
+// by users other than its owner. File modes are not checked on Windows.
+func CheckMode(path string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("pulse: %s is accessible by other users, run chmod 600 %s", path, path)
+	}
+	return nil
+}
+
+// Detect gives a name of a store, which is available in the environment,
+// preferring the Secret Service over pass. It gives an empty string, if none
+// of them is available. The file store is never detected, since it requires
+// a passphrase.
+func Detect() string {
+	if _, err := exec.LookPath("secret-tool"); err == nil && os.Getenv("DBUS_SESSION_BUS_ADDRESS") != "" {
+		return NameService
+	}
+	if _, err := exec.LookPath("pass"); err == nil {
+		dir := os.Getenv("PASSWORD_STORE_DIR")
+		if dir == "" {
+			if u, err := user.Current(); err == nil {
+				dir = filepath.Join(u.HomeDir, ".password-store")
+			}
+		}
+		// The password store is initialised with a GPG key.
+		if _, err := os.Stat(filepath.Join(dir, ".gpg-id")); dir != "" && err == nil {
+			return NamePass
+		}
+	}
+	return ""
+}
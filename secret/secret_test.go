@@ -0,0 +1,126 @@
+package secret
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func passphrase(s string) func() (string, error) {
+	return func() (string, error) { return s, nil }
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pulsekit")
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pulsecli.d", "secrets")
+	f := NewFile(path, passphrase("correct horse"))
+	if _, err = f.Get("user@pulse"); err != ErrNotFound {
+		t.Errorf("expected err to be ErrNotFound, was %v instead", err)
+	}
+	if err = f.Set("user@pulse", "s3cr3t"); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	if err = f.Set("token@pulse", "t0k3n"); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("expected secrets to be persisted with 0600 mode, was fi=%v, err=%v", fi, err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	if len(b) == 0 || bytes.Contains(b, []byte("s3cr3t")) {
+		t.Errorf("expected secrets file to be encrypted, was %q instead", b)
+	}
+	f = NewFile(path, passphrase("correct horse"))
+	if s, err := f.Get("user@pulse"); err != nil || s != "s3cr3t" {
+		t.Errorf("expected secret to be s3cr3t, was %q instead (err=%v)", s, err)
+	}
+	if err = f.Delete("user@pulse"); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	if _, err = f.Get("user@pulse"); err != ErrNotFound {
+		t.Errorf("expected err to be ErrNotFound, was %v instead", err)
+	}
+	if s, err := f.Get("token@pulse"); err != nil || s != "t0k3n" {
+		t.Errorf("expected secret to be t0k3n, was %q instead (err=%v)", s, err)
+	}
+	if _, err = NewFile(path, passphrase("battery staple")).Get("token@pulse"); err != ErrPassphrase {
+		t.Errorf("expected err to be ErrPassphrase, was %v instead", err)
+	}
+	if runtime.GOOS == "windows" {
+		return
+	}
+	if err = os.Chmod(path, 0644); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	if _, err = NewFile(path, passphrase("correct horse")).Get("token@pulse"); err == nil {
+		t.Error("expected secrets file accessible by other users to be refused")
+	}
+}
+
+func TestCommand(t *testing.T) {
+	type call struct {
+		stdin string
+		args  []string
+	}
+	var calls []call
+	out, outErr := "", error(nil)
+	defer func(fn func(string, string, ...string) (string, error)) { run = fn }(run)
+	run = func(stdin, name string, args ...string) (string, error) {
+		calls = append(calls, call{stdin, append([]string{name}, args...)})
+		return out, outErr
+	}
+	cases := []struct {
+		s   Store
+		exp []call
+	}{
+		{Service{}, []call{
+			{"s3cr3t", []string{"secret-tool", "store", "--label", "pulsecli user@pulse",
+				"service", "pulsecli", "account", "user@pulse"}},
+			{"", []string{"secret-tool", "lookup", "service", "pulsecli", "account", "user@pulse"}},
+			{"", []string{"secret-tool", "clear", "service", "pulsecli", "account", "user@pulse"}},
+		}},
+		{Pass{}, []call{
+			{"s3cr3t\n", []string{"pass", "insert", "--multiline", "--force", "pulsecli/user%40pulse"}},
+			{"", []string{"pass", "show", "pulsecli/user%40pulse"}},
+			{"", []string{"pass", "rm", "--force", "pulsecli/user%40pulse"}},
+		}},
+	}
+	for i, cas := range cases {
+		calls, out, outErr = nil, "s3cr3t", nil
+		if err := cas.s.Set("user@pulse", "s3cr3t"); err != nil {
+			t.Errorf("expected err to be nil, was %q instead (i=%d)", err, i)
+		}
+		if s, err := cas.s.Get("user@pulse"); err != nil || s != "s3cr3t" {
+			t.Errorf("expected secret to be s3cr3t, was %q instead (err=%v, i=%d)", s, err, i)
+		}
+		if err := cas.s.Delete("user@pulse"); err != nil {
+			t.Errorf("expected err to be nil, was %q instead (i=%d)", err, i)
+		}
+		if !reflect.DeepEqual(calls, cas.exp) {
+			t.Errorf("expected calls to be %v, was %v instead (i=%d)", cas.exp, calls, i)
+		}
+		out, outErr = "", ErrNotFound
+		if _, err := cas.s.Get("user@pulse"); err != ErrNotFound {
+			t.Errorf("expected err to be ErrNotFound, was %v instead (i=%d)", err, i)
+		}
+		if err := cas.s.Delete("user@pulse"); err != nil {
+			t.Errorf("expected err to be nil, was %q instead (i=%d)", err, i)
+		}
+		outErr = errors.New("err")
+		if err := cas.s.Set("user@pulse", "s3cr3t"); err != outErr {
+			t.Errorf("expected err to be %v, was %v instead (i=%d)", outErr, err, i)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package top
+
+import (
+	"time"
+
+	"github.com/nsf/termbox-go"
+)
+
+var colors = map[Color]termbox.Attribute{
+	ColorDefault: termbox.ColorDefault,
+	ColorRed:     termbox.ColorRed,
+	ColorGreen:   termbox.ColorGreen,
+	ColorYellow:  termbox.ColorYellow,
+	ColorBlue:    termbox.ColorBlue,
+	ColorMagenta: termbox.ColorMagenta,
+	ColorCyan:    termbox.ColorCyan,
+}
+
+var keys = map[termbox.Key]Action{
+	termbox.KeyArrowUp:   ActionUp,
+	termbox.KeyArrowDown: ActionDown,
+	termbox.KeyEnter:     ActionLogs,
+	termbox.KeyEsc:       ActionQuit,
+	termbox.KeyCtrlC:     ActionQuit,
+}
+
+var chars = map[rune]Action{
+	'k': ActionUp,
+	'j': ActionDown,
+	's': ActionSort,
+	't': ActionTrigger,
+	'c': ActionCancel,
+	'l': ActionLogs,
+	'q': ActionQuit,
+}
+
+// Run displays the dashboard in the terminal, refreshing it every interval,
+// until the user quits it.
+func Run(d *Dashboard, interval time.Duration) error {
+	if err := termbox.Init(); err != nil {
+		return err
+	}
+	defer termbox.Close()
+	termbox.HideCursor()
+	events := make(chan termbox.Event)
+	go func() {
+		for {
+			events <- termbox.PollEvent()
+		}
+	}()
+	type result struct {
+		snap *Snapshot
+		err  error
+	}
+	results := make(chan result, 1)
+	fetch := func() {
+		snap, err := d.Fetch()
+		results <- result{snap, err}
+	}
+	go fetch()
+	draw(d)
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	fetching := true
+	for {
+		select {
+		case ev := <-events:
+			switch ev.Type {
+			case termbox.EventError:
+				return ev.Err
+			case termbox.EventKey:
+				a, ok := keys[ev.Key]
+				if !ok {
+					a = chars[ev.Ch]
+				}
+				if d.Do(a) {
+					return nil
+				}
+			}
+		case r := <-results:
+			d.Set(r.snap, r.err)
+			fetching = false
+		case <-tick.C:
+			// A slow Pulse server must not pile up the requests.
+			if !fetching {
+				fetching = true
+				go fetch()
+			}
+		}
+		draw(d)
+	}
+}
+
+func draw(d *Dashboard) {
+	termbox.Clear(termbox.ColorDefault, termbox.ColorDefault)
+	w, h := termbox.Size()
+	for y, l := range d.Render(w, h) {
+		x := 0
+		for _, s := range l {
+			fg := colors[s.Color]
+			if s.Bold {
+				fg |= termbox.AttrBold
+			}
+			for _, r := range s.Text {
+				termbox.SetCell(x, y, r, fg, termbox.ColorDefault)
+				x++
+			}
+		}
+	}
+	termbox.Flush()
+}
@@ -0,0 +1,474 @@
+// Package top implements a full-screen terminal dashboard, which displays
+// state of projects and agents of a Pulse server.
+package top
+
+import (
+	"fmt"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/x-formation/pulsekit"
+)
+
+// Color is a color of a segment of a line.
+type Color int
+
+const (
+	ColorDefault Color = iota
+	ColorRed
+	ColorGreen
+	ColorYellow
+	ColorBlue
+	ColorMagenta
+	ColorCyan
+)
+
+// Segment is a text of a single color.
+type Segment struct {
+	Text  string
+	Color Color
+	Bold  bool
+}
+
+// Line is a single line of the dashboard.
+type Line []Segment
+
+// String gives the text of the line.
+func (l Line) String() string {
+	s := make([]string, 0, len(l))
+	for i := range l {
+		s = append(s, l[i].Text)
+	}
+	return strings.Join(s, "")
+}
+
+// StateColor gives a color the build state is displayed with.
+func StateColor(s pulse.BuildState) Color {
+	switch s {
+	case pulse.BuildSuccess:
+		return ColorGreen
+	case pulse.BuildFailure, pulse.BuildError:
+		return ColorRed
+	case pulse.BuildWarnings:
+		return ColorYellow
+	case pulse.BuildInProgress, pulse.BuildPending:
+		return ColorCyan
+	case pulse.BuildCancelling, pulse.BuildTerminating, pulse.BuildTerminated:
+		return ColorMagenta
+	}
+	return ColorDefault
+}
+
+// AgentColor gives a color the agent status is displayed with.
+func AgentColor(s pulse.AgentStatus) Color {
+	switch s {
+	case pulse.AgentIdle:
+		return ColorGreen
+	case pulse.AgentBuilding:
+		return ColorCyan
+	case pulse.AgentOffline:
+		return ColorRed
+	case pulse.AgentSync:
+		return ColorYellow
+	}
+	return ColorDefault
+}
+
+// Sort is an order of the projects.
+type Sort int
+
+const (
+	// SortName sorts projects by name.
+	SortName Sort = iota
+	// SortState sorts projects by state of the latest build, failed first.
+	SortState
+	// SortStart sorts projects by start of the latest build, recent first.
+	SortStart
+)
+
+var sortNames = []string{"name", "state", "start"}
+
+func (s Sort) String() string {
+	return sortNames[s]
+}
+
+// Action is an action a user can perform on the dashboard.
+type Action int
+
+const (
+	ActionNone Action = iota
+	// ActionUp selects the previous project.
+	ActionUp
+	// ActionDown selects the next project.
+	ActionDown
+	// ActionSort switches to the next order of the projects.
+	ActionSort
+	// ActionTrigger triggers a build of the selected project.
+	ActionTrigger
+	// ActionCancel cancels a build in progress of the selected project.
+	ActionCancel
+	// ActionLogs opens logs of the latest build of the selected project.
+	ActionLogs
+	// ActionQuit quits the dashboard.
+	ActionQuit
+)
+
+// Project is a state of a single project.
+type Project struct {
+	Name string
+	// Last is the latest completed build, nil if the project has never
+	// been built.
+	Last *pulse.BuildResult
+	// Running is a build in progress, nil if there is none.
+	Running *pulse.BuildResult
+}
+
+func (p *Project) latest() *pulse.BuildResult {
+	if p.Running != nil {
+		return p.Running
+	}
+	return p.Last
+}
+
+// Snapshot is a state of the Pulse server fetched by a single refresh.
+type Snapshot struct {
+	Projects []Project
+	Agents   pulse.Agents
+	Time     time.Time
+}
+
+// Dashboard keeps state of the dashboard and renders it. It is not safe
+// for concurrent use.
+type Dashboard struct {
+	// Client is used to communicate with a Pulse server.
+	Client pulse.Client
+	// Projects filters projects, which are displayed, all projects if nil.
+	Projects func([]string) []string
+	// Agents filters agents, which are displayed, all agents if nil.
+	Agents func(pulse.Agents) pulse.Agents
+	// URL is an URL of the Pulse server, which build logs are opened from.
+	URL string
+	// Open opens the URL of build logs, e.g. in a web browser.
+	Open func(url string) error
+
+	snap   *Snapshot
+	sort   Sort
+	sel    string
+	status string
+}
+
+// New gives a Dashboard for the Pulse server under the given URL, which opens
+// build logs in a web browser.
+func New(c pulse.Client, url string) *Dashboard {
+	return &Dashboard{Client: c, URL: strings.TrimRight(url, "/"), Open: Browse}
+}
+
+// Fetch requests the current state of projects and agents. It does not change
+// the dashboard, so it may be called concurrently with other methods.
+func (d *Dashboard) Fetch() (*Snapshot, error) {
+	p, err := d.Client.Projects()
+	if err != nil {
+		return nil, err
+	}
+	if d.Projects != nil {
+		p = d.Projects(p)
+	}
+	snap := &Snapshot{Projects: make([]Project, 0, len(p)), Time: time.Now()}
+	for _, p := range p {
+		// Two latest builds are enough to get both a build in progress and
+		// the latest completed one.
+		h, err := d.Client.BuildHistory(p, 2)
+		if err != nil {
+			if _, ok := err.(*pulse.InvalidBuildError); !ok {
+				return nil, err
+			}
+		}
+		prj := Project{Name: p}
+		for i := range h {
+			if !h[i].Complete && prj.Running == nil {
+				prj.Running = &h[i]
+			} else if h[i].Complete && prj.Last == nil {
+				prj.Last = &h[i]
+			}
+		}
+		snap.Projects = append(snap.Projects, prj)
+	}
+	if snap.Agents, err = d.Client.Agents(); err != nil {
+		return nil, err
+	}
+	if d.Agents != nil {
+		snap.Agents = d.Agents(snap.Agents)
+	}
+	return snap, nil
+}
+
+// Set replaces the displayed state with the given snapshot. A non-nil error
+// is displayed in the status line instead, keeping the previous state.
+func (d *Dashboard) Set(snap *Snapshot, err error) {
+	if err != nil {
+		d.status = err.Error()
+		return
+	}
+	d.snap = snap
+	d.sortProjects()
+	if d.index() == -1 && len(snap.Projects) != 0 {
+		d.sel = snap.Projects[0].Name
+	}
+}
+
+// Refresh fetches and displays the current state.
+func (d *Dashboard) Refresh() error {
+	snap, err := d.Fetch()
+	d.Set(snap, err)
+	return err
+}
+
+func (d *Dashboard) sortProjects() {
+	if d.snap == nil {
+		return
+	}
+	sort.Sort(projects{p: d.snap.Projects, by: d.sort})
+}
+
+type projects struct {
+	p  []Project
+	by Sort
+}
+
+func (p projects) Len() int      { return len(p.p) }
+func (p projects) Swap(i, j int) { p.p[i], p.p[j] = p.p[j], p.p[i] }
+func (p projects) Less(i, j int) bool {
+	a, b := p.p[i].latest(), p.p[j].latest()
+	switch {
+	case p.by == SortState && rank(a) != rank(b):
+		return rank(a) < rank(b)
+	case p.by == SortStart && !start(a).Equal(start(b)):
+		return start(a).After(start(b))
+	}
+	return p.p[i].Name < p.p[j].Name
+}
+
+// rank orders build states from the ones which need attention the most.
+func rank(b *pulse.BuildResult) int {
+	if b == nil {
+		return 4
+	}
+	switch StateColor(b.State) {
+	case ColorRed:
+		return 0
+	case ColorYellow:
+		return 1
+	case ColorCyan, ColorMagenta:
+		return 2
+	}
+	return 3
+}
+
+func start(b *pulse.BuildResult) time.Time {
+	if b == nil {
+		return time.Time{}
+	}
+	return b.Start
+}
+
+// Selected gives the selected project, nil if there are no projects.
+func (d *Dashboard) Selected() *Project {
+	if d.snap == nil {
+		return nil
+	}
+	for i := range d.snap.Projects {
+		if d.snap.Projects[i].Name == d.sel {
+			return &d.snap.Projects[i]
+		}
+	}
+	return nil
+}
+
+func (d *Dashboard) index() int {
+	if d.snap != nil {
+		for i := range d.snap.Projects {
+			if d.snap.Projects[i].Name == d.sel {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Do performs the action. It returns true when the dashboard should quit.
+func (d *Dashboard) Do(a Action) bool {
+	p := d.Selected()
+	switch a {
+	case ActionQuit:
+		return true
+	case ActionUp, ActionDown:
+		if i := d.index(); i != -1 {
+			if a == ActionUp && i > 0 {
+				d.sel = d.snap.Projects[i-1].Name
+			} else if a == ActionDown && i+1 < len(d.snap.Projects) {
+				d.sel = d.snap.Projects[i+1].Name
+			}
+		}
+	case ActionSort:
+		d.sort = (d.sort + 1) % Sort(len(sortNames))
+		d.sortProjects()
+		d.status = "Sorted by " + d.sort.String()
+	case ActionTrigger:
+		if p == nil {
+			return false
+		}
+		if _, err := d.Client.Trigger(p.Name); err != nil {
+			d.status = err.Error()
+		} else {
+			d.status = fmt.Sprintf("Triggered a build of %s", p.Name)
+		}
+	case ActionCancel:
+		if p == nil {
+			return false
+		}
+		if p.Running == nil {
+			d.status = fmt.Sprintf("No build of %s is in progress", p.Name)
+		} else if err := d.Client.Cancel(p.Name, p.Running.ID); err != nil {
+			d.status = err.Error()
+		} else {
+			d.status = fmt.Sprintf("Cancelled build %d of %s", p.Running.ID, p.Name)
+		}
+	case ActionLogs:
+		if p == nil || p.latest() == nil {
+			return false
+		}
+		if err := d.Open(d.LogsURL(p.Name, p.latest().ID)); err != nil {
+			d.status = err.Error()
+		}
+	}
+	return false
+}
+
+// LogsURL gives an URL of logs of the build in the Pulse web UI.
+func (d *Dashboard) LogsURL(project string, id int64) string {
+	return fmt.Sprintf("%s/browse/projects/%s/builds/%d/logs/", d.URL, pathEscape(project), id)
+}
+
+// pathEscape escapes the string as a single segment of an URL path, so
+// a space becomes %20 instead of + and a slash does not start a new segment.
+func pathEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// Render renders the dashboard into lines, which fit the given size.
+func (d *Dashboard) Render(width, height int) []Line {
+	var l []Line
+	title := "pulsecli top - " + d.URL + " - sorted by " + d.sort.String()
+	if d.snap != nil {
+		title += " - " + d.snap.Time.Format("15:04:05")
+	}
+	l = append(l, Line{{Text: title, Bold: true}}, nil)
+	l = append(l, Line{{Text: fmt.Sprintf("  %-40s %8s  %-12s %-16s %s", "PROJECT", "BUILD", "STATE", "PROGRESS", "STARTED"),
+		Bold: true}})
+	if d.snap != nil {
+		for i := range d.snap.Projects {
+			l = append(l, d.project(&d.snap.Projects[i]))
+		}
+		l = append(l, nil, Line{{Text: fmt.Sprintf("  %-40s %-14s %s", "AGENT", "STATUS", "HOST"), Bold: true}})
+		for i := range d.snap.Agents {
+			a := &d.snap.Agents[i]
+			l = append(l, Line{
+				{Text: fmt.Sprintf("  %-40s ", trim(a.Name, 40))},
+				{Text: fmt.Sprintf("%-14s", strings.ToLower(string(a.Status))), Color: AgentColor(a.Status)},
+				{Text: " " + a.Host},
+			})
+		}
+	}
+	help := Line{{Text: "up/down select  s sort  t trigger  c cancel  l logs  q quit"}}
+	status := Line{{Text: d.status, Color: ColorYellow}}
+	// Keep the status and help lines at the bottom of the screen.
+	if max := height - 2; max >= 0 && len(l) > max {
+		l = l[:max]
+	}
+	for len(l) < height-2 {
+		l = append(l, nil)
+	}
+	l = append(l, status, help)
+	for i := range l {
+		l[i] = clip(l[i], width)
+	}
+	return l
+}
+
+func (d *Dashboard) project(p *Project) Line {
+	mark, b := "  ", p.latest()
+	if p.Name == d.sel {
+		mark = "> "
+	}
+	if b == nil {
+		return Line{{Text: fmt.Sprintf("%s%-40s %8s  %s", mark, trim(p.Name, 40), "-", "never built"),
+			Bold: p.Name == d.sel}}
+	}
+	l := Line{
+		{Text: fmt.Sprintf("%s%-40s %8d  ", mark, trim(p.Name, 40), b.ID), Bold: p.Name == d.sel},
+		{Text: fmt.Sprintf("%-12s ", b.State), Color: StateColor(b.State)},
+	}
+	if p.Running != nil {
+		l = append(l, Segment{Text: Bar(b.Progress, 10) + " ", Color: ColorCyan})
+	} else {
+		l = append(l, Segment{Text: fmt.Sprintf("%-17s ", "")})
+	}
+	if !b.Start.IsZero() {
+		l = append(l, Segment{Text: b.Start.Format("Jan _2 15:04")})
+	}
+	return l
+}
+
+// Bar renders a progress bar of the given width, e.g. "[#####-----] 50%".
+// A negative progress, which means Pulse does not know it, renders an empty
+// bar.
+func Bar(progress, width int) string {
+	if progress < 0 {
+		return "[" + strings.Repeat("-", width) + "]   ?%"
+	}
+	if progress > 100 {
+		progress = 100
+	}
+	n := progress * width / 100
+	return fmt.Sprintf("[%s%s] %3d%%", strings.Repeat("#", n), strings.Repeat("-", width-n), progress)
+}
+
+func trim(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n-1]) + "~"
+	}
+	return s
+}
+
+// clip cuts the line to the given width.
+func clip(l Line, width int) Line {
+	var c Line
+	for _, s := range l {
+		r := []rune(s.Text)
+		if len(r) >= width {
+			s.Text = string(r[:width])
+			return append(c, s)
+		}
+		width -= len(r)
+		c = append(c, s)
+	}
+	return c
+}
+
+// Browse opens the URL in a web browser.
+func Browse(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	case "darwin":
+		cmd = exec.Command("open", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
+}
@@ -0,0 +1,136 @@
+package top
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/x-formation/pulsekit"
+	"github.com/x-formation/pulsekit/mock"
+)
+
+func TestBar(t *testing.T) {
+	cases := map[int]string{
+		-1:  "[----------]   ?%",
+		0:   "[----------]   0%",
+		45:  "[####------]  45%",
+		100: "[##########] 100%",
+		120: "[##########] 100%",
+	}
+	for progress, exp := range cases {
+		if bar := Bar(progress, 10); bar != exp {
+			t.Errorf("expected %q, was %q instead (progress=%d)", exp, bar, progress)
+		}
+	}
+}
+
+func fixture() (*mock.Client, *Dashboard) {
+	mc := mock.NewClient()
+	mc.P = []string{"Pulse CLI", "LM-X - Tier 1"}
+	start := time.Date(2014, 7, 1, 12, 0, 0, 0, time.UTC)
+	mc.H = []pulse.BuildResult{
+		{ID: 131, State: pulse.BuildInProgress, Progress: 45, Start: start},
+		{ID: 130, State: pulse.BuildFailure, Complete: true, Start: start.Add(-time.Hour)},
+	}
+	mc.A = pulse.Agents{{Name: "Linux x86", Status: pulse.AgentOffline, Host: "linux86:8090"}}
+	d := New(mc, "http://pulse/")
+	d.Projects = func(p []string) []string { return p[:1] }
+	return mc, d
+}
+
+func TestRender(t *testing.T) {
+	mc, d := fixture()
+	mc.Err = make([]error, 3)
+	if err := d.Refresh(); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	mc.Check(t)
+	p := d.Selected()
+	if p == nil || p.Name != "Pulse CLI" || p.Running.ID != 131 || p.Last.ID != 130 {
+		t.Fatalf("expected Pulse CLI to be selected, was %+v instead", p)
+	}
+	l := d.Render(120, 12)
+	if len(l) != 12 {
+		t.Fatalf("expected 12 lines, was %d instead", len(l))
+	}
+	var s []string
+	for i := range l {
+		s = append(s, l[i].String())
+	}
+	out := strings.Join(s, "\n")
+	for _, exp := range []string{"> Pulse CLI", "131", "in progress", "[####------]  45%",
+		"Linux x86", "offline", "linux86:8090", "q quit"} {
+		if !strings.Contains(out, exp) {
+			t.Errorf("expected output to contain %q, was %q instead", exp, out)
+		}
+	}
+	if strings.Contains(out, "LM-X") {
+		t.Errorf("expected LM-X to be filtered out, was %q instead", out)
+	}
+	for _, seg := range l[3] {
+		if strings.HasPrefix(seg.Text, "in progress") && seg.Color != ColorCyan {
+			t.Errorf("expected in progress state to be cyan, was %v instead", seg.Color)
+		}
+	}
+	if l = d.Render(20, 3); len(l) != 3 || len([]rune(l[0].String())) != 20 {
+		t.Errorf("expected output to be clipped to 20x3, was %q instead", l)
+	}
+}
+
+func TestDo(t *testing.T) {
+	mc, d := fixture()
+	d.Projects = nil
+	mc.Err = []error{nil, nil, nil, nil, nil, errors.New("err")}
+	var opened string
+	d.Open = func(url string) error { opened = url; return nil }
+	if err := d.Refresh(); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	if d.Selected().Name != "LM-X - Tier 1" {
+		t.Fatalf("expected LM-X - Tier 1 to be selected, was %q instead", d.Selected().Name)
+	}
+	d.Do(ActionDown)
+	if d.Selected().Name != "Pulse CLI" {
+		t.Errorf("expected Pulse CLI to be selected, was %q instead", d.Selected().Name)
+	}
+	d.Do(ActionDown)
+	if d.Selected().Name != "Pulse CLI" {
+		t.Errorf("expected Pulse CLI to stay selected, was %q instead", d.Selected().Name)
+	}
+	d.Do(ActionSort)
+	if d.sort != SortState {
+		t.Errorf("expected projects to be sorted by state, was %v instead", d.sort)
+	}
+	d.Do(ActionLogs)
+	if exp := "http://pulse/browse/projects/Pulse%20CLI/builds/131/logs/"; opened != exp {
+		t.Errorf("expected %q to be opened, was %q instead", exp, opened)
+	}
+	d.Do(ActionTrigger)
+	if exp := "Triggered a build of Pulse CLI"; d.status != exp {
+		t.Errorf("expected status to be %q, was %q instead", exp, d.status)
+	}
+	d.Do(ActionCancel)
+	if d.status != "err" {
+		t.Errorf("expected status to be %q, was %q instead", "err", d.status)
+	}
+	if !d.Do(ActionQuit) {
+		t.Error("expected ActionQuit to quit")
+	}
+	mc.Check(t)
+}
+
+func TestSetErr(t *testing.T) {
+	mc, d := fixture()
+	mc.Err = []error{nil, nil, nil, errors.New("err")}
+	if err := d.Refresh(); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	if err := d.Refresh(); err == nil {
+		t.Fatal("expected err to be non-nil")
+	}
+	if d.status != "err" || d.Selected() == nil {
+		t.Errorf("expected previous state to be kept, was status=%q, selected=%v", d.status, d.Selected())
+	}
+	mc.Check(t)
+}
@@ -180,6 +180,23 @@ type Message struct {
 
 const ProjectPersonal = "personal"
 
+// QueuedBuild is a build request waiting in the build queue of a Pulse server.
+type QueuedBuild struct {
+	Project  string    `xmlrpc:"project"`
+	Owner    string    `xmlrpc:"owner"`
+	Personal bool      `xmlrpc:"personal"`
+	Reason   string    `xmlrpc:"reason"`
+	Revision string    `xmlrpc:"revision"`
+	Queued   time.Time `xmlrpc:"queuedTime"`
+}
+
+// PersonalDetails describes the SCM of a project, which a personal build is
+// prepared for.
+type PersonalDetails struct {
+	SCM      string `xmlrpc:"scmType"`
+	Location string `xmlrpc:"scmLocation"`
+}
+
 // ProjectStage TODO(rjeczalik): document
 // 'projects/$PROJECT/stages'
 type ProjectStage struct {
@@ -191,19 +208,42 @@ type ProjectStage struct {
 	Terminate bool   `xmlrpc:"terminateBuildOnFailure"`
 }
 
-// ProjectCleanup TODO(rjeczalik): document
-// 'projects/$PROJECT/cleanup'
+// CleanupUnit is a unit of a retention period of a cleanup rule.
+type CleanupUnit string
+
+const (
+	CleanupBuilds CleanupUnit = "BUILDS"
+	CleanupDays   CleanupUnit = "DAYS"
+)
+
+// CleanupWhat is a kind of build data removed by a cleanup rule.
+type CleanupWhat string
+
+const (
+	CleanupArtifacts  CleanupWhat = "BUILD_ARTIFACTS"
+	CleanupRepository CleanupWhat = "REPOSITORY_ARTIFACTS"
+	CleanupSnapshot   CleanupWhat = "WORKING_COPY_SNAPSHOT"
+)
+
+// ProjectCleanupMeta is a symbolic name of the ProjectCleanup config type.
+const ProjectCleanupMeta = "zutubi.cleanupConfig"
+
+// ProjectCleanup is a single cleanup rule of a project, which describes how
+// long builds are retained.
+// 'projects/$PROJECT/cleanup/$NAME'
+//
+// The response for the 'projects/$PROJECT/cleanup' path is a struct with
+// members named after the rules, which kolo/xmlrpc is not able to map, thus
+// every rule is requested separately.
 type ProjectCleanup struct {
-	// TODO(rjeczalik): The response for this config path looks like:
-	//
-	//  <struct>
-	//    <member>
-	//      <name>60 days</name>
-	//      <value> ... </value>
-	//    </member>
-	//  </struct>
-	//
-	// Which makes it impossible to map in any useful way at the moment.
+	Meta     string        `xmlrpc:"meta.symbolicName"`
+	Name     string        `xmlrpc:"name"`
+	All      bool          `xmlrpc:"cleanupAll"`
+	What     []CleanupWhat `xmlrpc:"what"`
+	Retain   int           `xmlrpc:"retain"`
+	Unit     CleanupUnit   `xmlrpc:"unit"`
+	States   []string      `xmlrpc:"states"`
+	Statuses []string      `xmlrpc:"statuses"`
 }
 
 // BuildType TODO(rjeczalik): document
@@ -0,0 +1,194 @@
+package util
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/x-formation/pulsekit"
+)
+
+// StuckBuild describes a build, which runs much longer than builds of its
+// project usually do.
+type StuckBuild struct {
+	Project string
+	ID      int64
+	// Running is a time the build runs for.
+	Running time.Duration
+	// Median is a median duration of the previous builds of the project.
+	Median time.Duration
+}
+
+// StuckStage describes a stage of a build in progress, which waits for
+// an agent for too long.
+type StuckStage struct {
+	Project string
+	ID      int64
+	Stage   string
+	// Pending is a time the stage waits for an agent for.
+	Pending time.Duration
+}
+
+// HungAgent describes an agent, which is synchronizing or building without
+// any progress.
+type HungAgent struct {
+	Agent pulse.Agent
+	// Since is a time of the first sample the agent was seen in its current
+	// state.
+	Since time.Time
+}
+
+// Stuck is a result of a single sample of a Detector.
+type Stuck struct {
+	Builds []StuckBuild
+	Stages []StuckStage
+	Agents []HungAgent
+}
+
+// Empty returns true when nothing is stuck.
+func (s *Stuck) Empty() bool {
+	return len(s.Builds) == 0 && len(s.Stages) == 0 && len(s.Agents) == 0
+}
+
+// Detector detects stuck builds and hung agents. Builds and stages are
+// checked within each sample, while agents are compared across samples -
+// an agent is hung when it stays synchronizing, or building the same stage
+// with the same progress, in all samples taken during the Hang duration.
+// A Detector is not safe for concurrent use.
+type Detector struct {
+	// Client is used to communicate with a Pulse server.
+	Client pulse.Client
+	// Factor is a multiple of the median duration of previous builds,
+	// after which a build in progress is stuck.
+	Factor float64
+	// History is a number of latest builds of a project, which are requested
+	// to compute the median duration.
+	History int
+	// MaxPending is a time after which a stage waiting for an agent is stuck.
+	MaxPending time.Duration
+	// Hang is a time after which an agent without progress is hung.
+	Hang time.Duration
+
+	agents map[string]agentSample
+	now    func() time.Time
+}
+
+type agentSample struct {
+	state string
+	since time.Time
+}
+
+// minHistory is a minimum number of completed builds needed to tell whether
+// a build in progress is stuck.
+const minHistory = 3
+
+// NewDetector gives a Detector, which treats builds running more than 3 times
+// their median of the last 10 builds, stages waiting 30 minutes for an agent
+// and agents without progress for 15 minutes as stuck.
+func NewDetector(c pulse.Client) *Detector {
+	return &Detector{
+		Client:     c,
+		Factor:     3,
+		History:    10,
+		MaxPending: 30 * time.Minute,
+		Hang:       15 * time.Minute,
+	}
+}
+
+// Sample requests current state of the agents and builds of the given
+// projects and reports the ones, which seem to be stuck.
+func (d *Detector) Sample(projects []string) (*Stuck, error) {
+	if d.now == nil {
+		d.now = time.Now
+	}
+	now := d.now()
+	a, err := d.Client.Agents()
+	if err != nil {
+		return nil, err
+	}
+	s := &Stuck{}
+	// Describes what every agent is busy with, used to tell its progress.
+	work := make(map[string]string)
+	for _, p := range projects {
+		h, err := d.Client.BuildHistory(p, d.History)
+		if err != nil {
+			if _, ok := err.(*pulse.InvalidBuildError); ok {
+				continue
+			}
+			return nil, err
+		}
+		var done []time.Duration
+		for i := range h {
+			if h[i].Complete && !h[i].Start.IsZero() && h[i].End.After(h[i].Start) {
+				done = append(done, h[i].End.Sub(h[i].Start))
+			}
+		}
+		median := Median(done)
+		for i := range h {
+			b := &h[i]
+			if b.Complete || b.Start.IsZero() {
+				continue
+			}
+			run := now.Sub(b.Start)
+			if len(done) >= minHistory && float64(run) > d.Factor*float64(median) {
+				s.Builds = append(s.Builds, StuckBuild{Project: p, ID: b.ID, Running: run, Median: median})
+			}
+			for j := range b.Stages {
+				st := &b.Stages[j]
+				switch {
+				case st.Complete:
+				case st.Agent == pulse.AgentPending:
+					if run > d.MaxPending {
+						s.Stages = append(s.Stages, StuckStage{Project: p, ID: b.ID, Stage: st.Name, Pending: run})
+					}
+				case st.Agent != "":
+					work[st.Agent] = fmt.Sprintf("%s/%d/%s/%d/%d", p, b.ID, st.Name, st.Progress, len(st.Command))
+				}
+			}
+		}
+	}
+	if d.agents == nil {
+		d.agents = make(map[string]agentSample)
+	}
+	seen := make(map[string]struct{}, len(a))
+	for i := range a {
+		if a[i].Status != pulse.AgentSync && a[i].Status != pulse.AgentBuilding {
+			continue
+		}
+		seen[a[i].Name] = struct{}{}
+		state := string(a[i].Status) + "/" + work[a[i].Name]
+		if prev, ok := d.agents[a[i].Name]; ok && prev.state == state {
+			if now.Sub(prev.since) >= d.Hang {
+				s.Agents = append(s.Agents, HungAgent{Agent: a[i], Since: prev.since})
+			}
+			continue
+		}
+		d.agents[a[i].Name] = agentSample{state: state, since: now}
+	}
+	for name := range d.agents {
+		if _, ok := seen[name]; !ok {
+			delete(d.agents, name)
+		}
+	}
+	return s, nil
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// Median gives a median of the given durations, 0 if there are none.
+func Median(d []time.Duration) time.Duration {
+	if len(d) == 0 {
+		return 0
+	}
+	s := make(durations, len(d))
+	copy(s, d)
+	sort.Sort(s)
+	if n := len(s); n%2 == 0 {
+		return (s[n/2-1] + s[n/2]) / 2
+	}
+	return s[len(s)/2]
+}
@@ -0,0 +1,125 @@
+package util
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/x-formation/pulsekit"
+	"github.com/x-formation/pulsekit/mock"
+)
+
+func TestMedian(t *testing.T) {
+	cases := []struct {
+		d   []time.Duration
+		exp time.Duration
+	}{
+		{nil, 0},
+		{[]time.Duration{3}, 3},
+		{[]time.Duration{5, 1, 3}, 3},
+		{[]time.Duration{4, 1, 2, 8}, 3},
+	}
+	for i, cas := range cases {
+		if m := Median(cas.d); m != cas.exp {
+			t.Errorf("expected median to be %v, was %v instead (i=%d)", cas.exp, m, i)
+		}
+	}
+}
+
+func history(now time.Time) []pulse.BuildResult {
+	start := now.Add(-4 * time.Hour)
+	h := []pulse.BuildResult{{
+		ID:    14,
+		Start: start,
+		Stages: []pulse.StageResult{
+			{Name: "Build - Linux x86", Agent: "Linux x86", Progress: 40},
+			{Name: "Build - Windows", Agent: pulse.AgentPending},
+			{Name: "Build - Linux x64", Agent: "Linux x64", Complete: true},
+		},
+	}}
+	for i, d := range []time.Duration{60, 50, 70, 65} {
+		h = append(h, pulse.BuildResult{
+			ID:       int64(13 - i),
+			Complete: true,
+			Start:    start.Add(-24 * time.Hour),
+			End:      start.Add(-24*time.Hour + d*time.Minute),
+		})
+	}
+	return h
+}
+
+func TestDetector(t *testing.T) {
+	now := time.Date(2014, 7, 1, 12, 0, 0, 0, time.UTC)
+	mc := mock.NewClient()
+	mc.Err = make([]error, 6)
+	mc.A = pulse.Agents{
+		{Name: "Linux x86", Status: pulse.AgentBuilding},
+		{Name: "Linux x64", Status: pulse.AgentSync},
+		{Name: "Windows", Status: pulse.AgentIdle},
+	}
+	mc.H = history(now)
+	d := NewDetector(mc)
+	d.now = func() time.Time { return now }
+	s, err := d.Sample([]string{"LM-X - Tier 1"})
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	if len(s.Builds) != 1 || s.Builds[0].ID != 14 || s.Builds[0].Running != 4*time.Hour ||
+		s.Builds[0].Median != 62*time.Minute+30*time.Second {
+		t.Errorf("expected build 14 to be stuck, was %+v instead", s.Builds)
+	}
+	if len(s.Stages) != 1 || s.Stages[0].Stage != "Build - Windows" {
+		t.Errorf("expected stage Build - Windows to be stuck, was %+v instead", s.Stages)
+	}
+	if len(s.Agents) != 0 {
+		t.Errorf("expected no agents to be hung after the first sample, was %+v instead", s.Agents)
+	}
+	// Linux x86 makes progress, Linux x64 does not.
+	mc.H[0].Stages[0].Progress = 50
+	now = now.Add(20 * time.Minute)
+	if s, err = d.Sample([]string{"LM-X - Tier 1"}); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	if len(s.Agents) != 1 || s.Agents[0].Agent.Name != "Linux x64" || !s.Agents[0].Since.Equal(now.Add(-20*time.Minute)) {
+		t.Errorf("expected Linux x64 to be hung, was %+v instead", s.Agents)
+	}
+	// Linux x64 is idle now.
+	mc.A[1].Status = pulse.AgentIdle
+	now = now.Add(20 * time.Minute)
+	if s, err = d.Sample([]string{"LM-X - Tier 1"}); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	if len(s.Agents) != 1 || s.Agents[0].Agent.Name != "Linux x86" {
+		t.Errorf("expected only Linux x86 to be hung, was %+v instead", s.Agents)
+	}
+	mc.Check(t)
+}
+
+func TestDetectorNoHistory(t *testing.T) {
+	now := time.Date(2014, 7, 1, 12, 0, 0, 0, time.UTC)
+	mc := mock.NewClient()
+	mc.Err = []error{nil, nil, errInvalidBuild}
+	mc.H = history(now)[:3]
+	d := NewDetector(mc)
+	d.now = func() time.Time { return now }
+	s, err := d.Sample([]string{"LM-X - Tier 1", "LM-X - Tier 2"})
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	if len(s.Builds) != 0 {
+		t.Errorf("expected no builds to be stuck, was %+v instead", s.Builds)
+	}
+	if len(s.Stages) != 1 {
+		t.Errorf("expected len(s.Stages) to be 1, was %d instead", len(s.Stages))
+	}
+	mc.Check(t)
+}
+
+func TestDetectorErr(t *testing.T) {
+	mc := mock.NewClient()
+	mc.Err = []error{nil, errors.New("err")}
+	if _, err := NewDetector(mc).Sample([]string{"LM-X - Tier 1"}); err == nil {
+		t.Error("expected err to be non-nil")
+	}
+	mc.Check(t)
+}
@@ -55,6 +55,50 @@ func Wait(c pulse.Client, d time.Duration, project string, id int64) <-chan erro
 	return done
 }
 
+// Follow waits for the build to complete like Wait does, calling fn for every
+// stage, which state, agent or progress changed since the previous poll.
+// A build, which does not exist yet (e.g. a personal build, which patch is
+// still being processed), is polled until it shows up.
+func Follow(c pulse.Client, d time.Duration, project string, id int64, fn func(pulse.StageResult)) <-chan error {
+	done := make(chan error)
+	go func() {
+		last := make(map[string]pulse.StageResult)
+		for {
+			b, err := c.BuildResult(project, id)
+			if _, ok := err.(*pulse.InvalidBuildError); ok {
+				time.Sleep(d)
+				continue
+			}
+			if err != nil {
+				done <- err
+				close(done)
+				return
+			}
+			complete := true
+			for i := range b {
+				for _, s := range b[i].Stages {
+					if l, ok := last[s.Name]; !ok || changed(&l, &s) {
+						last[s.Name] = s
+						fn(s)
+					}
+				}
+				complete = complete && b[i].Complete
+			}
+			if complete {
+				close(done)
+				return
+			}
+			time.Sleep(d)
+		}
+	}()
+	return done
+}
+
+func changed(a, b *pulse.StageResult) bool {
+	return a.State != b.State || a.Agent != b.Agent || a.Progress != b.Progress ||
+		a.Complete != b.Complete
+}
+
 // NormalizeBuildID TODO(rjeczalik): document
 func NormalizeBuildID(c pulse.Client, p string, id int64) (int64, error) {
 	// Regular build ID.
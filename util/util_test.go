@@ -66,6 +66,37 @@ func TestWaitErr(t *testing.T) {
 	mc.Check(t)
 }
 
+func TestFollow(t *testing.T) {
+	mc := mock.NewClient()
+	mc.Err = []error{errInvalidBuild, nil}
+	mc.BR = []pulse.BuildResult{{
+		Complete: true,
+		Stages: []pulse.StageResult{
+			{Name: "Build - Linux x86", State: pulse.BuildSuccess, Complete: true},
+			{Name: "Build - Linux x64", State: pulse.BuildFailure, Complete: true},
+		},
+	}}
+	var stages []string
+	fn := func(s pulse.StageResult) { stages = append(stages, s.Name) }
+	if err, ok := <-Follow(mc, 0, pulse.ProjectPersonal, 12, fn); err != nil || ok {
+		t.Errorf("expected err=nil and ok=false, was err=%q, ok=%v", err, ok)
+	}
+	if len(stages) != 2 || stages[0] != "Build - Linux x86" || stages[1] != "Build - Linux x64" {
+		t.Errorf("expected fn to be called for both stages, was called for %v instead", stages)
+	}
+	mc.Check(t)
+}
+
+func TestFollowErr(t *testing.T) {
+	mc := mock.NewClient()
+	mc.Err = []error{errors.New("err")}
+	fn := func(pulse.StageResult) { t.Error("expected fn to not be called") }
+	if err, ok := <-Follow(mc, 0, pulse.ProjectPersonal, 12, fn); err == nil || !ok {
+		t.Errorf("expected err!=nil and ok=true, was err=%q, ok=%v", err, ok)
+	}
+	mc.Check(t)
+}
+
 var errInvalidBuild = &pulse.InvalidBuildError{Status: pulse.BuildUnknown}
 
 type fixture struct {
@@ -0,0 +1,158 @@
+package watch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sink receives events detected by a Watcher.
+type Sink interface {
+	// Notify dispatches a notification about the event.
+	Notify(e *Event) error
+}
+
+// Command is a sink, which runs a shell command for every event. The event
+// is written to the standard input of the command in the JSON format, and
+// its fields are passed in the PULSE_EVENT, PULSE_PROJECT, PULSE_BUILD,
+// PULSE_STATE, PULSE_AGENT, PULSE_HOST and PULSE_TEXT environment variables.
+type Command struct {
+	Cmd string
+}
+
+// Notify implements Sink.
+func (c Command) Notify(e *Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", c.Cmd)
+	} else {
+		cmd = exec.Command("sh", "-c", c.Cmd)
+	}
+	cmd.Env = append(os.Environ(),
+		"PULSE_EVENT="+string(e.Type),
+		"PULSE_PROJECT="+e.Project,
+		"PULSE_BUILD="+strconv.FormatInt(e.ID, 10),
+		"PULSE_STATE="+string(e.State),
+		"PULSE_AGENT="+e.Agent,
+		"PULSE_HOST="+e.Host,
+		"PULSE_TEXT="+e.Text,
+	)
+	cmd.Stdin = bytes.NewReader(b)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("pulse: command %q failed: %v: %s", c.Cmd, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// Webhook is a sink, which posts every event to the URL in the JSON format.
+type Webhook struct {
+	URL string
+	// Client is used to post the events, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// Notify implements Sink.
+func (w Webhook) Notify(e *Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	c := w.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+	resp, err := c.Post(w.URL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("pulse: webhook %s responded with %s", w.URL, resp.Status)
+	}
+	return nil
+}
+
+// Mail is a sink, which sends every event in an email.
+type Mail struct {
+	// Addr is an address of the SMTP server, e.g. "smtp.example.com:25".
+	Addr string
+	From string
+	To   []string
+	// Auth is used to authenticate with the SMTP server, if non-nil.
+	Auth smtp.Auth
+}
+
+// Notify implements Sink.
+func (m Mail) Notify(e *Event) error {
+	return smtp.SendMail(m.Addr, m.Auth, m.From, m.To, m.message(e))
+}
+
+func (m Mail) message(e *Event) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", m.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(m.To, ", "))
+	fmt.Fprintf(&buf, "Subject: [pulse] %s\r\n", e.Text)
+	fmt.Fprintf(&buf, "Date: %s\r\n", e.Time.Format(time.RFC1123Z))
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&buf, "%s\r\n\r\n", e.Text)
+	for _, f := range [][2]string{
+		{"Event", string(e.Type)},
+		{"Project", e.Project},
+		{"Build", strconv.FormatInt(e.ID, 10)},
+		{"State", string(e.State)},
+		{"Agent", e.Agent},
+		{"Host", e.Host},
+	} {
+		if f[1] != "" && f[1] != "0" {
+			fmt.Fprintf(&buf, "%s: %s\r\n", f[0], f[1])
+		}
+	}
+	return buf.Bytes()
+}
+
+// Log is a sink, which writes every event as a single line of JSON.
+type Log struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewLog gives a Log sink, which writes to w.
+func NewLog(w io.Writer) *Log {
+	return &Log{w: w}
+}
+
+// OpenLog gives a Log sink, which appends to a file under the given path.
+// The file is created if it does not exist.
+func OpenLog(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewLog(f), nil
+}
+
+// Notify implements Sink.
+func (l *Log) Notify(e *Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.w.Write(append(b, '\n'))
+	return err
+}
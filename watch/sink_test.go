@@ -0,0 +1,117 @@
+package watch
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+var event = Event{
+	Type:    BuildBroken,
+	Project: "Pulse CLI",
+	ID:      131,
+	State:   "failure",
+	Time:    time.Date(2014, 7, 1, 12, 0, 0, 0, time.UTC),
+	Text:    "Pulse CLI is broken: build 131 failed",
+}
+
+func TestWebhook(t *testing.T) {
+	var got Event
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("expected Content-Type to be application/json, was %q instead", ct)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("expected err to be nil, was %q instead", err)
+		}
+	}))
+	defer srv.Close()
+	if err := (Webhook{URL: srv.URL}).Notify(&event); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	if got != event {
+		t.Errorf("expected %+v, was %+v instead", event, got)
+	}
+}
+
+func TestWebhookErr(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "err", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	if err := (Webhook{URL: srv.URL}).Notify(&event); err == nil {
+		t.Error("expected err to be non-nil")
+	}
+}
+
+func TestLog(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLog(&buf)
+	for i := 0; i < 2; i++ {
+		if err := l.Notify(&event); err != nil {
+			t.Fatalf("expected err to be nil, was %q instead (i=%d)", err, i)
+		}
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, was %q instead", buf.String())
+	}
+	for i, line := range lines {
+		var e Event
+		if err := json.Unmarshal([]byte(line), &e); err != nil || e != event {
+			t.Errorf("expected %+v, was %+v instead (err=%v, i=%d)", event, e, err, i)
+		}
+	}
+}
+
+func TestCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("TODO(rjeczalik): test cmd /C")
+	}
+	dir, err := ioutil.TempDir("", "pulsekit")
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+	cmd := Command{Cmd: `echo "$PULSE_EVENT $PULSE_PROJECT $PULSE_BUILD" > ` + out + ` && cat >> ` + out}
+	if err = cmd.Notify(&event); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	if exp := "broken Pulse CLI 131\n{"; !strings.HasPrefix(string(b), exp) {
+		t.Errorf("expected output to start with %q, was %q instead", exp, b)
+	}
+	if err = (Command{Cmd: "exit 1"}).Notify(&event); err == nil {
+		t.Error("expected err to be non-nil")
+	}
+}
+
+func TestMailMessage(t *testing.T) {
+	m := Mail{From: "pulse@example.com", To: []string{"dev@example.com", "qa@example.com"}}
+	msg := string(m.message(&event))
+	for _, exp := range []string{
+		"To: dev@example.com, qa@example.com\r\n",
+		"Subject: [pulse] Pulse CLI is broken: build 131 failed\r\n",
+		"Project: Pulse CLI\r\n",
+		"Build: 131\r\n",
+	} {
+		if !strings.Contains(msg, exp) {
+			t.Errorf("expected message to contain %q, was %q instead", exp, msg)
+		}
+	}
+	if strings.Contains(msg, "Agent:") {
+		t.Errorf("expected message to not contain empty fields, was %q instead", msg)
+	}
+}
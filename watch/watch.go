@@ -0,0 +1,280 @@
+// Package watch polls a Pulse server for state transitions of projects and
+// agents and dispatches notifications about them to sinks.
+package watch
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/x-formation/pulsekit"
+
+	"gopkg.in/v1/yaml"
+)
+
+// EventType is a type of a state transition.
+type EventType string
+
+const (
+	// BuildBroken is a transition of a project from success to failure.
+	BuildBroken EventType = "broken"
+	// BuildFixed is a transition of a project from failure to success.
+	BuildFixed EventType = "fixed"
+	// AgentOffline is a transition of an agent to the offline status.
+	AgentOffline EventType = "agent-offline"
+	// AgentOnline is a transition of an agent from the offline status.
+	AgentOnline EventType = "agent-online"
+)
+
+// Event describes a single state transition.
+type Event struct {
+	Type    EventType        `json:"type" yaml:"type"`
+	Project string           `json:"project,omitempty" yaml:"project,omitempty"`
+	ID      int64            `json:"build,omitempty" yaml:"build,omitempty"`
+	State   pulse.BuildState `json:"state,omitempty" yaml:"state,omitempty"`
+	Agent   string           `json:"agent,omitempty" yaml:"agent,omitempty"`
+	Host    string           `json:"host,omitempty" yaml:"host,omitempty"`
+	Time    time.Time        `json:"time" yaml:"time"`
+	// Text is a human-readable description of the event.
+	Text string `json:"text" yaml:"text"`
+}
+
+func (e *Event) String() string {
+	return e.Text
+}
+
+func buildEvent(typ EventType, p string, b *pulse.BuildResult, t time.Time) Event {
+	e := Event{Type: typ, Project: p, ID: b.ID, State: b.State, Time: t}
+	if typ == BuildBroken {
+		e.Text = fmt.Sprintf("%s is broken: build %d failed", p, b.ID)
+	} else {
+		e.Text = fmt.Sprintf("%s is fixed: build %d succeeded", p, b.ID)
+	}
+	return e
+}
+
+func agentEvent(typ EventType, a *pulse.Agent, t time.Time) Event {
+	e := Event{Type: typ, Agent: a.Name, Host: a.Host, Time: t}
+	if typ == AgentOffline {
+		e.Text = fmt.Sprintf("Agent %s (%s) went offline", a.Name, a.Host)
+	} else {
+		e.Text = fmt.Sprintf("Agent %s (%s) is back online", a.Name, a.Host)
+	}
+	return e
+}
+
+// Seen is the last seen completed build of a project.
+type Seen struct {
+	ID      int64 `yaml:"id"`
+	Success bool  `yaml:"success"`
+}
+
+// State is the last seen state of a Pulse server, which transitions are
+// detected against.
+type State struct {
+	Builds  map[string]Seen `yaml:"builds"`
+	Offline map[string]bool `yaml:"offline"`
+	// Pending are events, which were not dispatched to a sink yet, keyed
+	// by the sink's index and type.
+	Pending map[string][]Event `yaml:"pending,omitempty"`
+}
+
+// MaxPending is a maximum number of events kept for a failing sink, the oldest
+// ones are dropped above it.
+const MaxPending = 1000
+
+func sinkKey(i int, s Sink) string {
+	return fmt.Sprintf("%d:%T", i, s)
+}
+
+// Watcher polls a Pulse server and dispatches events about state transitions
+// to its sinks. Projects and agents seen for the first time are recorded
+// without dispatching any event.
+type Watcher struct {
+	// Client is used to communicate with a Pulse server.
+	Client pulse.Client
+	// Projects filters projects which are watched, all projects if nil.
+	Projects func([]string) []string
+	// Interval is a time between two polls.
+	Interval time.Duration
+	// Sinks receive every detected event.
+	Sinks []Sink
+	// Error is called by Run with errors of polls, if non-nil.
+	Error func(error)
+
+	path  string
+	state State
+	now   func() time.Time
+}
+
+// New gives a Watcher, which polls the Pulse server every minute. The state
+// of the Pulse server is persisted in a file under the given path after each
+// poll, so transitions which happened while the watcher was not running are
+// detected after a restart. The state is not persisted if the path is empty.
+func New(c pulse.Client, path string) (*Watcher, error) {
+	w := &Watcher{
+		Client:   c,
+		Interval: time.Minute,
+		path:     path,
+		state:    State{Builds: make(map[string]Seen), Offline: make(map[string]bool)},
+		now:      time.Now,
+	}
+	if path == "" {
+		return w, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return w, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = yaml.Unmarshal(b, &w.state); err != nil {
+		return nil, fmt.Errorf("pulse: invalid watch state %s: %v", path, err)
+	}
+	if w.state.Builds == nil {
+		w.state.Builds = make(map[string]Seen)
+	}
+	if w.state.Offline == nil {
+		w.state.Offline = make(map[string]bool)
+	}
+	return w, nil
+}
+
+// Run polls the Pulse server every w.Interval until the stop channel
+// is closed.
+func (w *Watcher) Run(stop <-chan struct{}) {
+	for {
+		if _, err := w.Poll(); err != nil && w.Error != nil {
+			w.Error(err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(w.Interval):
+		}
+	}
+}
+
+// Poll polls the Pulse server once, dispatching events about detected state
+// transitions to every sink. It returns the events and the first error, either
+// of the poll or of a sink. A failing sink does not stop the dispatch.
+//
+// Events a sink failed to receive are kept pending for that sink only, and
+// are dispatched to it, in order, before the events of the next poll. They
+// are persisted together with the state, so they survive a restart as long
+// as the sinks are configured the same way.
+func (w *Watcher) Poll() ([]Event, error) {
+	ev, state, err := w.poll()
+	if err != nil {
+		return nil, err
+	}
+	state.Pending = make(map[string][]Event)
+	for i, s := range w.Sinks {
+		k := sinkKey(i, s)
+		queue := append(append([]Event(nil), w.state.Pending[k]...), ev...)
+		for j := range queue {
+			if e := s.Notify(&queue[j]); e != nil {
+				if err == nil {
+					err = e
+				}
+				if queue = queue[j:]; len(queue) > MaxPending {
+					queue = queue[len(queue)-MaxPending:]
+				}
+				state.Pending[k] = queue
+				break
+			}
+		}
+	}
+	w.state = state
+	if e := w.save(); e != nil {
+		return ev, e
+	}
+	return ev, err
+}
+
+// poll detects state transitions against the last seen state, giving
+// the events and the new state.
+func (w *Watcher) poll() (ev []Event, state State, err error) {
+	now := w.now()
+	a, err := w.Client.Agents()
+	if err != nil {
+		return nil, state, err
+	}
+	p, err := w.Client.Projects()
+	if err != nil {
+		return nil, state, err
+	}
+	if w.Projects != nil {
+		p = w.Projects(p)
+	}
+	builds := make(map[string]Seen, len(p))
+	for _, p := range p {
+		b, err := w.Client.LatestBuildResult(p)
+		if err != nil {
+			if _, ok := err.(*pulse.InvalidBuildError); ok {
+				continue
+			}
+			return nil, state, err
+		}
+		if len(b) == 0 {
+			continue
+		}
+		cur := Seen{ID: b[0].ID, Success: b[0].Success}
+		builds[p] = cur
+		prev, ok := w.state.Builds[p]
+		if !ok || prev.ID == cur.ID || prev.Success == cur.Success {
+			continue
+		}
+		if cur.Success {
+			ev = append(ev, buildEvent(BuildFixed, p, &b[0], now))
+		} else {
+			ev = append(ev, buildEvent(BuildBroken, p, &b[0], now))
+		}
+	}
+	offline := make(map[string]bool, len(a))
+	for i := range a {
+		off := a[i].Status == pulse.AgentOffline
+		offline[a[i].Name] = off
+		prev, ok := w.state.Offline[a[i].Name]
+		if !ok || prev == off {
+			continue
+		}
+		if off {
+			ev = append(ev, agentEvent(AgentOffline, &a[i], now))
+		} else {
+			ev = append(ev, agentEvent(AgentOnline, &a[i], now))
+		}
+	}
+	// Builds of projects, which are not watched now, are kept, so they are
+	// not reported as new ones when they are watched again.
+	state = State{Builds: make(map[string]Seen, len(w.state.Builds)), Offline: offline}
+	for p, b := range w.state.Builds {
+		state.Builds[p] = b
+	}
+	for p, b := range builds {
+		state.Builds[p] = b
+	}
+	return ev, state, nil
+}
+
+// save writes the state to the state file.
+func (w *Watcher) save() error {
+	if w.path == "" {
+		return nil
+	}
+	b, err := yaml.Marshal(&w.state)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(w.path), 0700); err != nil {
+		return err
+	}
+	tmp := w.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, w.path)
+}
@@ -0,0 +1,156 @@
+package watch
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/x-formation/pulsekit"
+	"github.com/x-formation/pulsekit/mock"
+)
+
+type recorder []Event
+
+func (r *recorder) Notify(e *Event) error {
+	*r = append(*r, *e)
+	return nil
+}
+
+// flaky fails the first n notifications, recording the following ones.
+type flaky struct {
+	n   int
+	rec recorder
+}
+
+func (f *flaky) Notify(e *Event) error {
+	if f.n > 0 {
+		f.n--
+		return errors.New("err")
+	}
+	return f.rec.Notify(e)
+}
+
+func TestPoll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pulsekit")
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "watch", "watch.yml")
+	mc := mock.NewClient()
+	mc.Err = make([]error, 12)
+	mc.P = []string{"Pulse CLI"}
+	polls := []struct {
+		build   pulse.BuildResult
+		status  pulse.AgentStatus
+		restart bool
+		exp     []EventType
+	}{
+		{pulse.BuildResult{ID: 10, Success: true}, pulse.AgentIdle, false, nil},
+		{pulse.BuildResult{ID: 11, State: pulse.BuildFailure}, pulse.AgentOffline, false,
+			[]EventType{BuildBroken, AgentOffline}},
+		{pulse.BuildResult{ID: 11, State: pulse.BuildFailure}, pulse.AgentOffline, true, nil},
+		{pulse.BuildResult{ID: 12, Success: true}, pulse.AgentIdle, true,
+			[]EventType{BuildFixed, AgentOnline}},
+	}
+	var w *Watcher
+	for i, poll := range polls {
+		if w == nil || poll.restart {
+			if w, err = New(mc, path); err != nil {
+				t.Fatalf("expected err to be nil, was %q instead (i=%d)", err, i)
+			}
+		}
+		var rec recorder
+		w.Sinks = []Sink{&rec}
+		mc.L = []pulse.BuildResult{poll.build}
+		mc.A = pulse.Agents{{Name: "Linux x86", Host: "linux86:8090", Status: poll.status}}
+		ev, err := w.Poll()
+		if err != nil {
+			t.Fatalf("expected err to be nil, was %q instead (i=%d)", err, i)
+		}
+		if len(ev) != len(poll.exp) || len(rec) != len(poll.exp) {
+			t.Errorf("expected %d events, was %v instead (i=%d)", len(poll.exp), ev, i)
+			continue
+		}
+		for j := range ev {
+			if ev[j].Type != poll.exp[j] {
+				t.Errorf("expected event type to be %q, was %q instead (i=%d, j=%d)", poll.exp[j], ev[j].Type, i, j)
+			}
+		}
+	}
+	mc.Check(t)
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("expected state to be persisted with 0600 mode, was fi=%v, err=%v", fi, err)
+	}
+}
+
+func TestPollText(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pulsekit")
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "watch.yml")
+	mc := mock.NewClient()
+	mc.Err = make([]error, 12)
+	mc.P = []string{"Pulse CLI"}
+	mc.L = []pulse.BuildResult{{ID: 130, Success: true}}
+	w, err := New(mc, path)
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	if _, err = w.Poll(); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	mc.L = []pulse.BuildResult{{ID: 131}}
+	fl := &flaky{n: 2}
+	w.Sinks = []Sink{fl, &recorder{}}
+	ev, err := w.Poll()
+	if err == nil {
+		t.Error("expected err to be non-nil")
+	}
+	if exp := "Pulse CLI is broken: build 131 failed"; len(ev) != 1 || ev[0].Text != exp {
+		t.Errorf("expected %q event, was %v instead", exp, ev)
+	}
+	if rec := w.Sinks[1].(*recorder); len(*rec) != 1 {
+		t.Errorf("expected failing sink to not stop the dispatch, was %v instead", *rec)
+	}
+	// The event is kept pending for the failing sink only, also across
+	// a restart, while the state advances.
+	rec := w.Sinks[1].(*recorder)
+	if w, err = New(mc, path); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	w.Sinks = []Sink{fl, rec}
+	if _, err = w.Poll(); err == nil {
+		t.Error("expected err to be non-nil")
+	}
+	if ev, err = w.Poll(); err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	if len(ev) != 0 {
+		t.Errorf("expected no new events, was %v instead", ev)
+	}
+	if len(fl.rec) != 1 || fl.rec[0].ID != 131 {
+		t.Errorf("expected undelivered event to be dispatched again, was %v instead", fl.rec)
+	}
+	if len(*rec) != 1 {
+		t.Errorf("expected delivered event to not be dispatched again, was %v instead", *rec)
+	}
+	mc.Check(t)
+}
+
+func TestPollErr(t *testing.T) {
+	mc := mock.NewClient()
+	mc.Err = []error{nil, errors.New("err")}
+	w, err := New(mc, "")
+	if err != nil {
+		t.Fatalf("expected err to be nil, was %q instead", err)
+	}
+	if _, err = w.Poll(); err == nil {
+		t.Error("expected err to be non-nil")
+	}
+	mc.Check(t)
+}